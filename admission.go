@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 请求优先级，数值越大越优先
+const (
+	priorityLow      = 0
+	priorityNormal   = 1
+	priorityHigh     = 2
+	priorityCritical = 3
+)
+
+// 客户端指定优先级的请求Header
+const priorityHeader = "X-Priority"
+
+var priorityNames = map[string]int{
+	"low":      priorityLow,
+	"normal":   priorityNormal,
+	"high":     priorityHigh,
+	"critical": priorityCritical,
+}
+
+// 优先级配置：PRIORITY_KEY_POLICIES（调用方Key标识→优先级）、PRIORITY_DEFAULT
+var priorities struct {
+	keyPolicies map[string]int
+	defaultPrio int
+}
+
+// 上游并发限制（上游的concurrency字段）：超过并发上限的请求按优先级排队
+type ConcurrencyConfig struct {
+	MaxConcurrent int      `json:"max_concurrent"` // 同时发往该上游的最大请求数（流式请求直到响应结束）
+	MaxQueue      int      `json:"max_queue"`      // 排队请求上限，默认100；队列满时挤出优先级更低的请求
+	MaxQueueTime  Duration `json:"max_queue_time"` // 最长排队时间，默认10s，超时返回503
+}
+
+// 解析优先级名称或数字
+func parsePriority(s string) (int, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if p, ok := priorityNames[s]; ok {
+		return p, true
+	}
+	if p, err := strconv.Atoi(s); err == nil && p >= priorityLow && p <= priorityCritical {
+		return p, true
+	}
+	return 0, false
+}
+
+func priorityName(p int) string {
+	for name, value := range priorityNames {
+		if value == p {
+			return name
+		}
+	}
+	return strconv.Itoa(p)
+}
+
+// 初始化优先级配置
+func initPriorities() {
+	priorities.defaultPrio = priorityNormal
+	if p, ok := parsePriority(getEnv("PRIORITY_DEFAULT", "normal")); ok {
+		priorities.defaultPrio = p
+	}
+	var policies map[string]string
+	if _, err := loadJSONEnv("PRIORITY_KEY_POLICIES", &policies); err != nil {
+		slog.Error("PRIORITY_KEY_POLICIES配置错误，已忽略", "error", err)
+	}
+	priorities.keyPolicies = make(map[string]int, len(policies))
+	for key, name := range policies {
+		p, ok := parsePriority(name)
+		if !ok {
+			slog.Warn("不支持的优先级，已忽略", "key", key, "priority", name)
+			continue
+		}
+		priorities.keyPolicies[key] = p
+	}
+}
+
+// 请求的优先级：配置了Key策略时以策略为上限，X-Priority只能降低；
+// 未配置时使用X-Priority，都没有时为PRIORITY_DEFAULT
+func requestPriority(ctx context.Context) int {
+	p, hasPolicy := priorities.defaultPrio, false
+	if info := getRequestInfo(ctx); info != nil {
+		p, hasPolicy = priorities.keyPolicies[info.Key]
+		if !hasPolicy {
+			p = priorities.defaultPrio
+		}
+	}
+	if requested, ok := parsePriority(requestHeader(ctx, priorityHeader)); ok {
+		if !hasPolicy || requested < p {
+			p = requested
+		}
+	}
+	return p
+}
+
+// 上游的准入控制：并发槽位和按优先级排序的等待队列
+type admission struct {
+	upstream string
+	cfg      *ConcurrencyConfig
+
+	mu     sync.Mutex
+	active int
+	queue  waiterQueue
+	seq    uint64
+}
+
+// 排队中的请求
+type waiter struct {
+	priority int
+	seq      uint64
+	index    int
+	result   chan error // 获得槽位时收到nil，被挤出时收到错误
+}
+
+// 等待队列：优先级高的在前，同优先级先到先得
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int { return len(q) }
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *waiterQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waiterQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// 填充默认值并创建准入控制
+func newAdmission(upstream string, cfg *ConcurrencyConfig) *admission {
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = 100
+	}
+	if cfg.MaxQueueTime <= 0 {
+		cfg.MaxQueueTime = Duration(10 * time.Second)
+	}
+	return &admission{upstream: upstream, cfg: cfg}
+}
+
+// 被拒绝的请求：设置Retry-After并返回OpenAI格式的错误
+func shedError(ctx context.Context, status int, message string) error {
+	setResponseHeader(ctx, "Retry-After", "1")
+	return &proxyError{status, "upstream_overloaded", message}
+}
+
+// 获取一个并发槽位，返回释放函数
+// 队列已满时挤出队列中优先级最低（同优先级中最晚到达）的请求，新请求优先级不高于它时直接拒绝（429）；
+// 排队超过max_queue_time返回503
+func (a *admission) acquire(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	priority := requestPriority(ctx)
+	label := priorityName(priority)
+
+	a.mu.Lock()
+	if a.active < a.cfg.MaxConcurrent && a.queue.Len() == 0 {
+		a.active++
+		a.mu.Unlock()
+		metricQueueWait.observe(0, a.upstream, label)
+		return a.release, nil
+	}
+	if a.queue.Len() >= a.cfg.MaxQueue {
+		lowest := a.queue.lowest()
+		if lowest == nil || lowest.priority >= priority {
+			a.mu.Unlock()
+			metricShed.add(1, a.upstream, label, "queue_full")
+			return nil, shedError(ctx, http.StatusTooManyRequests, fmt.Sprintf("上游%s繁忙，排队已满", a.upstream))
+		}
+		heap.Remove(&a.queue, lowest.index)
+		lowest.result <- fmt.Errorf("被优先级更高的请求挤出队列")
+	}
+	a.seq++
+	w := &waiter{priority: priority, seq: a.seq, result: make(chan error, 1)}
+	heap.Push(&a.queue, w)
+	a.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(time.Duration(a.cfg.MaxQueueTime))
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-w.result:
+	case <-timer.C:
+		err = a.abandon(w, fmt.Errorf("上游%s繁忙，排队超过%s", a.upstream, time.Duration(a.cfg.MaxQueueTime)))
+	case <-ctx.Done():
+		err = a.abandon(w, contextError(ctx))
+	}
+	metricQueueWait.observe(time.Since(start).Seconds(), a.upstream, label)
+	if err == nil {
+		return a.release, nil
+	}
+	switch {
+	case ctx.Err() != nil:
+		return nil, err
+	case w.index == waiterAbandoned:
+		metricShed.add(1, a.upstream, label, "queue_timeout")
+		return nil, shedError(ctx, http.StatusServiceUnavailable, err.Error())
+	default:
+		metricShed.add(1, a.upstream, label, "preempted")
+		logger(ctx).Warn("请求被挤出上游队列", "upstream", a.upstream, "priority", label)
+		return nil, shedError(ctx, http.StatusTooManyRequests, fmt.Sprintf("上游%s繁忙，请求被优先级更高的请求挤出队列", a.upstream))
+	}
+}
+
+// 不排队地获取一个并发槽位（用于对冲请求）：有空闲槽位且没有请求在排队时返回释放函数，否则返回false
+func (a *admission) tryAcquire() (func(), bool) {
+	if a == nil {
+		return func() {}, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active >= a.cfg.MaxConcurrent || a.queue.Len() > 0 {
+		return nil, false
+	}
+	a.active++
+	return a.release, true
+}
+
+// 放弃排队的waiter的index
+const waiterAbandoned = -2
+
+// 放弃排队；已获得槽位（返回nil）或已被挤出时以该结果为准
+func (a *admission) abandon(w *waiter, err error) error {
+	a.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&a.queue, w.index)
+		w.index = waiterAbandoned
+		a.mu.Unlock()
+		return err
+	}
+	a.mu.Unlock()
+	return <-w.result
+}
+
+// 释放槽位，交给队列中优先级最高的请求
+func (a *admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.queue.Len() > 0 {
+		w := heap.Pop(&a.queue).(*waiter)
+		w.result <- nil
+		return
+	}
+	a.active--
+}
+
+// 队列中最先被挤出的请求：优先级最低，同优先级中最晚到达
+func (q waiterQueue) lowest() *waiter {
+	var lowest *waiter
+	for _, w := range q {
+		if lowest == nil || w.priority < lowest.priority || (w.priority == lowest.priority && w.seq > lowest.seq) {
+			lowest = w
+		}
+	}
+	return lowest
+}
+
+// 当前排队数和进行中的请求数
+func (a *admission) depth() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queue.Len(), a.active
+}
+
+// 响应体关闭时释放并发槽位
+type admissionBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *admissionBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
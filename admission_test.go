@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 带调用方Key和X-Priority的请求上下文
+func priorityContext(key, priority string) (context.Context, *requestInfo) {
+	info := &requestInfo{header: http.Header{}, requestHeader: http.Header{}, Key: key}
+	if priority != "" {
+		info.requestHeader.Set(priorityHeader, priority)
+	}
+	return context.WithValue(context.Background(), requestInfoKey{}, info), info
+}
+
+func TestRequestPriority(t *testing.T) {
+	old := priorities
+	t.Cleanup(func() { priorities = old })
+	priorities.defaultPrio = priorityNormal
+	priorities.keyPolicies = map[string]int{"key-vip": priorityHigh}
+
+	tests := []struct {
+		name   string
+		key    string
+		header string
+		want   int
+	}{
+		{"默认优先级", "key-other", "", priorityNormal},
+		{"Header指定", "key-other", "critical", priorityCritical},
+		{"Header为数字", "key-other", "0", priorityLow},
+		{"无效Header被忽略", "key-other", "urgent", priorityNormal},
+		{"Key策略", "key-vip", "", priorityHigh},
+		{"Header不能超过Key策略", "key-vip", "critical", priorityHigh},
+		{"Header可以降低Key策略", "key-vip", "low", priorityLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _ := priorityContext(tt.key, tt.header)
+			if got := requestPriority(ctx); got != tt.want {
+				t.Fatalf("priority = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// 在后台排队，返回获取结果的channel；等到请求进入队列后才返回
+func enqueue(t *testing.T, a *admission, ctx context.Context) <-chan error {
+	t.Helper()
+	queued, _ := a.depth()
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.acquire(ctx)
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if n, _ := a.depth(); n > queued {
+			return done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("请求未进入队列")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func wantStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var pe *proxyError
+	if !errors.As(err, &pe) || pe.Status != status {
+		t.Fatalf("err = %v, want status %d", err, status)
+	}
+}
+
+func TestAdmissionPriorityOrder(t *testing.T) {
+	a := newAdmission("u", &ConcurrencyConfig{MaxConcurrent: 1})
+	ctx, _ := priorityContext("", "")
+	release, err := a.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"low", "normal", "high", "normal"}
+	waiting := make([]<-chan error, len(names))
+	for i, name := range names {
+		ctx, _ := priorityContext("", name)
+		waiting[i] = enqueue(t, a, ctx)
+	}
+
+	// 依次释放槽位，获得槽位的顺序应为high、先到的normal、后到的normal、low
+	for _, i := range []int{2, 1, 3, 0} {
+		release()
+		select {
+		case err := <-waiting[i]:
+			if err != nil {
+				t.Fatalf("waiter %d: %s", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d (%s) 未获得槽位", i, names[i])
+		}
+	}
+	release()
+	if queued, active := a.depth(); queued != 0 || active != 0 {
+		t.Fatalf("queued=%d active=%d", queued, active)
+	}
+}
+
+func TestAdmissionQueueFull(t *testing.T) {
+	a := newAdmission("u", &ConcurrencyConfig{MaxConcurrent: 1, MaxQueue: 1})
+	ctx, _ := priorityContext("", "")
+	release, _ := a.acquire(ctx)
+	normal, _ := priorityContext("", "normal")
+	queued := enqueue(t, a, normal)
+
+	// 优先级不高于队列中最低的请求：直接拒绝
+	low, info := priorityContext("", "low")
+	if _, err := a.acquire(low); err == nil {
+		t.Fatal("队列已满时低优先级请求应被拒绝")
+	} else {
+		wantStatus(t, err, http.StatusTooManyRequests)
+	}
+	if info.header.Get("Retry-After") == "" {
+		t.Fatal("被拒绝的请求应设置Retry-After")
+	}
+
+	// 高优先级请求挤出队列中的normal请求
+	high, _ := priorityContext("", "high")
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.acquire(high)
+		done <- err
+	}()
+	select {
+	case err := <-queued:
+		wantStatus(t, err, http.StatusTooManyRequests)
+	case <-time.After(time.Second):
+		t.Fatal("normal请求未被挤出")
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionAbandon(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+		status int
+	}{
+		{"排队超时", false, http.StatusServiceUnavailable},
+		{"客户端取消", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission("u", &ConcurrencyConfig{MaxConcurrent: 1, MaxQueueTime: Duration(20 * time.Millisecond)})
+			base, _ := priorityContext("", "")
+			release, _ := a.acquire(base)
+
+			ctx, cancel := context.WithCancel(base)
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(5*time.Millisecond, cancel)
+			}
+			_, err := a.acquire(ctx)
+			if tt.status != 0 {
+				wantStatus(t, err, tt.status)
+			} else if err == nil {
+				t.Fatal("取消后应返回错误")
+			}
+
+			// 放弃排队的请求不应占用槽位
+			release()
+			if queued, active := a.depth(); queued != 0 || active != 0 {
+				t.Fatalf("queued=%d active=%d", queued, active)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anthropic响应中的内容块
+type AnthropicContentBlock struct {
+	Type  string      `json:"type"`
+	Text  string      `json:"text,omitempty"`
+	ID    string      `json:"id,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Input interface{} `json:"input,omitempty"`
+}
+
+// Anthropic Messages响应结构
+type AnthropicMessage struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// Anthropic的token用量
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// 以Anthropic错误格式返回给客户端
+func writeAnthropicError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if pe, ok := err.(*proxyError); ok {
+		status = pe.Status
+	}
+	c.JSON(status, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    anthropicErrorType(status),
+			"message": err.Error(),
+		},
+	})
+}
+
+// 按HTTP状态码映射Anthropic错误类型
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusBadRequest:
+		return "invalid_request_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// 将OpenAI的finish_reason映射为Anthropic的stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// 将system字段（字符串或文本块数组）转换为文本
+func anthropicSystemText(v interface{}) string {
+	switch system := v.(type) {
+	case string:
+		return system
+	case []interface{}:
+		var parts []string
+		for _, item := range system {
+			if block, ok := item.(map[string]interface{}); ok && stringValue(block["type"]) == "text" {
+				parts = append(parts, stringValue(block["text"]))
+			}
+		}
+		return strings.Join(parts, "\n")
+	default:
+		return ""
+	}
+}
+
+// 将tool_result的content（字符串或内容块数组）转换为文本
+func anthropicToolResultText(v interface{}) string {
+	if blocks, ok := v.([]interface{}); ok {
+		var parts []string
+		for _, item := range blocks {
+			if block, ok := item.(map[string]interface{}); ok && stringValue(block["type"]) == "text" {
+				parts = append(parts, stringValue(block["text"]))
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return stringValue(v)
+}
+
+// 将单条Anthropic消息转换为一条或多条OpenAI消息
+// tool_result块转换为role=tool消息，tool_use块转换为assistant的tool_calls
+func convertAnthropicMessage(message map[string]interface{}) ([]map[string]interface{}, error) {
+	role := stringValue(message["role"])
+	if role != "user" && role != "assistant" {
+		return nil, fmt.Errorf("不支持的消息角色: %s", role)
+	}
+	if text, ok := message["content"].(string); ok {
+		return []map[string]interface{}{{"role": role, "content": text}}, nil
+	}
+	blocks, ok := message["content"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("content格式错误，应为字符串或内容块数组")
+	}
+
+	var (
+		messages  []map[string]interface{}
+		parts     []map[string]interface{}
+		toolCalls []map[string]interface{}
+		hasImage  bool
+	)
+	for _, item := range blocks {
+		block, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch blockType := stringValue(block["type"]); blockType {
+		case "text":
+			parts = append(parts, map[string]interface{}{"type": "text", "text": stringValue(block["text"])})
+		case "image":
+			source, _ := block["source"].(map[string]interface{})
+			url := stringValue(source["url"])
+			if stringValue(source["type"]) == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", stringValue(source["media_type"]), stringValue(source["data"]))
+			}
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}})
+			hasImage = true
+		case "tool_use":
+			arguments, _ := json.Marshal(block["input"])
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":   stringValue(block["id"]),
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      stringValue(block["name"]),
+					"arguments": string(arguments),
+				},
+			})
+		case "tool_result":
+			content := anthropicToolResultText(block["content"])
+			if isError, _ := strconv.ParseBool(stringValue(block["is_error"])); isError {
+				content = "Error: " + content
+			}
+			messages = append(messages, map[string]interface{}{
+				"role":         "tool",
+				"tool_call_id": stringValue(block["tool_use_id"]),
+				"content":      content,
+			})
+		case "thinking", "redacted_thinking":
+			// 思考过程不转发给目标服务
+		default:
+			return nil, fmt.Errorf("不支持的内容块类型: %s", blockType)
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages, nil
+	}
+	converted := map[string]interface{}{"role": role}
+	if hasImage {
+		converted["content"] = parts
+	} else {
+		var texts []string
+		for _, part := range parts {
+			texts = append(texts, stringValue(part["text"]))
+		}
+		converted["content"] = strings.Join(texts, "\n")
+	}
+	if len(toolCalls) > 0 {
+		converted["tool_calls"] = toolCalls
+	}
+	return append(messages, converted), nil
+}
+
+// 将Anthropic Messages请求转换为目标服务使用的OpenAI格式请求
+func convertAnthropicRequest(anthropicRequest map[string]interface{}) (map[string]interface{}, error) {
+	chatRequest := map[string]interface{}{}
+	for _, key := range []string{"model", "max_tokens", "temperature", "top_p", "stream"} {
+		if v, ok := anthropicRequest[key]; ok {
+			chatRequest[key] = v
+		}
+	}
+	if stopSequences, ok := anthropicRequest["stop_sequences"]; ok {
+		chatRequest["stop"] = stopSequences
+	}
+	if metadata, ok := anthropicRequest["metadata"].(map[string]interface{}); ok {
+		if userID := stringValue(metadata["user_id"]); userID != "" {
+			chatRequest["user"] = userID
+		}
+	}
+
+	// 消息：system + messages
+	var messages []map[string]interface{}
+	if system := anthropicSystemText(anthropicRequest["system"]); system != "" {
+		messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+	}
+	rawMessages, ok := anthropicRequest["messages"].([]interface{})
+	if !ok || len(rawMessages) == 0 {
+		return nil, fmt.Errorf("messages不能为空")
+	}
+	for _, rawMessage := range rawMessages {
+		message, ok := rawMessage.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages格式错误")
+		}
+		converted, err := convertAnthropicMessage(message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, converted...)
+	}
+	chatRequest["messages"] = messages
+
+	// 工具定义和tool_choice
+	if rawTools, ok := anthropicRequest["tools"].([]interface{}); ok && len(rawTools) > 0 {
+		var tools []map[string]interface{}
+		for _, rawTool := range rawTools {
+			tool, ok := rawTool.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			tools = append(tools, map[string]interface{}{
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":        tool["name"],
+					"description": tool["description"],
+					"parameters":  tool["input_schema"],
+				},
+			})
+		}
+		chatRequest["tools"] = tools
+	}
+	if toolChoice, ok := anthropicRequest["tool_choice"].(map[string]interface{}); ok {
+		switch stringValue(toolChoice["type"]) {
+		case "auto":
+			chatRequest["tool_choice"] = "auto"
+		case "any":
+			chatRequest["tool_choice"] = "required"
+		case "none":
+			chatRequest["tool_choice"] = "none"
+		case "tool":
+			chatRequest["tool_choice"] = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": toolChoice["name"]},
+			}
+		}
+	}
+	return chatRequest, nil
+}
+
+// Anthropic Messages接口（/v1/messages）：转换为OpenAI格式后复用Token和转发流程
+func anthropicMessagesHandler(c *gin.Context) {
+	// 1. 读取Anthropic格式请求
+	var anthropicRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&anthropicRequest); err != nil {
+		writeAnthropicError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("解析请求体失败: %s", err)})
+		return
+	}
+
+	// 2. 转换为OpenAI格式
+	chatRequest, err := convertAnthropicRequest(anthropicRequest)
+	if err != nil {
+		writeAnthropicError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", err.Error()})
+		return
+	}
+	model, isStream := prepareTargetRequest(chatRequest)
+
+	if isStream {
+		streamAnthropicMessage(c, chatRequest, model)
+		return
+	}
+
+	// 3. 非流式：调用目标服务并转换为Anthropic消息
+	result, err := callTargetOnce(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeAnthropicError(c, err)
+		return
+	}
+	message := AnthropicMessage{
+		ID:      newObjectID("msg_"),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   servedModel(c.Request.Context(), model),
+		Content: []AnthropicContentBlock{},
+		Usage:   AnthropicUsage{InputTokens: result.PromptTokens, OutputTokens: result.CompletionTokens},
+	}
+	if result.Content != "" {
+		message.Content = append(message.Content, AnthropicContentBlock{Type: "text", Text: result.Content})
+	}
+	for _, toolCall := range result.ToolCalls {
+		var input interface{} = map[string]interface{}{}
+		if toolCall.Arguments != "" {
+			json.Unmarshal([]byte(toolCall.Arguments), &input)
+		}
+		message.Content = append(message.Content, AnthropicContentBlock{Type: "tool_use", ID: toolCall.ID, Name: toolCall.Name, Input: input})
+	}
+	stopReason := anthropicStopReason(result.FinishReason)
+	if len(result.ToolCalls) > 0 {
+		stopReason = "tool_use"
+	}
+	message.StopReason = &stopReason
+
+	c.JSON(http.StatusOK, message)
+}
+
+// 流式Anthropic消息：将目标SSE转换为message_start…message_stop事件序列
+func streamAnthropicMessage(c *gin.Context, chatRequest map[string]interface{}, model string) {
+	resp, err := openTargetStream(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeAnthropicError(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	model = servedModel(c.Request.Context(), model)
+
+	setSSEHeaders(c)
+	c.Status(http.StatusOK)
+
+	sendEvent := func(eventType string, payload map[string]interface{}) {
+		payload["type"] = eventType
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		c.Writer.WriteString(fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(data)))
+		c.Writer.Flush()
+	}
+
+	message := AnthropicMessage{
+		ID:      newObjectID("msg_"),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []AnthropicContentBlock{},
+	}
+	sendEvent("message_start", map[string]interface{}{"message": message})
+
+	// 内容块按顺序输出：文本块和tool_use块交替时先结束当前块再开始下一个
+	openBlock, openType, nextBlock := -1, "", 0
+	startBlock := func(blockType string, contentBlock map[string]interface{}) {
+		if openBlock >= 0 {
+			sendEvent("content_block_stop", map[string]interface{}{"index": openBlock})
+		}
+		openBlock, openType = nextBlock, blockType
+		nextBlock++
+		sendEvent("content_block_start", map[string]interface{}{"index": openBlock, "content_block": contentBlock})
+	}
+	startBlock("text", map[string]interface{}{"type": "text", "text": ""})
+	sendEvent("ping", map[string]interface{}{})
+
+	finishReason := "stop"
+	outputTokens := 0
+	toolBlocks := map[int]int{} // 目标tool_calls的index→内容块序号
+	err = readTargetStream(c.Request.Context(), resp.Body, func(targetChunk map[string]interface{}) error {
+		if fr := stringValue(targetChunk["finish_reason"]); fr != "" {
+			finishReason = fr
+		}
+		if n := intValue(targetChunk["completion_tokens"]); n > 0 {
+			outputTokens = n
+		}
+		if text := stringValue(targetChunk["content"]); text != "" {
+			if openType != "text" {
+				startBlock("text", map[string]interface{}{"type": "text", "text": ""})
+			}
+			sendEvent("content_block_delta", map[string]interface{}{"index": openBlock, "delta": map[string]interface{}{"type": "text_delta", "text": text}})
+		}
+
+		// 工具调用：完整的tool_calls或按index分片的增量都转换为tool_use块和input_json_delta
+		items, _ := targetChunk["tool_calls"].([]interface{})
+		for i, item := range items {
+			call, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := i
+			if _, ok := call["index"]; ok {
+				key = intValue(call["index"])
+			}
+			function, _ := call["function"].(map[string]interface{})
+			block, seen := toolBlocks[key]
+			if !seen {
+				id := stringValue(call["id"])
+				if id == "" {
+					id = newObjectID("toolu_")
+				}
+				startBlock("tool_use", map[string]interface{}{"type": "tool_use", "id": id, "name": stringValue(function["name"]), "input": map[string]interface{}{}})
+				block = openBlock
+				toolBlocks[key] = block
+			}
+			if arguments := stringValue(function["arguments"]); arguments != "" {
+				sendEvent("content_block_delta", map[string]interface{}{"index": block, "delta": map[string]interface{}{"type": "input_json_delta", "partial_json": arguments}})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if !clientGone(c.Request.Context()) {
+			sendEvent("error", map[string]interface{}{"error": map[string]interface{}{"type": "api_error", "message": err.Error()}})
+		}
+		return
+	}
+
+	sendEvent("content_block_stop", map[string]interface{}{"index": openBlock})
+	stopReason := anthropicStopReason(finishReason)
+	if len(toolBlocks) > 0 {
+		stopReason = "tool_use"
+	}
+	sendEvent("message_delta", map[string]interface{}{
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": map[string]interface{}{"output_tokens": outputTokens},
+	})
+	sendEvent("message_stop", map[string]interface{}{})
+}
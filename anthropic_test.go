@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertAnthropicRequest(t *testing.T) {
+	request := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"model": "claude",
+		"max_tokens": 64,
+		"system": [{"type":"text","text":"be brief"}],
+		"stop_sequences": ["END"],
+		"messages": [
+			{"role":"user","content":"weather?"},
+			{"role":"assistant","content":[{"type":"text","text":"checking"},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},
+			{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"sunny"}]}]}
+		],
+		"tools": [{"name":"get_weather","description":"d","input_schema":{"type":"object"}}],
+		"tool_choice": {"type":"any"}
+	}`), &request)
+
+	chatRequest, err := convertAnthropicRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(chatRequest)
+	var got map[string]interface{}
+	json.Unmarshal(data, &got)
+
+	var want map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"model": "claude",
+		"max_tokens": 64,
+		"stop": ["END"],
+		"messages": [
+			{"role":"system","content":"be brief"},
+			{"role":"user","content":"weather?"},
+			{"role":"assistant","content":"checking","tool_calls":[{"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+			{"role":"tool","tool_call_id":"toolu_1","content":"sunny"}
+		],
+		"tools": [{"type":"function","function":{"name":"get_weather","description":"d","parameters":{"type":"object"}}}],
+		"tool_choice": "required"
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("converted = %s", data)
+	}
+}
+
+func TestConvertAnthropicRequestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"messages为空", `{"model":"m","messages":[]}`},
+		{"不支持的角色", `{"model":"m","messages":[{"role":"system","content":"x"}]}`},
+		{"不支持的内容块", `{"model":"m","messages":[{"role":"user","content":[{"type":"document"}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestBackend(t, echoTarget)
+			w := serveJSON(anthropicMessagesHandler, tt.body)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_request_error") {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	w := serveJSON(anthropicMessagesHandler, `{"model":"claude","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var message AnthropicMessage
+	json.Unmarshal(w.Body.Bytes(), &message)
+	if len(message.Content) != 1 || message.Content[0].Text != "echo:hi" || *message.StopReason != "end_turn" {
+		t.Fatalf("message = %s", w.Body)
+	}
+	if message.Usage.InputTokens != 3 || message.Usage.OutputTokens != len("echo:hi") {
+		t.Fatalf("usage = %+v", message.Usage)
+	}
+}
+
+func TestAnthropicMessagesToolUse(t *testing.T) {
+	startTestBackend(t, toolCallTarget)
+	w := serveJSON(anthropicMessagesHandler, `{"model":"claude","max_tokens":16,"messages":[{"role":"user","content":"weather?"}]}`)
+	var message AnthropicMessage
+	json.Unmarshal(w.Body.Bytes(), &message)
+	if len(message.Content) != 1 || message.Content[0].Type != "tool_use" || message.Content[0].Name != "get_weather" || *message.StopReason != "tool_use" {
+		t.Fatalf("message = %s", w.Body)
+	}
+	if input, _ := message.Content[0].Input.(map[string]interface{}); input["city"] != "Paris" {
+		t.Fatalf("input = %v", message.Content[0].Input)
+	}
+}
+
+func TestAnthropicStreamToolUse(t *testing.T) {
+	// 先输出文本，再按index分片输出工具调用参数
+	startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"content":"let me check"}`,
+			`{"content":"","tool_calls":[{"index":0,"id":"call_1","function":{"name":"get_weather","arguments":"{\"city\":"}}]}`,
+			`{"content":"","tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}`,
+			`{"content":"","finish_reason":"tool_calls","prompt_tokens":5,"completion_tokens":9}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	})
+	w := serveJSON(anthropicMessagesHandler, `{"model":"claude","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"weather?"}]}`)
+
+	var types []string
+	var partialJSON string
+	var toolBlock, stopReason interface{}
+	var outputTokens int
+	for _, event := range sseData(w.Body.String()) {
+		types = append(types, stringValue(event["type"]))
+		switch event["type"] {
+		case "content_block_start":
+			if block := event["content_block"].(map[string]interface{}); block["type"] == "tool_use" {
+				toolBlock = block
+				if intValue(event["index"]) != 1 {
+					t.Fatalf("tool_use块序号 = %v, want 1", event["index"])
+				}
+			}
+		case "content_block_delta":
+			if delta := event["delta"].(map[string]interface{}); delta["type"] == "input_json_delta" {
+				partialJSON += stringValue(delta["partial_json"])
+			}
+		case "message_delta":
+			stopReason = event["delta"].(map[string]interface{})["stop_reason"]
+			outputTokens = intValue(event["usage"].(map[string]interface{})["output_tokens"])
+		}
+	}
+
+	want := []string{"message_start", "content_block_start", "ping", "content_block_delta",
+		"content_block_stop", "content_block_start", "content_block_delta", "content_block_delta",
+		"content_block_stop", "message_delta", "message_stop"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("events = %v", types)
+	}
+	if block := toolBlock.(map[string]interface{}); block["id"] != "call_1" || block["name"] != "get_weather" {
+		t.Fatalf("tool_use block = %v", block)
+	}
+	if partialJSON != `{"city":"Paris"}` || stopReason != "tool_use" || outputTokens != 9 {
+		t.Fatalf("partial_json = %s, stop_reason = %v, output_tokens = %d", partialJSON, stopReason, outputTokens)
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计记录的内容采集策略
+const (
+	auditPolicyFull     = "full"     // 记录请求/响应内容（超过上限时截断）
+	auditPolicyMetadata = "metadata" // 只记录元数据（大小、状态码、模型等）
+	auditPolicyHashed   = "hashed"   // 记录内容的SHA-256，不记录原文
+	auditPolicyNone     = "none"     // 不记录
+)
+
+// 审计配置（AUDIT_DIR为空时关闭）
+var audit struct {
+	enabled       bool
+	defaultPolicy string
+	keyPolicies   map[string]string // 调用方Key标识（见apiKeyLabel）→策略
+	maxPayload    int
+	sink          *auditSink
+}
+
+// 初始化审计日志
+// AUDIT_DIR：审计文件目录；AUDIT_DEFAULT_POLICY：默认策略（默认metadata）；
+// AUDIT_KEY_POLICIES：按调用方Key标识配置的策略（JSON对象或@文件）；
+// AUDIT_MAX_PAYLOAD_BYTES：单个内容最多记录的字节数；AUDIT_MAX_FILE_MB、AUDIT_MAX_FILES：文件滚动和保留数量；
+// 加密和签名配置见loadAuditChain；开启审计但无法写入时返回错误，不在无审计的情况下提供服务
+func initAudit() error {
+	audit.enabled = false
+	dir := getEnv("AUDIT_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	audit.defaultPolicy = getEnv("AUDIT_DEFAULT_POLICY", auditPolicyMetadata)
+	if !validAuditPolicy(audit.defaultPolicy) {
+		slog.Warn("AUDIT_DEFAULT_POLICY不支持，使用metadata", "policy", audit.defaultPolicy)
+		audit.defaultPolicy = auditPolicyMetadata
+	}
+	audit.keyPolicies = map[string]string{}
+	if _, err := loadJSONEnv("AUDIT_KEY_POLICIES", &audit.keyPolicies); err != nil {
+		slog.Error("AUDIT_KEY_POLICIES配置错误，已忽略", "error", err)
+		audit.keyPolicies = map[string]string{}
+	}
+	for key, policy := range audit.keyPolicies {
+		if !validAuditPolicy(policy) {
+			slog.Warn("审计策略不支持，使用默认策略", "key", key, "policy", policy)
+			delete(audit.keyPolicies, key)
+		}
+	}
+	audit.maxPayload = getEnvInt("AUDIT_MAX_PAYLOAD_BYTES", 64*1024)
+
+	chain, err := loadAuditChain()
+	if err != nil {
+		return fmt.Errorf("审计加密/签名配置错误: %s", err)
+	}
+	sink, err := openAuditSink(dir, int64(getEnvInt("AUDIT_MAX_FILE_MB", 100))<<20, getEnvInt("AUDIT_MAX_FILES", 10), chain)
+	if err != nil {
+		return fmt.Errorf("打开审计日志%s失败: %s", dir, err)
+	}
+	audit.sink = sink
+	audit.enabled = true
+	onShutdown(func() { audit.sink.Close() })
+	slog.Info("审计日志", "dir", dir, "default_policy", audit.defaultPolicy, "key_policies", len(audit.keyPolicies), "max_payload_bytes", audit.maxPayload,
+		"encryption_key", chain.active, "signed", chain.signer != nil)
+	if chain.signer != nil {
+		slog.Info("审计检查点签名公钥（用于verify-audit -public-key）", "public_key", base64.StdEncoding.EncodeToString(chain.signer.Public().(ed25519.PublicKey)))
+	}
+	return nil
+}
+
+func validAuditPolicy(policy string) bool {
+	switch policy {
+	case auditPolicyFull, auditPolicyMetadata, auditPolicyHashed, auditPolicyNone:
+		return true
+	}
+	return false
+}
+
+// 调用方Key对应的审计策略
+func auditPolicyFor(key string) string {
+	if policy, ok := audit.keyPolicies[key]; ok {
+		return policy
+	}
+	return audit.defaultPolicy
+}
+
+// 一次请求的审计记录：入站请求、转换后的上游请求和响应（每次尝试一条）、返回给客户端的响应
+type auditRecord struct {
+	mu sync.Mutex
+
+	Time             time.Time       `json:"time"`
+	CorrelationID    string          `json:"correlation_id"`
+	Key              string          `json:"key"`
+	Policy           string          `json:"policy"`
+	Method           string          `json:"method"`
+	Path             string          `json:"path"`
+	Route            string          `json:"route"`
+	Status           int             `json:"status"`
+	LatencyMs        int64           `json:"latency_ms"`
+	RequestedModel   string          `json:"requested_model,omitempty"`
+	Model            string          `json:"model,omitempty"`
+	Upstream         string          `json:"upstream,omitempty"`
+	PromptTokens     int             `json:"prompt_tokens,omitempty"`
+	CompletionTokens int             `json:"completion_tokens,omitempty"`
+	Request          auditMessage    `json:"request"`
+	UpstreamAttempts []*auditAttempt `json:"upstream_attempts,omitempty"`
+	Response         auditMessage    `json:"response"`
+}
+
+// 一次上游尝试
+type auditAttempt struct {
+	Upstream string        `json:"upstream"`
+	Endpoint string        `json:"endpoint"`
+	Attempt  int           `json:"attempt"`
+	Request  auditMessage  `json:"request"`
+	Response *auditMessage `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// 请求或响应（Header已去除凭证，内容按策略记录）
+type auditMessage struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	auditPayload
+}
+
+type auditPayload struct {
+	Size          int             `json:"size"`
+	Stream        bool            `json:"stream,omitempty"`
+	Chunks        int             `json:"chunks,omitempty"`
+	SHA256        string          `json:"sha256,omitempty"`
+	Body          json.RawMessage `json:"body,omitempty"`
+	Content       string          `json:"content,omitempty"` // 流式响应重组后的文本
+	ContentSHA256 string          `json:"content_sha256,omitempty"`
+	Truncated     bool            `json:"truncated,omitempty"`
+}
+
+type auditRecordKey struct{}
+
+func getAuditRecord(ctx context.Context) *auditRecord {
+	record, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record
+}
+
+// 去除凭证后的Header
+func auditHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, vs := range h {
+		if sensitiveLogKeys[strings.ToLower(k)] {
+			out[k] = "[REDACTED]"
+			continue
+		}
+		out[k] = strings.Join(vs, ",")
+	}
+	return out
+}
+
+// 按策略采集内容：记录总大小和哈希，完整策略下保留前limit字节；流式内容按行重组为文本
+type auditCapture struct {
+	policy  string
+	limit   int
+	stream  bool
+	size    int
+	hash    hash.Hash
+	buf     bytes.Buffer
+	line    []byte
+	content strings.Builder
+	chunks  int
+}
+
+func newAuditCapture(policy string, stream bool) *auditCapture {
+	return &auditCapture{policy: policy, limit: audit.maxPayload, stream: stream, hash: sha256.New()}
+}
+
+func (a *auditCapture) Write(p []byte) (int, error) {
+	a.size += len(p)
+	a.hash.Write(p)
+	if a.policy == auditPolicyFull && !a.stream && a.buf.Len() < a.limit {
+		n := min(len(p), a.limit-a.buf.Len())
+		a.buf.Write(p[:n])
+	}
+	if a.stream {
+		a.line = append(a.line, p...)
+		for {
+			i := bytes.IndexByte(a.line, '\n')
+			if i < 0 {
+				break
+			}
+			a.streamLine(a.line[:i])
+			a.line = a.line[i+1:]
+		}
+	}
+	return len(p), nil
+}
+
+// 从SSE或NDJSON的一行中提取文本增量（目标服务、OpenAI、Anthropic、Responses、Ollama格式）
+func (a *auditCapture) streamLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if len(line) == 0 || line[0] != '{' {
+		return
+	}
+	var chunk map[string]interface{}
+	if json.Unmarshal(line, &chunk) != nil {
+		return
+	}
+	a.chunks++
+	text := streamChunkText(chunk)
+	if text == "" || a.policy == auditPolicyMetadata {
+		return
+	}
+	if a.policy == auditPolicyHashed || a.content.Len() < a.limit {
+		a.content.WriteString(text)
+	}
+}
+
+func streamChunkText(chunk map[string]interface{}) string {
+	text := func(m map[string]interface{}, key string) string {
+		s, _ := m[key].(string)
+		return s
+	}
+	if s := text(chunk, "content"); s != "" {
+		return s
+	}
+	if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if delta, ok := choice["delta"].(map[string]interface{}); ok {
+				return text(delta, "content")
+			}
+			return text(choice, "text")
+		}
+	}
+	if delta, ok := chunk["delta"].(map[string]interface{}); ok {
+		return text(delta, "text")
+	}
+	if text(chunk, "type") == "response.output_text.delta" {
+		return text(chunk, "delta")
+	}
+	if message, ok := chunk["message"].(map[string]interface{}); ok {
+		return text(message, "content")
+	}
+	return text(chunk, "response")
+}
+
+// 按策略输出采集结果
+func (a *auditCapture) payload() auditPayload {
+	if a.stream && len(a.line) > 0 {
+		a.streamLine(a.line)
+		a.line = nil
+	}
+	p := auditPayload{Size: a.size, Stream: a.stream, Chunks: a.chunks}
+	switch a.policy {
+	case auditPolicyHashed:
+		p.SHA256 = hex.EncodeToString(a.hash.Sum(nil))
+		if a.stream {
+			sum := sha256.Sum256([]byte(a.content.String()))
+			p.ContentSHA256 = hex.EncodeToString(sum[:])
+		}
+	case auditPolicyFull:
+		p.SHA256 = hex.EncodeToString(a.hash.Sum(nil))
+		if a.stream {
+			p.Content = a.content.String()
+			if len(p.Content) > a.limit {
+				p.Content, p.Truncated = p.Content[:a.limit], true
+			}
+			break
+		}
+		p.Truncated = a.size > a.buf.Len()
+		if body := a.buf.Bytes(); len(body) > 0 {
+			if !p.Truncated && json.Valid(body) {
+				p.Body = append(json.RawMessage(nil), body...)
+			} else {
+				p.Body, _ = json.Marshal(string(body))
+			}
+		}
+	}
+	return p
+}
+
+// 记录客户端响应的ResponseWriter
+type auditWriter struct {
+	gin.ResponseWriter
+	capture *auditCapture
+	policy  string
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	w.start()
+	w.capture.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.start()
+	w.capture.Write([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// 首次写入时根据Content-Type判断是否为流式响应
+func (w *auditWriter) start() {
+	if w.capture != nil {
+		return
+	}
+	contentType := w.Header().Get("Content-Type")
+	stream := strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson")
+	w.capture = newAuditCapture(w.policy, stream)
+}
+
+// 审计中间件：挂在调用模型的路由上，请求结束后写一条审计记录
+func auditMiddleware(c *gin.Context) {
+	if !audit.enabled {
+		c.Next()
+		return
+	}
+	info := getRequestInfo(c.Request.Context())
+	key := "anonymous"
+	if info != nil {
+		key = info.Key
+	}
+	policy := auditPolicyFor(key)
+	if policy == auditPolicyNone {
+		c.Next()
+		return
+	}
+
+	record := &auditRecord{
+		Time:   time.Now(),
+		Key:    key,
+		Policy: policy,
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Route:  c.FullPath(),
+	}
+
+	// 入站请求（读取后放回请求体）
+	inbound := newAuditCapture(policy, false)
+	if c.Request.Body != nil {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body.Close()
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		inbound.Write(body)
+	}
+	record.Request = auditMessage{Headers: auditHeaders(c.Request.Header), auditPayload: inbound.payload()}
+
+	writer := &auditWriter{ResponseWriter: c.Writer, policy: policy}
+	c.Writer = writer
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auditRecordKey{}, record))
+
+	c.Next()
+
+	writer.start()
+	record.mu.Lock()
+	record.Status = c.Writer.Status()
+	record.LatencyMs = time.Since(record.Time).Milliseconds()
+	if info != nil {
+		snap := info.snapshot()
+		record.CorrelationID = snap.CorrelationID
+		record.RequestedModel, record.Model, record.Upstream = snap.RequestedModel, snap.Model, snap.Upstream
+		record.PromptTokens, record.CompletionTokens = snap.PromptTokens, snap.CompletionTokens
+	}
+	record.Response = auditMessage{Status: c.Writer.Status(), Headers: auditHeaders(c.Writer.Header()), auditPayload: writer.capture.payload()}
+	line, err := json.Marshal(record)
+	record.mu.Unlock()
+	if err == nil {
+		err = audit.sink.write(line)
+	}
+	if err != nil {
+		logger(c.Request.Context()).Error("写入审计日志失败", "error", err)
+	}
+}
+
+// 记录一次上游尝试（请求体为转换后的上游请求，Header已去除凭证）；
+// 成功时包装响应体，在响应体关闭时记录上游响应
+func auditUpstream(ctx context.Context, upstream, endpoint string, attempt int, req *http.Request, payload []byte, resp *http.Response, err error) {
+	record := getAuditRecord(ctx)
+	if record == nil {
+		return
+	}
+	reqCapture := newAuditCapture(record.Policy, false)
+	reqCapture.Write(payload)
+	entry := &auditAttempt{
+		Upstream: upstream,
+		Endpoint: endpoint,
+		Attempt:  attempt,
+		Request:  auditMessage{Headers: auditHeaders(req.Header), auditPayload: reqCapture.payload()},
+	}
+	record.mu.Lock()
+	record.UpstreamAttempts = append(record.UpstreamAttempts, entry)
+	record.mu.Unlock()
+
+	if err != nil {
+		record.mu.Lock()
+		entry.Error = err.Error()
+		record.mu.Unlock()
+		return
+	}
+	stream := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	resp.Body = &auditBody{
+		ReadCloser: resp.Body,
+		capture:    newAuditCapture(record.Policy, stream),
+		record:     record,
+		entry:      entry,
+		status:     resp.StatusCode,
+		headers:    auditHeaders(resp.Header),
+	}
+}
+
+// 记录上游响应内容的响应体
+type auditBody struct {
+	io.ReadCloser
+	once    sync.Once
+	capture *auditCapture
+	record  *auditRecord
+	entry   *auditAttempt
+	status  int
+	headers map[string]string
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.Write(p[:n])
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	b.once.Do(func() {
+		b.record.mu.Lock()
+		b.entry.Response = &auditMessage{Status: b.status, Headers: b.headers, auditPayload: b.capture.payload()}
+		b.record.mu.Unlock()
+	})
+	return b.ReadCloser.Close()
+}
+
+// 审计文件：按大小滚动的JSONL文件，保留最近maxFiles个；
+// 记录跨文件组成哈希链，每checkpointEvery条记录及滚动、关闭时写入检查点
+type auditSink struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	chain    *auditChain
+	file     *os.File
+	size     int64
+
+	seq             uint64 // 最后一条记录的序号
+	head            string // 链头（最后一条记录的哈希）
+	sinceCheckpoint int
+}
+
+func openAuditSink(dir string, maxSize int64, maxFiles int, chain *auditChain) (*auditSink, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &auditSink{dir: dir, maxSize: maxSize, maxFiles: maxFiles, chain: chain}
+	// 接续已有文件的哈希链：从最新的非空文件取最后一条（重启后未写入就退出会留下空文件）
+	files := auditFiles(dir)
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditEnvelope(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			s.seq, s.head = last.Seq, last.Hash
+			break
+		}
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 写入一条记录，超过大小上限时滚动到新文件
+func (s *auditSink) write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return fmt.Errorf("审计日志已关闭")
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(record)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	env, err := s.chain.seal(record, s.seq+1, s.head)
+	if err != nil {
+		return err
+	}
+	if err := s.writeEnvelope(env); err != nil {
+		return err
+	}
+	s.seq, s.head = env.Seq, env.Hash
+	s.sinceCheckpoint++
+	if s.chain.checkpointEvery > 0 && s.sinceCheckpoint >= s.chain.checkpointEvery {
+		return s.writeCheckpoint()
+	}
+	return nil
+}
+
+// 调用方需持有s.mu
+func (s *auditSink) writeEnvelope(env *auditEnvelope) error {
+	line, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// 写入检查点并重新读取密钥（轮换），调用方需持有s.mu
+func (s *auditSink) writeCheckpoint() error {
+	s.sinceCheckpoint = 0
+	if err := s.chain.reloadKeys(); err != nil {
+		slog.Error("重新读取审计密钥失败，继续使用当前密钥", "error", err)
+	}
+	return s.writeEnvelope(s.chain.checkpoint(s.seq, s.head))
+}
+
+// 打开新文件并清理超出保留数量的旧文件，调用方需持有s.mu（初始化时除外）
+func (s *auditSink) rotate() error {
+	if s.file != nil {
+		s.writeCheckpoint()
+		s.file.Close()
+	}
+	name := filepath.Join(s.dir, "audit-"+time.Now().UTC().Format("20060102T150405.000000000")+".jsonl")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+	s.file, s.size = f, 0
+
+	if s.maxFiles > 0 {
+		files := auditFiles(s.dir)
+		for len(files) > s.maxFiles {
+			os.Remove(files[0])
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// 目录中的审计文件（按时间从旧到新）
+func auditFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	sort.Strings(files)
+	return files
+}
+
+func (s *auditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if s.seq > 0 {
+		s.writeCheckpoint()
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
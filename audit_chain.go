@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 审计文件中的一行：记录（链入哈希链）或检查点（对链头签名）
+// 记录的哈希为sha256(prev + "\n" + seq + "\n" + 内容)，内容为密文（加密时）或记录JSON，
+// 因此不持有解密密钥也能校验哈希链
+type auditEnvelope struct {
+	Type      string          `json:"type"` // record或checkpoint
+	Seq       uint64          `json:"seq"`
+	Prev      string          `json:"prev,omitempty"`
+	Hash      string          `json:"hash"`
+	Time      string          `json:"time,omitempty"`
+	KeyID     string          `json:"key_id,omitempty"`
+	Nonce     []byte          `json:"nonce,omitempty"`
+	Data      []byte          `json:"data,omitempty"`   // AES-GCM密文
+	Record    json.RawMessage `json:"record,omitempty"` // 未加密时的记录
+	Signature []byte          `json:"signature,omitempty"`
+}
+
+const (
+	auditEnvelopeRecord     = "record"
+	auditEnvelopeCheckpoint = "checkpoint"
+)
+
+// 哈希链中一条记录的哈希
+func auditChainHash(prev string, seq uint64, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev + "\n" + strconv.FormatUint(seq, 10) + "\n"))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 检查点的签名内容
+func auditCheckpointMessage(seq uint64, hash, ts string) []byte {
+	return []byte("audit-checkpoint\n" + strconv.FormatUint(seq, 10) + "\n" + hash + "\n" + ts)
+}
+
+// 加密的附加数据：绑定序号和前一条哈希，密文不能挪到其他位置
+func auditAdditionalData(seq uint64, prev string) []byte {
+	return []byte(strconv.FormatUint(seq, 10) + "\n" + prev)
+}
+
+// 哈希链、加密和签名配置
+type auditChain struct {
+	keyDir          string
+	activeKeyID     string // 为空时使用目录中按名称排序的最后一个密钥
+	keys            map[string]cipher.AEAD
+	active          string
+	signer          ed25519.PrivateKey
+	checkpointEvery int
+}
+
+// 读取AUDIT_KEY_DIR、AUDIT_ACTIVE_KEY_ID、AUDIT_SIGNING_KEY_FILE、AUDIT_CHECKPOINT_EVERY
+func loadAuditChain() (*auditChain, error) {
+	chain := &auditChain{
+		keyDir:          getEnv("AUDIT_KEY_DIR", ""),
+		activeKeyID:     getEnv("AUDIT_ACTIVE_KEY_ID", ""),
+		checkpointEvery: getEnvInt("AUDIT_CHECKPOINT_EVERY", 100),
+	}
+	if err := chain.reloadKeys(); err != nil {
+		return nil, err
+	}
+	if path := getEnv("AUDIT_SIGNING_KEY_FILE", ""); path != "" {
+		signer, err := readAuditSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		chain.signer = signer
+	}
+	return chain, nil
+}
+
+// 重新读取密钥目录（新增密钥文件即可轮换，旧密钥保留用于解密历史记录）
+func (c *auditChain) reloadKeys() error {
+	if c.keyDir == "" {
+		return nil
+	}
+	keys, err := readAuditKeys(c.keyDir)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("审计密钥目录%s中没有*.key文件", c.keyDir)
+	}
+	active := c.activeKeyID
+	if active == "" {
+		ids := make([]string, 0, len(keys))
+		for id := range keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		active = ids[len(ids)-1]
+	}
+	if keys[active] == nil {
+		return fmt.Errorf("审计密钥%s不存在", active)
+	}
+	c.keys, c.active = keys, active
+	return nil
+}
+
+// 读取目录中的AES-256密钥：文件名（去掉.key）为密钥ID，内容为32字节密钥的base64或hex
+func readAuditKeys(dir string) (map[string]cipher.AEAD, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]cipher.AEAD, len(files))
+	for _, file := range files {
+		key, err := readKeyFile(file, 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("审计密钥%s无效: %s", file, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys[strings.TrimSuffix(filepath.Base(file), ".key")] = aead
+	}
+	return keys, nil
+}
+
+// 读取指定长度的密钥文件（base64或hex）
+func readKeyFile(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取密钥文件失败: %s", err)
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == size {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == size {
+		return key, nil
+	}
+	return nil, fmt.Errorf("密钥文件%s格式错误，应为%d字节的base64或hex", path, size)
+}
+
+// 签名私钥文件：Ed25519种子（32字节）
+func readAuditSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := readKeyFile(path, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// 签名公钥文件：Ed25519公钥（32字节）
+func readAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readKeyFile(path, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// 将记录封装为哈希链中的下一条
+func (c *auditChain) seal(record []byte, seq uint64, prev string) (*auditEnvelope, error) {
+	env := &auditEnvelope{Type: auditEnvelopeRecord, Seq: seq, Prev: prev}
+	content := record
+	if c.active != "" {
+		aead := c.keys[c.active]
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		env.KeyID, env.Nonce = c.active, nonce
+		env.Data = aead.Seal(nil, nonce, record, auditAdditionalData(seq, prev))
+		content = env.Data
+	} else {
+		env.Record = record
+	}
+	env.Hash = auditChainHash(prev, seq, content)
+	return env, nil
+}
+
+// 对当前链头生成检查点（未配置签名密钥时只记录链头）
+func (c *auditChain) checkpoint(seq uint64, head string) *auditEnvelope {
+	env := &auditEnvelope{Type: auditEnvelopeCheckpoint, Seq: seq, Hash: head, Time: time.Now().UTC().Format(time.RFC3339Nano)}
+	if c.signer != nil {
+		env.Signature = ed25519.Sign(c.signer, auditCheckpointMessage(seq, head, env.Time))
+	}
+	return env
+}
+
+// 读取审计文件的最后一条记录，用于重启后接续哈希链；文件为空时返回nil
+// 崩溃导致最后一行没有写完（不以换行结尾）时截掉该行，从上一行接续
+func lastAuditEnvelope(path string) (*auditEnvelope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		complete := bytes.LastIndexByte(data, '\n') + 1
+		slog.Warn("审计文件最后一行不完整，已截断", "file", path, "bytes", len(data)-complete)
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return nil, fmt.Errorf("截断审计文件%s失败: %s", path, err)
+		}
+		data = data[:complete]
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	last := data[bytes.LastIndexByte(data, '\n')+1:]
+	var env auditEnvelope
+	if err := json.Unmarshal(last, &env); err != nil {
+		return nil, fmt.Errorf("审计文件%s最后一行格式错误: %s", path, err)
+	}
+	return &env, nil
+}
+
+// 逐行读取审计文件
+func scanAuditFile(path string, fn func(lineNo int, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := fn(lineNo, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testAEAD(t *testing.T, seed byte) cipher.AEAD {
+	t.Helper()
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// 依次封装记录，返回序列化后的行
+func sealLines(t *testing.T, chain *auditChain, records ...string) [][]byte {
+	t.Helper()
+	var lines [][]byte
+	seq, head := uint64(0), ""
+	for _, record := range records {
+		env, err := chain.seal([]byte(record), seq+1, head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, head = env.Seq, env.Hash
+		line, _ := json.Marshal(env)
+		lines = append(lines, line)
+	}
+	line, _ := json.Marshal(chain.checkpoint(seq, head))
+	return append(lines, line)
+}
+
+func verifyLines(v *auditVerifier, lines [][]byte) int {
+	for i, line := range lines {
+		v.verifyLine("test.jsonl", i+1, line)
+	}
+	return v.breaks
+}
+
+func TestAuditChainSealAndVerify(t *testing.T) {
+	_, signer, _ := ed25519.GenerateKey(nil)
+	records := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}
+
+	tests := []struct {
+		name   string
+		chain  *auditChain
+		tamper func(lines [][]byte) [][]byte
+		breaks bool
+	}{
+		{"明文", &auditChain{}, nil, false},
+		{"加密并签名", &auditChain{keys: map[string]cipher.AEAD{"k1": testAEAD(t, 1)}, active: "k1", signer: signer}, nil, false},
+		{"修改明文记录", &auditChain{}, func(lines [][]byte) [][]byte {
+			var env auditEnvelope
+			json.Unmarshal(lines[1], &env)
+			env.Record = json.RawMessage(`{"n":20}`)
+			lines[1], _ = json.Marshal(env)
+			return lines
+		}, true},
+		{"修改密文", &auditChain{keys: map[string]cipher.AEAD{"k1": testAEAD(t, 1)}, active: "k1"}, func(lines [][]byte) [][]byte {
+			var env auditEnvelope
+			json.Unmarshal(lines[0], &env)
+			env.Data[0] ^= 0xff
+			lines[0], _ = json.Marshal(env)
+			return lines
+		}, true},
+		{"删除记录", &auditChain{}, func(lines [][]byte) [][]byte {
+			return append(lines[:1:1], lines[2:]...)
+		}, true},
+		{"重排记录", &auditChain{}, func(lines [][]byte) [][]byte {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := sealLines(t, tt.chain, records...)
+			if tt.tamper != nil {
+				lines = tt.tamper(lines)
+			}
+			v := &auditVerifier{keys: tt.chain.keys}
+			if tt.chain.signer != nil {
+				v.publicKey = tt.chain.signer.Public().(ed25519.PublicKey)
+			}
+			if breaks := verifyLines(v, lines); (breaks > 0) != tt.breaks {
+				t.Fatalf("breaks = %d, want breaks: %v", breaks, tt.breaks)
+			}
+		})
+	}
+}
+
+func TestAuditChainEncryptionRoundTrip(t *testing.T) {
+	chain := &auditChain{keys: map[string]cipher.AEAD{"k1": testAEAD(t, 1), "k2": testAEAD(t, 2)}, active: "k1"}
+	first, err := chain.seal([]byte(`{"secret":"a"}`), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.active = "k2" // 轮换后旧记录仍可用旧密钥解密
+	second, err := chain.seal([]byte(`{"secret":"b"}`), 2, first.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, env := range []*auditEnvelope{first, second} {
+		if env.Record != nil {
+			t.Fatal("加密时不应保存明文")
+		}
+		plain, err := chain.keys[env.KeyID].Open(nil, env.Nonce, env.Data, auditAdditionalData(env.Seq, env.Prev))
+		if err != nil {
+			t.Fatalf("seq %d: %s", env.Seq, err)
+		}
+		if want := fmt.Sprintf(`{"secret":"%s"}`, map[uint64]string{1: "a", 2: "b"}[env.Seq]); string(plain) != want {
+			t.Fatalf("plain = %s, want %s", plain, want)
+		}
+		// 附加数据绑定序号，密文不能挪到其他位置
+		if _, err := chain.keys[env.KeyID].Open(nil, env.Nonce, env.Data, auditAdditionalData(env.Seq+1, env.Prev)); err == nil {
+			t.Fatal("序号不同时解密应失败")
+		}
+	}
+	if first.KeyID != "k1" || second.KeyID != "k2" {
+		t.Fatalf("key ids = %s, %s", first.KeyID, second.KeyID)
+	}
+}
+
+// 重启后接续哈希链：最后一行未写完时截掉，最新文件为空时从更早的文件接续
+func TestAuditSinkResume(t *testing.T) {
+	dir := t.TempDir()
+	chain := &auditChain{checkpointEvery: 100}
+	open := func() *auditSink {
+		s, err := openAuditSink(dir, 0, 0, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	for i := 0; i < 3; i++ {
+		if err := s.write([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.file.Close() // 模拟崩溃：不写检查点
+	files := auditFiles(dir)
+	f, _ := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0o600)
+	f.WriteString(`{"type":"record","seq":4,"pr`)
+	f.Close()
+
+	// 重启后立即崩溃，留下空文件
+	time.Sleep(time.Millisecond)
+	s = open()
+	s.file.Close()
+	time.Sleep(time.Millisecond)
+
+	s = open()
+	if s.seq != 3 {
+		t.Fatalf("seq = %d, want 3", s.seq)
+	}
+	if err := s.write([]byte(`{"n":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	v := &auditVerifier{}
+	for _, file := range auditFiles(dir) {
+		scanAuditFile(file, func(lineNo int, line []byte) error {
+			v.verifyLine(filepath.Base(file), lineNo, line)
+			return nil
+		})
+	}
+	if v.breaks != 0 || v.records != 4 || v.seq != 4 {
+		t.Fatalf("breaks=%d records=%d seq=%d", v.breaks, v.records, v.seq)
+	}
+}
+
+func TestAuditSinkCorruptLastLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit-20260101T000000.000000000.jsonl")
+	os.WriteFile(path, []byte("not json\n"), 0o600)
+	if _, err := openAuditSink(dir, 0, 0, &auditChain{}); err == nil {
+		t.Fatal("最后一行完整但格式错误时应返回错误")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// 开启审计并启动测试后端，返回审计目录
+func startAuditBackend(t *testing.T, defaultPolicy, keyPolicies string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("AUDIT_DIR", dir)
+	t.Setenv("AUDIT_DEFAULT_POLICY", defaultPolicy)
+	t.Setenv("AUDIT_KEY_POLICIES", keyPolicies)
+	startTestBackend(t, echoTarget)
+	t.Cleanup(func() {
+		audit.sink.Close()
+		audit.enabled = false
+	})
+	return dir
+}
+
+// 读取目录中的全部审计记录（未加密）
+func readAuditRecords(t *testing.T, dir string) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, name := range auditFiles(dir) {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var env auditEnvelope
+			if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+				t.Fatalf("invalid audit line: %s", scanner.Text())
+			}
+			if env.Type != auditEnvelopeRecord {
+				continue
+			}
+			var record map[string]interface{}
+			if err := json.Unmarshal(env.Record, &record); err != nil {
+				t.Fatalf("invalid audit record: %s", env.Record)
+			}
+			records = append(records, record)
+		}
+		f.Close()
+	}
+	return records
+}
+
+func TestAuditPolicies(t *testing.T) {
+	const body = `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`
+	sum := sha256.Sum256([]byte(body))
+	bodySHA := hex.EncodeToString(sum[:])
+	header := map[string]string{"Authorization": "Bearer alice"}
+
+	tests := []struct {
+		name        string
+		policy      string
+		keyPolicies string
+		check       func(t *testing.T, records []map[string]interface{})
+	}{
+		{"none不写记录", auditPolicyNone, "", func(t *testing.T, records []map[string]interface{}) {
+			if len(records) != 0 {
+				t.Fatalf("records = %v", records)
+			}
+		}},
+		{"按Key配置为none", auditPolicyFull, `{"` + apiKeyLabelFor("alice") + `":"none"}`, func(t *testing.T, records []map[string]interface{}) {
+			if len(records) != 0 {
+				t.Fatalf("records = %v", records)
+			}
+		}},
+		{"metadata只记录大小", auditPolicyMetadata, "", func(t *testing.T, records []map[string]interface{}) {
+			request := records[0]["request"].(map[string]interface{})
+			if request["size"] != float64(len(body)) || request["sha256"] != nil || request["body"] != nil {
+				t.Fatalf("request = %v", request)
+			}
+		}},
+		{"hashed只记录哈希", auditPolicyHashed, "", func(t *testing.T, records []map[string]interface{}) {
+			request := records[0]["request"].(map[string]interface{})
+			if request["sha256"] != bodySHA || request["body"] != nil {
+				t.Fatalf("request = %v", request)
+			}
+			response := records[0]["response"].(map[string]interface{})
+			if response["sha256"] == nil || response["body"] != nil {
+				t.Fatalf("response = %v", response)
+			}
+		}},
+		{"full记录内容", auditPolicyFull, "", func(t *testing.T, records []map[string]interface{}) {
+			record := records[0]
+			request := record["request"].(map[string]interface{})
+			if request["sha256"] != bodySHA || request["body"].(map[string]interface{})["model"] != "gpt-3.5-turbo" {
+				t.Fatalf("request = %v", request)
+			}
+			attempts := record["upstream_attempts"].([]interface{})
+			attempt := attempts[0].(map[string]interface{})
+			upstreamBody := attempt["request"].(map[string]interface{})["body"].(map[string]interface{})
+			if upstreamBody["messages"] == nil || attempt["response"].(map[string]interface{})["status"] != float64(http.StatusOK) {
+				t.Fatalf("attempt = %v", attempt)
+			}
+			response := record["response"].(map[string]interface{})
+			choices := response["body"].(map[string]interface{})["choices"].([]interface{})
+			if content := choices[0].(map[string]interface{})["message"].(map[string]interface{})["content"]; content != "echo:hi" {
+				t.Fatalf("response content = %v", content)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := startAuditBackend(t, tt.policy, tt.keyPolicies)
+			w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", body, header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			records := readAuditRecords(t, dir)
+			if tt.policy != auditPolicyNone && tt.keyPolicies == "" {
+				if len(records) != 1 {
+					t.Fatalf("records = %d, want 1", len(records))
+				}
+				record := records[0]
+				headers := record["request"].(map[string]interface{})["headers"].(map[string]interface{})
+				if record["policy"] != tt.policy || record["status"] != float64(http.StatusOK) || headers["Authorization"] != "[REDACTED]" {
+					t.Fatalf("record = %v", record)
+				}
+			}
+			tt.check(t, records)
+		})
+	}
+}
+
+func TestAuditStreamContent(t *testing.T) {
+	dir := startAuditBackend(t, auditPolicyFull, "")
+	w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	records := readAuditRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("records = %d, want 1", len(records))
+	}
+	response := records[0]["response"].(map[string]interface{})
+	if response["stream"] != true || response["content"] != "echo:hi" {
+		t.Fatalf("response = %v", response)
+	}
+	attempt := records[0]["upstream_attempts"].([]interface{})[0].(map[string]interface{})
+	if content := attempt["response"].(map[string]interface{})["content"]; content != "echo:hi" {
+		t.Fatalf("upstream content = %v", content)
+	}
+}
+
+// 调用方API Key对应的标识
+func apiKeyLabelFor(key string) string {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+	return apiKeyLabel(r)
+}
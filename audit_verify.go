@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// 审计日志校验状态
+type auditVerifier struct {
+	keys      map[string]cipher.AEAD
+	publicKey ed25519.PublicKey
+	dump      bool
+
+	seq           uint64
+	head          string
+	started       bool
+	records       int
+	checkpoints   int
+	checkpointSeq uint64
+	signed        int
+	decrypted     int
+	breaks        int
+	last          *auditEnvelope
+}
+
+func (v *auditVerifier) fail(file string, lineNo int, format string, args ...interface{}) {
+	v.breaks++
+	fmt.Fprintf(os.Stderr, "%s:%d: %s\n", filepath.Base(file), lineNo, fmt.Sprintf(format, args...))
+}
+
+// 校验一行：记录须接续链头且哈希正确，检查点须与链头一致且签名有效
+func (v *auditVerifier) verifyLine(file string, lineNo int, line []byte) {
+	var env auditEnvelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		v.fail(file, lineNo, "格式错误: %s", err)
+		return
+	}
+	switch env.Type {
+	case auditEnvelopeRecord:
+		if v.started && env.Seq != v.seq+1 {
+			v.fail(file, lineNo, "序号不连续：期望%d，实际%d（记录被删除或插入）", v.seq+1, env.Seq)
+		} else if v.started && env.Prev != v.head {
+			v.fail(file, lineNo, "prev与前一条记录的哈希不一致（记录被删除、插入或重排）")
+		}
+		if !v.started && env.Seq != 1 {
+			fmt.Fprintf(os.Stderr, "%s:%d: 哈希链从序号%d开始（更早的文件可能已按保留数量清理）\n", filepath.Base(file), lineNo, env.Seq)
+		}
+		content := []byte(env.Record)
+		if env.KeyID != "" {
+			content = env.Data
+		}
+		if hash := auditChainHash(env.Prev, env.Seq, content); hash != env.Hash {
+			v.fail(file, lineNo, "记录%d的哈希不匹配（内容被修改）", env.Seq)
+		}
+		v.started, v.seq, v.head = true, env.Seq, env.Hash
+		v.records++
+
+		record := []byte(env.Record)
+		if env.KeyID != "" {
+			aead := v.keys[env.KeyID]
+			if aead == nil {
+				if v.keys != nil {
+					v.fail(file, lineNo, "记录%d使用的密钥%s不在密钥目录中", env.Seq, env.KeyID)
+				}
+				break
+			}
+			plain, err := aead.Open(nil, env.Nonce, env.Data, auditAdditionalData(env.Seq, env.Prev))
+			if err != nil {
+				v.fail(file, lineNo, "记录%d解密失败（密文被修改或密钥不匹配）", env.Seq)
+				break
+			}
+			record = plain
+			v.decrypted++
+		}
+		if v.dump && record != nil {
+			os.Stdout.Write(append(bytes.TrimSpace(record), '\n'))
+		}
+	case auditEnvelopeCheckpoint:
+		v.checkpoints++
+		v.checkpointSeq = env.Seq
+		if !v.started {
+			// 更早的文件已清理时，从检查点记录的链头开始校验
+			v.started, v.seq, v.head = true, env.Seq, env.Hash
+		} else if env.Seq != v.seq || env.Hash != v.head {
+			v.fail(file, lineNo, "检查点（序号%d）与哈希链不一致", env.Seq)
+		}
+		if v.publicKey != nil {
+			if len(env.Signature) == 0 {
+				v.fail(file, lineNo, "检查点（序号%d）缺少签名", env.Seq)
+			} else if !ed25519.Verify(v.publicKey, auditCheckpointMessage(env.Seq, env.Hash, env.Time), env.Signature) {
+				v.fail(file, lineNo, "检查点（序号%d）签名无效", env.Seq)
+			} else {
+				v.signed++
+			}
+		}
+	default:
+		v.fail(file, lineNo, "未知的行类型%q（缺少哈希链字段）", env.Type)
+		return
+	}
+	v.last = &env
+}
+
+// verify-audit子命令：按顺序遍历审计文件，校验哈希链、检查点签名和密文完整性
+// 发现任何断链返回1，全部通过返回0
+func runVerifyAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	dir := fs.String("dir", getEnv("AUDIT_DIR", ""), "审计文件目录（校验其中全部audit-*.jsonl）")
+	keyDir := fs.String("key-dir", getEnv("AUDIT_KEY_DIR", ""), "解密密钥目录，指定后同时校验密文并可输出明文")
+	publicKeyFile := fs.String("public-key", "", "检查点签名公钥文件（Ed25519，32字节base64或hex）")
+	signingKeyFile := fs.String("signing-key", getEnv("AUDIT_SIGNING_KEY_FILE", ""), "检查点签名私钥文件（未指定-public-key时由此推导公钥）")
+	dump := fs.Bool("dump", false, "将解密后的记录输出到标准输出")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		if *dir == "" {
+			fmt.Fprintln(os.Stderr, "缺少-dir参数或审计文件")
+			fs.Usage()
+			return 2
+		}
+		files = auditFiles(*dir)
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "没有找到审计文件")
+		return 2
+	}
+
+	v := &auditVerifier{dump: *dump}
+	if *keyDir != "" {
+		keys, err := readAuditKeys(*keyDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		v.keys = keys
+	}
+	switch {
+	case *publicKeyFile != "":
+		key, err := readAuditPublicKey(*publicKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		v.publicKey = key
+	case *signingKeyFile != "":
+		key, err := readAuditSigningKey(*signingKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		v.publicKey = key.Public().(ed25519.PublicKey)
+	}
+
+	for _, file := range files {
+		err := scanAuditFile(file, func(lineNo int, line []byte) error {
+			v.verifyLine(file, lineNo, line)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取%s失败: %s\n", file, err)
+			return 2
+		}
+	}
+
+	if v.last != nil && v.last.Type != auditEnvelopeCheckpoint {
+		fmt.Fprintf(os.Stderr, "警告：最后%d条记录之后没有检查点（日志末尾可能被截断，或进程未正常停止）\n", v.seq-v.checkpointSeq)
+	}
+	fmt.Fprintf(os.Stderr, "共%d个文件，%d条记录，%d个检查点（%d个签名有效），解密%d条，链头序号%d\n",
+		len(files), v.records, v.checkpoints, v.signed, v.decrypted, v.seq)
+	if v.publicKey == nil {
+		fmt.Fprintln(os.Stderr, "未指定签名公钥，未校验检查点签名")
+	}
+	if v.keys == nil {
+		fmt.Fprintln(os.Stderr, "未指定密钥目录，未校验密文")
+	}
+	if v.breaks > 0 {
+		fmt.Fprintf(os.Stderr, "校验失败：发现%d处问题\n", v.breaks)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "校验通过")
+	return 0
+}
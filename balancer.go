@@ -0,0 +1,224 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceWeighted         = "weighted"
+	balanceLeastOutstanding = "least_outstanding"
+	balanceEWMALatency      = "ewma_latency"
+	balanceEWMATTFT         = "ewma_ttft"
+)
+
+// EWMA平滑系数：新样本所占权重
+const ewmaAlpha = 0.3
+
+// 上游的一个副本
+type Endpoint struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"` // 权重，默认1
+
+	outstanding int64 // 进行中的请求数
+	health      *endpointHealth
+
+	currentWeight int // 平滑加权轮询的当前权重（由balancer.weightMu保护）
+
+	mu          sync.Mutex
+	latencyEWMA float64 // 完整响应延迟的EWMA（毫秒）
+	ttftEWMA    float64 // 流式首字节延迟的EWMA（毫秒）
+}
+
+// 开始一次请求
+func (e *Endpoint) begin() {
+	atomic.AddInt64(&e.outstanding, 1)
+}
+
+// 结束一次请求
+func (e *Endpoint) end() {
+	atomic.AddInt64(&e.outstanding, -1)
+}
+
+// 进行中的请求数
+func (e *Endpoint) inFlight() int64 {
+	return atomic.LoadInt64(&e.outstanding)
+}
+
+// 记录延迟样本（流式请求为首字节延迟）
+func (e *Endpoint) observe(d time.Duration, isStream bool) {
+	ms := float64(d) / float64(time.Millisecond)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	target := &e.latencyEWMA
+	if isStream {
+		target = &e.ttftEWMA
+	}
+	if *target == 0 {
+		*target = ms
+	} else {
+		*target = ewmaAlpha*ms + (1-ewmaAlpha)*(*target)
+	}
+}
+
+// 按策略计算的负载分数，越小越优先
+func (e *Endpoint) score(strategy string) float64 {
+	outstanding := float64(atomic.LoadInt64(&e.outstanding))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch strategy {
+	case balanceLeastOutstanding:
+		return outstanding / float64(e.Weight)
+	case balanceEWMATTFT:
+		if e.ttftEWMA > 0 {
+			return e.ttftEWMA * (outstanding + 1)
+		}
+		return e.latencyEWMA * (outstanding + 1)
+	default:
+		return e.latencyEWMA * (outstanding + 1)
+	}
+}
+
+// 上游副本池的负载均衡器
+type balancer struct {
+	strategy  string
+	endpoints []*Endpoint
+	next      uint64 // 轮询计数
+
+	weightMu sync.Mutex // 保护所有副本的currentWeight，一次加权选择整体在锁内完成
+}
+
+// 选择一个可用副本（未被熔断或摘除），没有可用副本时返回nil
+// sessionID非空且开启粘性时按会话哈希固定副本；exclude为上次失败的副本，可用副本多于一个时跳过
+func (b *balancer) pick(sessionID string, sticky bool, exclude *Endpoint) *Endpoint {
+	candidates := make([]*Endpoint, 0, len(b.endpoints))
+	for _, e := range b.endpoints {
+		if e.health.available() {
+			candidates = append(candidates, e)
+		}
+	}
+	if exclude != nil && len(candidates) > 1 {
+		candidates = removeEndpoint(candidates, exclude)
+	}
+	for {
+		e := b.choose(candidates, sessionID, sticky)
+		if e == nil || e.health.tryAcquire() {
+			return e
+		}
+		// 选中后试探名额已被并发请求占满（或副本刚被摘除），换一个副本
+		candidates = removeEndpoint(candidates, e)
+	}
+}
+
+// 选择exclude以外的一个可用副本（用于对冲），没有其他可用副本时返回nil且不占用试探名额
+func (b *balancer) pickOther(exclude *Endpoint) *Endpoint {
+	candidates := make([]*Endpoint, 0, len(b.endpoints))
+	for _, e := range b.endpoints {
+		if e != exclude && e.health.available() {
+			candidates = append(candidates, e)
+		}
+	}
+	for {
+		e := b.choose(candidates, "", false)
+		if e == nil || e.health.tryAcquire() {
+			return e
+		}
+		candidates = removeEndpoint(candidates, e)
+	}
+}
+
+// 从候选列表中去掉指定副本
+func removeEndpoint(candidates []*Endpoint, e *Endpoint) []*Endpoint {
+	for i, c := range candidates {
+		if c == e {
+			return append(candidates[:i], candidates[i+1:]...)
+		}
+	}
+	return candidates
+}
+
+func (b *balancer) choose(candidates []*Endpoint, sessionID string, sticky bool) *Endpoint {
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	if sticky && sessionID != "" {
+		return rendezvousPick(candidates, sessionID)
+	}
+
+	switch b.strategy {
+	case balanceWeighted:
+		return b.pickWeighted(candidates)
+	case balanceLeastOutstanding, balanceEWMALatency, balanceEWMATTFT:
+		// 分数相同时从轮询位置开始取第一个，避免总是命中同一副本
+		start := int(atomic.AddUint64(&b.next, 1))
+		var best *Endpoint
+		bestScore := math.Inf(1)
+		for i := range candidates {
+			e := candidates[(start+i)%len(candidates)]
+			if s := e.score(b.strategy); s < bestScore {
+				best, bestScore = e, s
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint64(&b.next, 1)
+		return candidates[int(n-1)%len(candidates)]
+	}
+}
+
+// 平滑加权轮询（与nginx相同的算法）
+func (b *balancer) pickWeighted(candidates []*Endpoint) *Endpoint {
+	b.weightMu.Lock()
+	defer b.weightMu.Unlock()
+	var best *Endpoint
+	total := 0
+	for _, e := range candidates {
+		e.currentWeight += e.Weight
+		total += e.Weight
+		if best == nil || e.currentWeight > best.currentWeight {
+			best = e
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// 加权最高随机权重哈希：同一会话总是落到同一副本，副本增减时只迁移少量会话
+func rendezvousPick(candidates []*Endpoint, key string) *Endpoint {
+	var best *Endpoint
+	bestScore := math.Inf(-1)
+	for _, e := range candidates {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		io.WriteString(h, "|")
+		io.WriteString(h, e.URL)
+		// 将哈希映射到(0,1)，按权重计算分数
+		u := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+		score := -float64(e.Weight) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
+
+// 副本响应体：关闭时结束该副本上的请求计数
+type endpointBody struct {
+	io.ReadCloser
+	once     sync.Once
+	endpoint *Endpoint
+}
+
+func (b *endpointBody) Close() error {
+	b.once.Do(b.endpoint.end)
+	return b.ReadCloser.Close()
+}
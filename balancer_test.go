@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEndpoints(weights ...int) []*Endpoint {
+	cb := &BreakerConfig{}
+	cb.applyDefaults()
+	endpoints := make([]*Endpoint, len(weights))
+	for i, w := range weights {
+		endpoints[i] = &Endpoint{URL: fmt.Sprintf("http://e%d", i), Weight: w, health: newEndpointHealth(cb)}
+	}
+	return endpoints
+}
+
+// 连续选择n次，统计每个副本被选中的次数
+func pickCounts(b *balancer, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[b.pick("", false, nil).URL]++
+	}
+	return counts
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		want     map[string]int
+	}{
+		{"轮询", balanceRoundRobin, []int{1, 1, 1}, map[string]int{"http://e0": 4, "http://e1": 4, "http://e2": 4}},
+		{"加权", balanceWeighted, []int{4, 1, 1}, map[string]int{"http://e0": 8, "http://e1": 2, "http://e2": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &balancer{strategy: tt.strategy, endpoints: testEndpoints(tt.weights...)}
+			got := pickCounts(b, 12)
+			for url, n := range tt.want {
+				if got[url] != n {
+					t.Fatalf("%s picked %d times, want %d (%v)", url, got[url], n, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBalancerWeightedSmooth(t *testing.T) {
+	// nginx平滑加权轮询：权重5/1/1时不会连续选中e0超过必要次数
+	b := &balancer{strategy: balanceWeighted, endpoints: testEndpoints(5, 1, 1)}
+	var seq []string
+	for i := 0; i < 7; i++ {
+		seq = append(seq, b.pick("", false, nil).URL[7:])
+	}
+	want := []string{"e0", "e0", "e1", "e0", "e2", "e0", "e0"}
+	if fmt.Sprint(seq) != fmt.Sprint(want) {
+		t.Fatalf("sequence = %v, want %v", seq, want)
+	}
+}
+
+func TestBalancerWeightedConcurrent(t *testing.T) {
+	b := &balancer{strategy: balanceWeighted, endpoints: testEndpoints(3, 1)}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				url := b.pick("", false, nil).URL
+				mu.Lock()
+				counts[url]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if counts["http://e0"] != 600 || counts["http://e1"] != 200 {
+		t.Fatalf("counts = %v, want 600/200", counts)
+	}
+}
+
+func TestBalancerScoreStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		setup    func(e []*Endpoint)
+		want     string
+	}{
+		{"最少进行中请求", balanceLeastOutstanding, func(e []*Endpoint) {
+			e[0].begin()
+			e[0].begin()
+			e[1].begin()
+		}, "http://e2"},
+		{"EWMA延迟", balanceEWMALatency, func(e []*Endpoint) {
+			e[0].observe(300*time.Millisecond, false)
+			e[1].observe(100*time.Millisecond, false)
+			e[2].observe(200*time.Millisecond, false)
+		}, "http://e1"},
+		{"EWMA首字节", balanceEWMATTFT, func(e []*Endpoint) {
+			e[0].observe(50*time.Millisecond, true)
+			e[1].observe(500*time.Millisecond, true)
+			e[2].observe(90*time.Millisecond, true)
+		}, "http://e0"},
+		{"只失败的副本不因延迟为0被选中", balanceEWMALatency, func(e []*Endpoint) {
+			e[0].observe(100*time.Millisecond, false)
+			e[1].observe(120*time.Millisecond, false)
+			observeFailure(context.Background(), e[2], time.Now(), false)
+		}, "http://e0"},
+	}
+	defer func(timeout time.Duration) { targetClient.Timeout = timeout }(targetClient.Timeout)
+	targetClient.Timeout = 10 * time.Second
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints := testEndpoints(1, 1, 1)
+			tt.setup(endpoints)
+			b := &balancer{strategy: tt.strategy, endpoints: endpoints}
+			for i := 0; i < 3; i++ {
+				if got := b.pick("", false, nil).URL; got != tt.want {
+					t.Fatalf("pick = %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBalancerExcludeAndAvailability(t *testing.T) {
+	endpoints := testEndpoints(1, 1, 1)
+	endpoints[1].health.healthy = false
+	b := &balancer{strategy: balanceRoundRobin, endpoints: endpoints}
+	for i := 0; i < 6; i++ {
+		e := b.pick("", false, endpoints[0])
+		if e != endpoints[2] {
+			t.Fatalf("pick = %s, want http://e2（e1不健康，e0被排除）", e.URL)
+		}
+	}
+
+	// 只剩被排除的副本时pick仍返回它
+	endpoints[2].health.healthy = false
+	endpoints[0].health.state, endpoints[0].health.openedAt = breakerOpen, time.Now().Add(-time.Hour)
+	if e := b.pick("", false, endpoints[0]); e != endpoints[0] {
+		t.Fatal("只有一个可用副本时pick应返回它")
+	}
+}
+
+func TestBalancerSticky(t *testing.T) {
+	b := &balancer{strategy: balanceRoundRobin, endpoints: testEndpoints(1, 1, 1, 1)}
+	for _, session := range []string{"alice", "bob", "carol"} {
+		first := b.pick(session, true, nil)
+		for i := 0; i < 5; i++ {
+			if e := b.pick(session, true, nil); e != first {
+				t.Fatalf("session %s moved from %s to %s", session, first.URL, e.URL)
+			}
+		}
+	}
+}
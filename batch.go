@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 批量请求支持的接口（对外URL→网关内部路由）
+var batchEndpoints = map[string]string{
+	"/v1/chat/completions": "/chat/completions",
+	"/chat/completions":    "/chat/completions",
+	"/v1/completions":      "/v1/completions",
+	"/v1/embeddings":       "/v1/embeddings",
+	"/v1/responses":        "/v1/responses",
+}
+
+// 网关路由，用于批量任务在进程内执行请求
+var gatewayRouter http.Handler
+
+// 批量输入文件中的一行
+type batchRequestLine struct {
+	CustomID string                 `json:"custom_id"`
+	Method   string                 `json:"method"`
+	URL      string                 `json:"url"`
+	Body     map[string]interface{} `json:"body"`
+}
+
+// 批量输出/错误文件中的一行
+type batchResultLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *batchResultError    `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type batchResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// 输入文件校验错误
+type batchLineError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+}
+
+// 批量任务请求计数
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// OpenAI兼容的Batch对象
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           interface{}        `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         interface{}        `json:"metadata"`
+}
+
+// 批量执行参数
+type batchRunOptions struct {
+	Concurrency  int           // 最大并发请求数
+	RateLimit    float64       // 每秒最多发起的请求数，0表示不限制
+	Retries      int           // 可重试错误（429、5xx、无响应）的最大重试次数
+	RetryBackoff time.Duration // 首次重试等待时间，之后每次翻倍
+}
+
+// 简单的匀速限流器：相邻两次放行至少间隔interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// 创建限流器，perSecond<=0时返回nil（不限流）
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// 等待直到允许发起下一次请求
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 读取并校验JSONL请求文件；endpoint非空时要求每行url与之一致
+func readBatchRequestFile(path, endpoint string) ([]batchRequestLine, []batchLineError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开请求文件失败: %s", err)
+	}
+	defer f.Close()
+
+	var (
+		lines     []batchRequestLine
+		lineErrs  []batchLineError
+		customIDs = make(map[string]bool)
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var line batchRequestLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			lineErrs = append(lineErrs, batchLineError{"invalid_json_line", fmt.Sprintf("JSON格式错误: %s", err), lineNo})
+			continue
+		}
+		switch {
+		case line.CustomID == "":
+			lineErrs = append(lineErrs, batchLineError{"missing_required_parameter", "缺少custom_id", lineNo})
+		case customIDs[line.CustomID]:
+			lineErrs = append(lineErrs, batchLineError{"duplicate_custom_id", fmt.Sprintf("custom_id重复: %s", line.CustomID), lineNo})
+		case line.Method != "" && !strings.EqualFold(line.Method, http.MethodPost):
+			lineErrs = append(lineErrs, batchLineError{"invalid_method", fmt.Sprintf("不支持的method: %s", line.Method), lineNo})
+		case batchEndpoints[line.URL] == "":
+			lineErrs = append(lineErrs, batchLineError{"invalid_url", fmt.Sprintf("不支持的url: %s", line.URL), lineNo})
+		case endpoint != "" && line.URL != endpoint:
+			lineErrs = append(lineErrs, batchLineError{"mismatched_endpoint", fmt.Sprintf("url与批量任务endpoint不一致: %s", line.URL), lineNo})
+		case line.Body == nil:
+			lineErrs = append(lineErrs, batchLineError{"missing_required_parameter", "缺少body", lineNo})
+		}
+		customIDs[line.CustomID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("读取请求文件失败: %s", err)
+	}
+	if len(lines) == 0 && len(lineErrs) == 0 {
+		lineErrs = append(lineErrs, batchLineError{"empty_file", "请求文件为空", 0})
+	}
+	return lines, lineErrs, nil
+}
+
+// 读取已有的结果文件，返回已处理的custom_id（用于断点续跑）
+func readBatchResultFile(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, fmt.Errorf("打开结果文件失败: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var result batchResultLine
+		// 进程中断可能留下不完整的最后一行，直接忽略
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil || result.CustomID == "" {
+			continue
+		}
+		done[result.CustomID] = true
+	}
+	return done, scanner.Err()
+}
+
+// 在进程内通过网关路由执行单条请求，与HTTP请求走完全相同的处理流程
+func executeBatchRequest(ctx context.Context, line batchRequestLine) batchResultLine {
+	result := batchResultLine{ID: newObjectID("batch_req_"), CustomID: line.CustomID}
+
+	body := make(map[string]interface{}, len(line.Body))
+	for k, v := range line.Body {
+		body[k] = v
+	}
+	body["stream"] = false
+	payload, err := json.Marshal(body)
+	if err != nil {
+		result.Error = &batchResultError{"invalid_request", fmt.Sprintf("序列化请求体失败: %s", err)}
+		return result
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, batchEndpoints[line.URL], bytes.NewReader(payload))
+	if err != nil {
+		result.Error = &batchResultError{"invalid_request", fmt.Sprintf("构建请求失败: %s", err)}
+		return result
+	}
+	requestID := generateRandomString()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(correlationIDHeader, requestID)
+
+	recorder := httptest.NewRecorder()
+	gatewayRouter.ServeHTTP(recorder, req)
+
+	respBody := recorder.Body.Bytes()
+	if !json.Valid(respBody) {
+		respBody, _ = json.Marshal(string(respBody))
+	}
+	result.Response = &batchResultResponse{StatusCode: recorder.Code, RequestID: requestID, Body: respBody}
+	if recorder.Code >= http.StatusBadRequest {
+		var errBody struct {
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+			} `json:"error"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &errBody)
+		code := errBody.Error.Type
+		if code == "" {
+			code = "http_" + strconv.Itoa(recorder.Code)
+		}
+		result.Error = &batchResultError{code, errBody.Error.Message}
+	}
+	return result
+}
+
+// 判断批量请求结果是否值得重试
+func batchResultRetryable(result batchResultLine) bool {
+	if result.Error == nil {
+		return false
+	}
+	if result.Response == nil {
+		return true
+	}
+	return result.Response.StatusCode == http.StatusTooManyRequests || result.Response.StatusCode >= http.StatusInternalServerError
+}
+
+// 执行单条请求，可重试错误按指数退避重试
+func executeBatchRequestWithRetry(ctx context.Context, line batchRequestLine, opts batchRunOptions) batchResultLine {
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	result := executeBatchRequest(ctx, line)
+	for attempt := 0; attempt < opts.Retries && batchResultRetryable(result); attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result
+		}
+		backoff *= 2
+		result = executeBatchRequest(ctx, line)
+	}
+	return result
+}
+
+// 以有限并发和限流执行请求，跳过done中已处理的custom_id
+// onResult在同一时刻只会被一个goroutine调用，可在其中修改done；ctx取消后未完成的请求不会回调
+func runBatchRequests(ctx context.Context, lines []batchRequestLine, done map[string]bool, opts batchRunOptions, onResult func(batchResultLine)) {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := newRateLimiter(opts.RateLimit)
+
+	// 开始执行前确定待执行的请求，执行过程中不再读取done
+	pending := make([]batchRequestLine, 0, len(lines))
+	for _, line := range lines {
+		if !done[line.CustomID] {
+			pending = append(pending, line)
+		}
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sem = make(chan struct{}, concurrency)
+	)
+	for _, line := range pending {
+		if limiter.Wait(ctx) != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(line batchRequestLine) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result := executeBatchRequestWithRetry(ctx, line, opts)
+			if ctx.Err() != nil {
+				return
+			}
+			mu.Lock()
+			onResult(result)
+			mu.Unlock()
+		}(line)
+	}
+	wg.Wait()
+}
+
+// 批量任务管理：状态持久化到<dir>/<id>.json，结果逐行追加到输出/错误文件
+type batchManager struct {
+	mu      sync.Mutex
+	dir     string
+	opts    batchRunOptions
+	batches map[string]*Batch
+	cancels map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+var batches *batchManager
+
+// 初始化批量任务管理器，加载已有任务并恢复未完成的任务
+func initBatchManager(dataDir string) error {
+	dir := filepath.Join(dataDir, "batches")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("创建批量任务目录失败: %s", err)
+	}
+	batches = &batchManager{
+		dir: dir,
+		opts: batchRunOptions{
+			Concurrency:  getEnvInt("BATCH_CONCURRENCY", 4),
+			RateLimit:    float64(getEnvInt("BATCH_RATE_LIMIT", 0)),
+			Retries:      getEnvInt("BATCH_RETRIES", 0),
+			RetryBackoff: getEnvDuration("BATCH_RETRY_BACKOFF", time.Second),
+		},
+		batches: make(map[string]*Batch),
+		cancels: make(map[string]context.CancelFunc),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("读取批量任务目录失败: %s", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var batch Batch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			slog.Warn("忽略损坏的批量任务", "file", entry.Name(), "error", err)
+			continue
+		}
+		batches.batches[batch.ID] = &batch
+	}
+
+	// 恢复重启前未完成的任务
+	for _, batch := range batches.batches {
+		switch batch.Status {
+		case "validating", "in_progress", "finalizing":
+			slog.Info("恢复批量任务", "batch_id", batch.ID, "status", batch.Status)
+			batches.start(batch)
+		case "cancelling":
+			now := time.Now().Unix()
+			batch.Status = "cancelled"
+			batch.CancelledAt = &now
+			batches.save(batch)
+		}
+	}
+	return nil
+}
+
+func (m *batchManager) outputPath(id string) string {
+	return filepath.Join(m.dir, id+".output.jsonl")
+}
+
+func (m *batchManager) errorPath(id string) string {
+	return filepath.Join(m.dir, id+".errors.jsonl")
+}
+
+// 持久化任务状态（调用方需持有m.mu或确保无并发修改）
+func (m *batchManager) save(batch *Batch) {
+	data, _ := json.Marshal(batch)
+	if err := writeFileAtomic(filepath.Join(m.dir, batch.ID+".json"), data); err != nil {
+		slog.Error("保存批量任务失败", "batch_id", batch.ID, "error", err)
+	}
+}
+
+// 在锁内修改任务并持久化
+func (m *batchManager) update(batch *Batch, fn func(b *Batch)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(batch)
+	m.save(batch)
+}
+
+// 创建并启动批量任务
+func (m *batchManager) Create(inputFileID, endpoint, completionWindow string, metadata interface{}) (*Batch, error) {
+	if _, ok := files.Get(inputFileID); !ok {
+		return nil, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("未找到输入文件: %s", inputFileID)}
+	}
+	if batchEndpoints[endpoint] == "" {
+		return nil, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("不支持的endpoint: %s", endpoint)}
+	}
+	window, err := time.ParseDuration(completionWindow)
+	if err != nil || window <= 0 {
+		return nil, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("completion_window格式错误: %s", completionWindow)}
+	}
+
+	now := time.Now()
+	batch := &Batch{
+		ID:               newObjectID("batch_"),
+		Object:           "batch",
+		Endpoint:         endpoint,
+		InputFileID:      inputFileID,
+		CompletionWindow: completionWindow,
+		Status:           "validating",
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(window).Unix(),
+		Metadata:         metadata,
+	}
+	m.mu.Lock()
+	m.batches[batch.ID] = batch
+	m.save(batch)
+	snapshot := *batch
+	m.mu.Unlock()
+
+	m.start(batch)
+	return &snapshot, nil
+}
+
+// 返回任务快照
+func (m *batchManager) Get(id string) (Batch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[id]
+	if !ok {
+		return Batch{}, false
+	}
+	return *batch, true
+}
+
+// 按创建时间倒序列出任务快照
+func (m *batchManager) List() []Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Batch, 0, len(m.batches))
+	for _, batch := range m.batches {
+		list = append(list, *batch)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return list
+}
+
+// 取消任务：正在执行的请求被中断，已完成的结果保留
+func (m *batchManager) Cancel(id string) (Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[id]
+	if !ok {
+		return Batch{}, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到批量任务: %s", id)}
+	}
+	if batch.Status != "validating" && batch.Status != "in_progress" {
+		return Batch{}, &proxyError{http.StatusConflict, "invalid_request_error", fmt.Sprintf("批量任务当前状态为%s，无法取消", batch.Status)}
+	}
+	now := time.Now().Unix()
+	batch.Status = "cancelling"
+	batch.CancellingAt = &now
+	m.save(batch)
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+	}
+	return *batch, nil
+}
+
+// 停止所有正在执行的任务并等待退出；未完成的任务保持当前状态，重启后续跑
+func (m *batchManager) Stop() {
+	m.mu.Lock()
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// 启动后台执行
+func (m *batchManager) start(batch *Batch) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(batch.ExpiresAt, 0))
+	m.mu.Lock()
+	m.cancels[batch.ID] = cancel
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			cancel()
+			m.mu.Lock()
+			delete(m.cancels, batch.ID)
+			m.mu.Unlock()
+		}()
+		m.run(ctx, batch)
+	}()
+}
+
+// 执行批量任务：校验→执行→汇总输出文件
+func (m *batchManager) run(ctx context.Context, batch *Batch) {
+	// 1. 校验输入文件
+	lines, lineErrs, err := readBatchRequestFile(files.contentPath(batch.InputFileID), batch.Endpoint)
+	if err == nil && len(lineErrs) > 0 {
+		err = fmt.Errorf("输入文件校验失败")
+	}
+	if err != nil {
+		m.update(batch, func(b *Batch) {
+			now := time.Now().Unix()
+			if len(lineErrs) == 0 {
+				lineErrs = append(lineErrs, batchLineError{"invalid_file", err.Error(), 0})
+			}
+			b.Status = "failed"
+			b.FailedAt = &now
+			b.Errors = gin.H{"object": "list", "data": lineErrs}
+		})
+		return
+	}
+
+	// 2. 读取已有结果（重启后续跑）
+	done, err := readBatchResultFile(m.outputPath(batch.ID))
+	if err != nil {
+		slog.Error("读取批量任务输出失败", "batch_id", batch.ID, "error", err)
+	}
+	failedDone, err := readBatchResultFile(m.errorPath(batch.ID))
+	if err != nil {
+		slog.Error("读取批量任务错误输出失败", "batch_id", batch.ID, "error", err)
+	}
+	completed := len(done)
+	for id := range failedDone {
+		done[id] = true
+	}
+	m.update(batch, func(b *Batch) {
+		if b.InProgressAt == nil {
+			now := time.Now().Unix()
+			b.InProgressAt = &now
+		}
+		if b.Status == "validating" {
+			b.Status = "in_progress"
+		}
+		b.RequestCounts = BatchRequestCounts{Total: len(lines), Completed: completed, Failed: len(failedDone)}
+	})
+
+	// 3. 执行请求，结果逐行追加
+	outputFile, err := os.OpenFile(m.outputPath(batch.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		m.fail(batch, fmt.Sprintf("打开输出文件失败: %s", err))
+		return
+	}
+	defer outputFile.Close()
+	errorFile, err := os.OpenFile(m.errorPath(batch.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		m.fail(batch, fmt.Sprintf("打开错误文件失败: %s", err))
+		return
+	}
+	defer errorFile.Close()
+
+	writeResult := func(result batchResultLine) {
+		data, _ := json.Marshal(result)
+		data = append(data, '\n')
+		m.update(batch, func(b *Batch) {
+			if result.Error != nil {
+				errorFile.Write(data)
+				b.RequestCounts.Failed++
+			} else {
+				outputFile.Write(data)
+				b.RequestCounts.Completed++
+			}
+		})
+	}
+	m.mu.Lock()
+	running := batch.Status == "in_progress"
+	m.mu.Unlock()
+	if running {
+		runBatchRequests(ctx, lines, done, m.opts, func(result batchResultLine) {
+			done[result.CustomID] = true
+			writeResult(result)
+		})
+	}
+
+	// 4. 根据结束原因更新状态
+	m.mu.Lock()
+	status := batch.Status
+	m.mu.Unlock()
+	now := time.Now().Unix()
+	switch {
+	case status == "cancelling":
+		m.update(batch, func(b *Batch) {
+			b.Status = "cancelled"
+			b.CancelledAt = &now
+		})
+	case ctx.Err() == context.DeadlineExceeded:
+		// 超时未执行的请求记为batch_expired
+		for _, line := range lines {
+			if !done[line.CustomID] {
+				writeResult(batchResultLine{ID: newObjectID("batch_req_"), CustomID: line.CustomID, Error: &batchResultError{"batch_expired", "批量任务已超过completion_window，请求未执行"}})
+			}
+		}
+		m.finalize(batch, outputFile, errorFile, "expired")
+	case ctx.Err() != nil:
+		// 进程退出导致中断，保持当前状态，重启后续跑
+		return
+	default:
+		m.finalize(batch, outputFile, errorFile, "completed")
+	}
+}
+
+// 汇总输出文件并登记为File对象
+func (m *batchManager) finalize(batch *Batch, outputFile, errorFile *os.File, finalStatus string) {
+	m.update(batch, func(b *Batch) {
+		now := time.Now().Unix()
+		b.Status = "finalizing"
+		b.FinalizingAt = &now
+	})
+	outputFile.Close()
+	errorFile.Close()
+
+	register := func(path, suffix string) *string {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			os.Remove(path)
+			return nil
+		}
+		file, err := files.Import(path, fmt.Sprintf("%s_%s.jsonl", batch.ID, suffix), "batch_output")
+		if err != nil {
+			slog.Error("登记批量任务结果文件失败", "batch_id", batch.ID, "error", err)
+			return nil
+		}
+		return &file.ID
+	}
+	outputFileID := register(m.outputPath(batch.ID), "output")
+	errorFileID := register(m.errorPath(batch.ID), "error")
+
+	m.update(batch, func(b *Batch) {
+		now := time.Now().Unix()
+		b.OutputFileID = outputFileID
+		b.ErrorFileID = errorFileID
+		b.Status = finalStatus
+		if finalStatus == "expired" {
+			b.ExpiredAt = &now
+		} else {
+			b.CompletedAt = &now
+		}
+	})
+}
+
+// 标记任务失败
+func (m *batchManager) fail(batch *Batch, message string) {
+	m.update(batch, func(b *Batch) {
+		now := time.Now().Unix()
+		b.Status = "failed"
+		b.FailedAt = &now
+		b.Errors = gin.H{"object": "list", "data": []batchLineError{{"internal_error", message, 0}}}
+	})
+}
+
+// 创建批量任务（POST /v1/batches）
+func createBatchHandler(c *gin.Context) {
+	var batchRequest struct {
+		InputFileID      string      `json:"input_file_id"`
+		Endpoint         string      `json:"endpoint"`
+		CompletionWindow string      `json:"completion_window"`
+		Metadata         interface{} `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&batchRequest); err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("解析请求体失败: %s", err)})
+		return
+	}
+	if batchRequest.CompletionWindow == "" {
+		batchRequest.CompletionWindow = "24h"
+	}
+	batch, err := batches.Create(batchRequest.InputFileID, batchRequest.Endpoint, batchRequest.CompletionWindow, batchRequest.Metadata)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// 查询批量任务（GET /v1/batches/:id）
+func getBatchHandler(c *gin.Context) {
+	batch, ok := batches.Get(c.Param("id"))
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到批量任务: %s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
+
+// 列出批量任务（GET /v1/batches）
+func listBatchesHandler(c *gin.Context) {
+	list := batches.List()
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": list, "has_more": false})
+}
+
+// 取消批量任务（POST /v1/batches/:id/cancel）
+func cancelBatchHandler(c *gin.Context) {
+	batch, err := batches.Cancel(c.Param("id"))
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 离线批量执行参数
+type batchCommandOptions struct {
+	Input       string
+	Output      string
+	Errors      string
+	URL         string
+	IDField     string
+	PromptField string
+	Model       string
+	Progress    time.Duration
+	Run         batchRunOptions
+}
+
+// 读取离线批量输入文件，兼容三种行格式：
+// 1. Batch API格式（custom_id、url、body）
+// 2. 直接是请求体的JSON（custom_id取IDField字段，缺省为行号）
+// 3. 指定PromptField时，取该字段文本作为用户消息构建chat请求（如requests.jsonl）
+func readBatchCommandInput(opts batchCommandOptions) ([]batchRequestLine, error) {
+	f, err := os.Open(opts.Input)
+	if err != nil {
+		return nil, fmt.Errorf("打开输入文件失败: %s", err)
+	}
+	defer f.Close()
+
+	var (
+		lines     []batchRequestLine
+		customIDs = make(map[string]int)
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &raw); err != nil {
+			return nil, fmt.Errorf("第%d行JSON格式错误: %s", lineNo, err)
+		}
+
+		line := batchRequestLine{URL: opts.URL}
+		if body, ok := raw["body"].(map[string]interface{}); ok && raw["custom_id"] != nil {
+			// Batch API格式
+			line.CustomID = stringValue(raw["custom_id"])
+			line.Body = body
+			if u := stringValue(raw["url"]); u != "" {
+				line.URL = u
+			}
+		} else {
+			line.CustomID = stringValue(raw[opts.IDField])
+			if opts.PromptField != "" {
+				line.Body = map[string]interface{}{
+					"messages": []map[string]interface{}{{"role": "user", "content": stringValue(raw[opts.PromptField])}},
+				}
+			} else {
+				line.Body = raw
+				delete(line.Body, opts.IDField)
+			}
+		}
+		if line.CustomID == "" {
+			line.CustomID = "line-" + strconv.Itoa(lineNo)
+		}
+		if opts.Model != "" {
+			if _, ok := line.Body["model"]; !ok {
+				line.Body["model"] = opts.Model
+			}
+		}
+		if batchEndpoints[line.URL] == "" {
+			return nil, fmt.Errorf("第%d行url不受支持: %s", lineNo, line.URL)
+		}
+		if prev, ok := customIDs[line.CustomID]; ok {
+			return nil, fmt.Errorf("第%d行custom_id与第%d行重复: %s", lineNo, prev, line.CustomID)
+		}
+		customIDs[line.CustomID] = lineNo
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取输入文件失败: %s", err)
+	}
+	return lines, nil
+}
+
+// batch子命令：在进程内通过网关处理流程离线执行JSONL请求文件
+// 成功结果追加到输出文件，失败结果写入错误文件；重新运行时跳过输出文件中已成功的请求
+func runBatchCommand(args []string) int {
+	var opts batchCommandOptions
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	fs.StringVar(&opts.Input, "input", "", "输入JSONL文件（必填）")
+	fs.StringVar(&opts.Output, "output", "", "输出JSONL文件，默认<input>.output.jsonl")
+	fs.StringVar(&opts.Errors, "errors", "", "错误JSONL文件，默认<input>.errors.jsonl")
+	fs.StringVar(&opts.URL, "url", "/v1/chat/completions", "行内未指定url时使用的接口")
+	fs.StringVar(&opts.IDField, "id-field", "custom_id", "非Batch API格式时作为custom_id的字段")
+	fs.StringVar(&opts.PromptField, "prompt-field", "", "指定后取该字段文本作为用户消息构建chat请求")
+	fs.StringVar(&opts.Model, "model", "", "请求体未指定model时使用的模型")
+	fs.IntVar(&opts.Run.Concurrency, "concurrency", 4, "最大并发请求数")
+	fs.Float64Var(&opts.Run.RateLimit, "rate", 0, "每秒最多发起的请求数，0表示不限制")
+	fs.IntVar(&opts.Run.Retries, "retries", 2, "429/5xx/网络错误的最大重试次数")
+	fs.DurationVar(&opts.Run.RetryBackoff, "retry-backoff", time.Second, "首次重试等待时间，之后每次翻倍")
+	fs.DurationVar(&opts.Progress, "progress", 5*time.Second, "进度输出间隔")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Input == "" {
+		fmt.Fprintln(os.Stderr, "缺少-input参数")
+		fs.Usage()
+		return 2
+	}
+	if opts.Output == "" {
+		opts.Output = strings.TrimSuffix(opts.Input, ".jsonl") + ".output.jsonl"
+	}
+	if opts.Errors == "" {
+		opts.Errors = strings.TrimSuffix(opts.Input, ".jsonl") + ".errors.jsonl"
+	}
+
+	// 1. 初始化网关（与HTTP服务相同的配置和路由，不输出访问日志）
+	initGateway()
+	defer runShutdownHooks()
+	gin.DefaultWriter = io.Discard
+	gatewayRouter = newRouter()
+
+	// 2. 读取输入和已完成的结果
+	lines, err := readBatchCommandInput(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	done, err := readBatchResultFile(opts.Output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	skipped := 0
+	for _, line := range lines {
+		if done[line.CustomID] {
+			skipped++
+		}
+	}
+	pending := len(lines) - skipped
+	fmt.Fprintf(os.Stderr, "共%d条请求，已完成%d条，待执行%d条\n", len(lines), skipped, pending)
+	if pending == 0 {
+		return 0
+	}
+
+	// 3. 打开输出文件（失败的请求每次重新执行，因此错误文件每次覆盖）
+	outputFile, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开输出文件失败: %s\n", err)
+		return 2
+	}
+	defer outputFile.Close()
+	errorFile, err := os.Create(opts.Errors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开错误文件失败: %s\n", err)
+		return 2
+	}
+	defer errorFile.Close()
+
+	// 4. 执行，Ctrl-C中断后可重新运行续跑
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var succeeded, failed int64
+	start := time.Now()
+	printProgress := func() {
+		finished := atomic.LoadInt64(&succeeded) + atomic.LoadInt64(&failed)
+		rate := float64(finished) / time.Since(start).Seconds()
+		fmt.Fprintf(os.Stderr, "进度：%d/%d，成功%d，失败%d，%.1f条/秒\n", finished, pending, atomic.LoadInt64(&succeeded), atomic.LoadInt64(&failed), rate)
+	}
+	if opts.Progress > 0 {
+		ticker := time.NewTicker(opts.Progress)
+		defer ticker.Stop()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					printProgress()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	runBatchRequests(ctx, lines, done, opts.Run, func(result batchResultLine) {
+		data, _ := json.Marshal(result)
+		data = append(data, '\n')
+		if result.Error != nil {
+			errorFile.Write(data)
+			atomic.AddInt64(&failed, 1)
+		} else {
+			outputFile.Write(data)
+			atomic.AddInt64(&succeeded, 1)
+		}
+	})
+	printProgress()
+
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "已中断，重新运行相同命令可继续执行剩余请求\n")
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d条请求失败，详情见%s；重新运行相同命令将重试失败的请求\n", failed, opts.Errors)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func writeBatchInput(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadBatchCommandInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    batchCommandOptions
+		lines   []string
+		wantIDs []string
+		wantErr string
+	}{
+		{
+			name:    "Batch API格式",
+			lines:   []string{`{"custom_id":"a","url":"/v1/embeddings","body":{"input":"x"}}`},
+			wantIDs: []string{"a"},
+		},
+		{
+			name:    "请求体格式，缺少id时使用行号",
+			opts:    batchCommandOptions{IDField: "id"},
+			lines:   []string{`{"id":"a","messages":[]}`, ``, `{"messages":[]}`},
+			wantIDs: []string{"a", "line-3"},
+		},
+		{
+			name:    "prompt字段",
+			opts:    batchCommandOptions{IDField: "request_id", PromptField: "body", Model: "m"},
+			lines:   []string{`{"request_id":"r1","body":"hello"}`},
+			wantIDs: []string{"r1"},
+		},
+		{
+			name:    "custom_id重复",
+			opts:    batchCommandOptions{IDField: "id"},
+			lines:   []string{`{"id":"a"}`, `{"id":"a"}`},
+			wantErr: "重复",
+		},
+		{
+			name:    "不支持的url",
+			lines:   []string{`{"custom_id":"a","url":"/v1/models","body":{}}`},
+			wantErr: "不受支持",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Input = writeBatchInput(t, tt.lines...)
+			if tt.opts.URL == "" {
+				tt.opts.URL = "/v1/chat/completions"
+			}
+			lines, err := readBatchCommandInput(tt.opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, line := range lines {
+				ids = append(ids, line.CustomID)
+				if _, ok := line.Body[tt.opts.IDField]; ok && tt.opts.IDField != "custom_id" {
+					t.Fatalf("请求体不应保留id字段: %v", line.Body)
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Fatalf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if tt.opts.PromptField != "" {
+				messages, _ := lines[0].Body["messages"].([]map[string]interface{})
+				if lines[0].Body["model"] != "m" || len(messages) != 1 || messages[0]["content"] != "hello" {
+					t.Fatalf("body = %v", lines[0].Body)
+				}
+			}
+		})
+	}
+}
+
+func TestRunBatchCommandResume(t *testing.T) {
+	// 第一次收到"bad"时失败，之后成功
+	var badCalls int64
+	hits := startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		req := readTargetRequest(r)
+		if lastMessageText(req) == "bad" && atomic.AddInt64(&badCalls, 1) == 1 {
+			http.Error(w, `{"error":"boom"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"content": "ok", "finish_reason": "stop"})
+	})
+	oldRouter, oldWriter := gatewayRouter, gin.DefaultWriter
+	t.Cleanup(func() { gatewayRouter, gin.DefaultWriter = oldRouter, oldWriter })
+
+	input := writeBatchInput(t, `{"id":"1","text":"a"}`, `{"id":"2","text":"bad"}`, `{"id":"3","text":"c"}`)
+	args := []string{"-input", input, "-id-field", "id", "-prompt-field", "text", "-concurrency", "1", "-retries", "0", "-progress", "0"}
+	output := strings.TrimSuffix(input, ".jsonl") + ".output.jsonl"
+	errors := strings.TrimSuffix(input, ".jsonl") + ".errors.jsonl"
+
+	if code := runBatchCommand(args); code != 1 {
+		t.Fatalf("第一次运行exit = %d, want 1", code)
+	}
+	if got := batchFileIDs(t, output); got != "1,3" {
+		t.Fatalf("output = %s", got)
+	}
+	if got := batchFileIDs(t, errors); got != "2" {
+		t.Fatalf("errors = %s", got)
+	}
+
+	// 重新运行只执行失败的请求
+	if code := runBatchCommand(args); code != 0 {
+		t.Fatalf("第二次运行exit = %d, want 0", code)
+	}
+	if got := atomic.LoadInt64(hits); got != 4 {
+		t.Fatalf("target hits = %d, want 4", got)
+	}
+	if got := batchFileIDs(t, output); got != "1,3,2" {
+		t.Fatalf("output = %s", got)
+	}
+	if got := batchFileIDs(t, errors); got != "" {
+		t.Fatalf("错误文件应被覆盖: %s", got)
+	}
+}
+
+// 按写入顺序返回结果文件中的custom_id
+func batchFileIDs(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line batchResultLine
+		json.Unmarshal(scanner.Bytes(), &line)
+		ids = append(ids, line.CustomID)
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 替换网关路由：按请求体中的id统计调用次数，前fail次返回status
+type batchStubRouter struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	fail     map[string]int
+	status   int
+	inFlight int64
+	maxPeak  int64
+}
+
+func (s *batchStubRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	for {
+		peak := atomic.LoadInt64(&s.maxPeak)
+		if n <= peak || atomic.CompareAndSwapInt64(&s.maxPeak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	s.calls[body.ID]++
+	failing := s.calls[body.ID] <= s.fail[body.ID]
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if failing {
+		w.WriteHeader(s.status)
+		fmt.Fprint(w, `{"error":{"message":"busy","type":"rate_limit_error"}}`)
+		return
+	}
+	fmt.Fprintf(w, `{"id":%q}`, body.ID)
+}
+
+func useBatchStub(t *testing.T, stub *batchStubRouter) {
+	t.Helper()
+	old := gatewayRouter
+	gatewayRouter = stub
+	t.Cleanup(func() { gatewayRouter = old })
+}
+
+func batchLines(ids ...string) []batchRequestLine {
+	lines := make([]batchRequestLine, len(ids))
+	for i, id := range ids {
+		lines[i] = batchRequestLine{CustomID: id, Method: http.MethodPost, URL: "/v1/chat/completions", Body: map[string]interface{}{"id": id}}
+	}
+	return lines
+}
+
+func TestRunBatchRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		done      map[string]bool
+		fail      map[string]int
+		status    int
+		opts      batchRunOptions
+		wantCalls map[string]int
+		wantError map[string]string // custom_id -> 错误码，空表示成功
+	}{
+		{
+			name:      "跳过已完成",
+			done:      map[string]bool{"a": true, "c": true},
+			opts:      batchRunOptions{Concurrency: 2},
+			wantCalls: map[string]int{"b": 1, "d": 1},
+			wantError: map[string]string{"b": "", "d": ""},
+		},
+		{
+			name:      "429重试后成功",
+			fail:      map[string]int{"a": 2},
+			status:    http.StatusTooManyRequests,
+			opts:      batchRunOptions{Concurrency: 2, Retries: 2, RetryBackoff: time.Millisecond},
+			wantCalls: map[string]int{"a": 3, "b": 1, "c": 1, "d": 1},
+			wantError: map[string]string{"a": "", "b": "", "c": "", "d": ""},
+		},
+		{
+			name:      "重试次数用尽",
+			fail:      map[string]int{"b": 5},
+			status:    http.StatusBadGateway,
+			opts:      batchRunOptions{Concurrency: 4, Retries: 1, RetryBackoff: time.Millisecond},
+			wantCalls: map[string]int{"a": 1, "b": 2, "c": 1, "d": 1},
+			wantError: map[string]string{"a": "", "b": "rate_limit_error", "c": "", "d": ""},
+		},
+		{
+			name:      "4xx不重试",
+			fail:      map[string]int{"c": 5},
+			status:    http.StatusBadRequest,
+			opts:      batchRunOptions{Concurrency: 1, Retries: 3, RetryBackoff: time.Millisecond},
+			wantCalls: map[string]int{"a": 1, "b": 1, "c": 1, "d": 1},
+			wantError: map[string]string{"a": "", "b": "", "c": "rate_limit_error", "d": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &batchStubRouter{calls: map[string]int{}, fail: tt.fail, status: tt.status}
+			useBatchStub(t, stub)
+			done := tt.done
+			if done == nil {
+				done = map[string]bool{}
+			}
+
+			results := map[string]batchResultLine{}
+			runBatchRequests(context.Background(), batchLines("a", "b", "c", "d"), done, tt.opts, func(r batchResultLine) {
+				results[r.CustomID] = r
+				done[r.CustomID] = true // 与调用方一样在回调中更新done
+			})
+
+			if fmt.Sprint(stub.calls) != fmt.Sprint(tt.wantCalls) {
+				t.Fatalf("calls = %v, want %v", stub.calls, tt.wantCalls)
+			}
+			if len(results) != len(tt.wantError) {
+				t.Fatalf("results = %d, want %d", len(results), len(tt.wantError))
+			}
+			for id, code := range tt.wantError {
+				r := results[id]
+				got := ""
+				if r.Error != nil {
+					got = r.Error.Code
+				}
+				if got != code {
+					t.Fatalf("%s: error = %q, want %q", id, got, code)
+				}
+			}
+		})
+	}
+}
+
+func TestRunBatchRequestsConcurrency(t *testing.T) {
+	stub := &batchStubRouter{calls: map[string]int{}}
+	useBatchStub(t, stub)
+	ids := make([]string, 20)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("r%d", i)
+	}
+	var count int
+	runBatchRequests(context.Background(), batchLines(ids...), map[string]bool{}, batchRunOptions{Concurrency: 3}, func(batchResultLine) { count++ })
+	if count != len(ids) {
+		t.Fatalf("results = %d, want %d", count, len(ids))
+	}
+	if peak := atomic.LoadInt64(&stub.maxPeak); peak > 3 || peak < 2 {
+		t.Fatalf("peak concurrency = %d, want 2..3", peak)
+	}
+}
+
+func TestRunBatchRequestsCancel(t *testing.T) {
+	stub := &batchStubRouter{calls: map[string]int{}}
+	useBatchStub(t, stub)
+	ctx, cancel := context.WithCancel(context.Background())
+	var count int
+	runBatchRequests(ctx, batchLines("a", "b", "c", "d", "e", "f"), map[string]bool{}, batchRunOptions{Concurrency: 1}, func(batchResultLine) {
+		count++
+		if count == 2 {
+			cancel()
+		}
+	})
+	if count != 2 {
+		t.Fatalf("取消后不应再回调：results = %d", count)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 响应缓存后端
+const (
+	responseCacheMemory = "memory"
+	responseCacheDisk   = "disk"
+)
+
+// 精确匹配响应缓存配置（RESPONSE_CACHE为空时关闭）
+var responseCache struct {
+	backend           responseCacheBackend
+	ttl               time.Duration
+	scope             string // key：按调用方API Key隔离；global：所有调用方共享
+	deterministicOnly bool   // 只缓存temperature为0的请求
+	maxEntryBytes     int
+}
+
+// 一条缓存的目标服务响应：非流式保存响应体，流式保存每个data块（回放时保持原有分块）
+type cachedResponse struct {
+	Stream    bool              `json:"stream"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	Chunks    []json.RawMessage `json:"chunks,omitempty"`
+	Upstream  string            `json:"upstream"`
+	Model     string            `json:"model"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// 缓存后端
+type responseCacheBackend interface {
+	Get(key string) (*cachedResponse, bool)
+	Set(key string, entry *cachedResponse)
+}
+
+// 初始化响应缓存：RESPONSE_CACHE（memory、disk）、RESPONSE_CACHE_TTL、RESPONSE_CACHE_SCOPE、
+// RESPONSE_CACHE_MAX_ENTRIES（内存）、RESPONSE_CACHE_DIR和RESPONSE_CACHE_MAX_DISK_MB（磁盘）
+func initResponseCache() {
+	responseCache.backend = nil
+	responseCache.ttl = getEnvDuration("RESPONSE_CACHE_TTL", time.Hour)
+	responseCache.scope = getEnv("RESPONSE_CACHE_SCOPE", "key")
+	responseCache.deterministicOnly = getEnv("RESPONSE_CACHE_DETERMINISTIC_ONLY", "true") == "true"
+	responseCache.maxEntryBytes = getEnvInt("RESPONSE_CACHE_MAX_ENTRY_BYTES", 1024*1024)
+
+	switch mode := getEnv("RESPONSE_CACHE", ""); mode {
+	case "":
+		return
+	case responseCacheMemory:
+		responseCache.backend = newLRUCache[*cachedResponse](getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 10000), responseCache.ttl)
+	case responseCacheDisk:
+		dir := getEnv("RESPONSE_CACHE_DIR", filepath.Join(config.DataDir, "cache"))
+		backend, err := openDiskResponseCache(dir, int64(getEnvInt("RESPONSE_CACHE_MAX_DISK_MB", 1024))*1024*1024, responseCache.ttl)
+		if err != nil {
+			slog.Error("打开响应缓存目录失败，已关闭响应缓存", "dir", dir, "error", err)
+			return
+		}
+		responseCache.backend = backend
+	default:
+		slog.Error("不支持的RESPONSE_CACHE，已关闭响应缓存", "mode", mode)
+		return
+	}
+	if responseCache.scope != "global" {
+		responseCache.scope = "key"
+	}
+	slog.Info("响应缓存", "backend", getEnv("RESPONSE_CACHE", ""), "ttl", responseCache.ttl.String(),
+		"scope", responseCache.scope, "deterministic_only", responseCache.deterministicOnly)
+}
+
+// 计算请求的缓存Key；不可缓存时返回空串
+// Key由作用域（调用方Key或global）、模型和去掉stream相关字段后按键排序的请求体决定，
+// 因此同一请求的流式和非流式调用共用一条缓存
+func responseCacheKey(ctx context.Context, openaiRequest map[string]interface{}) string {
+	if responseCache.deterministicOnly && stringValue(openaiRequest["temperature"]) != "0" {
+		return ""
+	}
+	normalized := make(map[string]interface{}, len(openaiRequest))
+	for k, v := range openaiRequest {
+		if k != "stream" && k != "stream_options" {
+			normalized[k] = v
+		}
+	}
+	body, err := json.Marshal(normalized)
+	if err != nil {
+		return ""
+	}
+	scope := "global"
+	if responseCache.scope == "key" {
+		scope = "anonymous"
+		if info := getRequestInfo(ctx); info != nil {
+			scope = info.Key
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(scope + "\n" + stringValue(openaiRequest["model"]) + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 缓存写入回调：目标服务响应完整读取后调用
+type cacheStore func(entry *cachedResponse)
+
+// 客户端Cache-Control指令：no-cache跳过查询但仍写入，no-store既不查询也不写入
+func cacheDirectives(ctx context.Context) (lookup, store bool) {
+	directives := strings.ToLower(requestHeader(ctx, "Cache-Control"))
+	if strings.Contains(directives, "no-store") {
+		return false, false
+	}
+	return !strings.Contains(directives, "no-cache"), true
+}
+
+// 查询响应缓存：命中时返回按请求的流式标识合成的目标服务响应；
+// 未命中时返回写入回调（不可缓存或no-store时为nil），供转发后写入
+func lookupResponseCache(ctx context.Context, openaiRequest map[string]interface{}) (cacheStore, *http.Response) {
+	if responseCache.backend == nil {
+		return nil, nil
+	}
+	key := responseCacheKey(ctx, openaiRequest)
+	if key == "" {
+		return nil, nil
+	}
+	store := func(entry *cachedResponse) { responseCache.backend.Set(key, entry) }
+	lookup, storable := cacheDirectives(ctx)
+	if !lookup {
+		setResponseHeader(ctx, "X-Cache", "BYPASS")
+		metricResponseCache.add(1, "bypass")
+		if !storable {
+			return nil, nil
+		}
+		return store, nil
+	}
+	entry, ok := responseCache.backend.Get(key)
+	if !ok {
+		setResponseHeader(ctx, "X-Cache", "MISS")
+		metricResponseCache.add(1, "miss")
+		return store, nil
+	}
+	setResponseHeader(ctx, "X-Cache", "HIT")
+	setResponseHeader(ctx, "X-Cache-Age", strconv.Itoa(int(time.Since(entry.CreatedAt).Seconds())))
+	metricResponseCache.add(1, "hit")
+	recordServedBy(ctx, entry.Upstream, entry.Model)
+	isStream, _ := strconv.ParseBool(stringValue(openaiRequest["stream"]))
+	return nil, entry.response(isStream)
+}
+
+// 捕获成功的目标服务响应：包装响应体，完整读到EOF后在关闭时交给各写入回调
+func captureCacheableResponse(ctx context.Context, openaiRequest map[string]interface{}, resp *http.Response, stores ...cacheStore) {
+	var active []cacheStore
+	for _, store := range stores {
+		if store != nil {
+			active = append(active, store)
+		}
+	}
+	if len(active) == 0 || resp.StatusCode != http.StatusOK {
+		return
+	}
+	isStream, _ := strconv.ParseBool(stringValue(openaiRequest["stream"]))
+	entry := &cachedResponse{Stream: isStream, Model: stringValue(openaiRequest["model"])}
+	if info := getRequestInfo(ctx); info != nil {
+		snapshot := info.snapshot()
+		entry.Upstream, entry.Model = snapshot.Upstream, snapshot.Model
+	}
+	resp.Body = &cacheCaptureBody{ReadCloser: resp.Body, entry: entry, stores: active}
+}
+
+// 按请求的流式标识合成目标服务响应
+func (e *cachedResponse) response(stream bool) *http.Response {
+	var body []byte
+	contentType := "application/json"
+	switch {
+	case stream:
+		contentType = "text/event-stream"
+		var buf bytes.Buffer
+		chunks := e.Chunks
+		if !e.Stream {
+			// 非流式结果的字段与目标服务的流式块相同，作为一个块输出
+			chunks = []json.RawMessage{e.Body}
+		}
+		for _, chunk := range chunks {
+			buf.WriteString("data: ")
+			buf.Write(chunk)
+			buf.WriteString("\n\n")
+		}
+		buf.WriteString("data: [DONE]\n\n")
+		body = buf.Bytes()
+	case e.Stream:
+		body = e.mergeChunks()
+	default:
+		body = e.Body
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// 将流式块合并为非流式响应体：拼接content，其余字段取最后出现的值（finish_reason缺省为stop）
+func (e *cachedResponse) mergeChunks() []byte {
+	merged := map[string]interface{}{}
+	var content strings.Builder
+	for _, raw := range e.Chunks {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal(raw, &chunk); err != nil {
+			continue
+		}
+		for k, v := range chunk {
+			if k == "content" {
+				if s, ok := v.(string); ok {
+					content.WriteString(s)
+				}
+			} else if v != nil && v != "" {
+				merged[k] = v
+			}
+		}
+	}
+	merged["content"] = content.String()
+	if merged["finish_reason"] == nil {
+		merged["finish_reason"] = "stop"
+	}
+	body, _ := json.Marshal(merged)
+	return body
+}
+
+// 捕获目标服务响应体，完整读取后写入缓存（客户端中途断开等未读到EOF的响应不缓存）
+type cacheCaptureBody struct {
+	io.ReadCloser
+	once     sync.Once
+	entry    *cachedResponse
+	stores   []cacheStore
+	buf      bytes.Buffer
+	eof      bool
+	overflow bool
+}
+
+func (b *cacheCaptureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if b.buf.Len()+n > responseCache.maxEntryBytes {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *cacheCaptureBody) Close() error {
+	b.once.Do(func() {
+		if !b.eof || b.overflow {
+			return
+		}
+		if b.entry.Stream {
+			scanner := bufio.NewScanner(&b.buf)
+			scanner.Buffer(make([]byte, 0, 64*1024), responseCache.maxEntryBytes)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				data := strings.TrimPrefix(line, "data: ")
+				if data == "[DONE]" || !json.Valid([]byte(data)) {
+					continue
+				}
+				b.entry.Chunks = append(b.entry.Chunks, json.RawMessage(data))
+			}
+			if len(b.entry.Chunks) == 0 {
+				return
+			}
+		} else {
+			var body map[string]interface{}
+			if err := json.Unmarshal(b.buf.Bytes(), &body); err != nil || body["error"] != nil {
+				return
+			}
+			b.entry.Body = json.RawMessage(append([]byte(nil), b.buf.Bytes()...))
+		}
+		b.entry.CreatedAt = time.Now()
+		for _, store := range b.stores {
+			store(b.entry)
+		}
+	})
+	return b.ReadCloser.Close()
+}
+
+// 磁盘缓存：每条一个JSON文件，总大小超过上限时按最后访问时间淘汰
+type diskResponseCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu   sync.Mutex
+	size int64
+}
+
+func openDiskResponseCache(dir string, maxBytes int64, ttl time.Duration) (*diskResponseCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskResponseCache{dir: dir, maxBytes: maxBytes, ttl: ttl}
+	for _, f := range c.files() {
+		c.size += f.size
+	}
+	return c, nil
+}
+
+func (c *diskResponseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *diskResponseCache) Get(key string) (*cachedResponse, bool) {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		c.remove(path)
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(entry.CreatedAt) > c.ttl {
+		c.remove(path)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &entry, true
+}
+
+func (c *diskResponseCache) Set(key string, entry *cachedResponse) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	path := c.path(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err := os.Stat(path); err == nil {
+		c.size -= info.Size()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		slog.Error("写入响应缓存失败", "path", path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		slog.Error("写入响应缓存失败", "path", path, "error", err)
+		os.Remove(tmp)
+		return
+	}
+	c.size += int64(len(data))
+	if c.maxBytes > 0 && c.size > c.maxBytes {
+		c.evict()
+	}
+}
+
+func (c *diskResponseCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err := os.Stat(path); err == nil && os.Remove(path) == nil {
+		c.size -= info.Size()
+	}
+}
+
+type diskCacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *diskResponseCache) files() []diskCacheFile {
+	paths, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	files := make([]diskCacheFile, 0, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			files = append(files, diskCacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+	}
+	return files
+}
+
+// 淘汰最久未访问的条目，直到总大小降到上限的90%以下（调用方需持有c.mu）
+func (c *diskResponseCache) evict() {
+	files := c.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.size = 0
+	for _, f := range files {
+		c.size += f.size
+	}
+	evicted := 0
+	for _, f := range files {
+		if c.size <= c.maxBytes*9/10 {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			c.size -= f.size
+			evicted++
+		}
+	}
+	slog.Debug("淘汰响应缓存", "dir", c.dir, "evicted", evicted, "size", c.size)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStreamBody = "data: {\"content\":\"Hel\"}\n\ndata: {\"content\":\"lo\",\"finish_reason\":\"stop\"}\n\ndata: [DONE]\n\n"
+
+// 捕获一次目标服务响应，readAll为false时模拟客户端中途断开
+func captureEntry(t *testing.T, stream bool, status int, body string, readAll bool) *cachedResponse {
+	t.Helper()
+	resp := &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body))}
+	var stored *cachedResponse
+	captureCacheableResponse(context.Background(), map[string]interface{}{"model": "m", "stream": stream}, resp,
+		func(entry *cachedResponse) { stored = entry })
+	if readAll {
+		io.ReadAll(resp.Body)
+	} else {
+		resp.Body.Read(make([]byte, 4))
+	}
+	resp.Body.Close()
+	return stored
+}
+
+func TestCacheCapture(t *testing.T) {
+	defer func(n int) { responseCache.maxEntryBytes = n }(responseCache.maxEntryBytes)
+	responseCache.maxEntryBytes = 1024
+
+	tests := []struct {
+		name    string
+		stream  bool
+		status  int
+		body    string
+		readAll bool
+		cached  bool
+	}{
+		{"非流式", false, http.StatusOK, `{"content":"Hello","finish_reason":"stop"}`, true, true},
+		{"流式", true, http.StatusOK, testStreamBody, true, true},
+		{"未读完不缓存", false, http.StatusOK, `{"content":"Hello"}`, false, false},
+		{"非200不缓存", false, http.StatusBadGateway, `{"content":"Hello"}`, true, false},
+		{"错误响应不缓存", false, http.StatusOK, `{"error":{"message":"x"}}`, true, false},
+		{"超过大小上限不缓存", false, http.StatusOK, `{"content":"` + strings.Repeat("x", 2048) + `"}`, true, false},
+		{"流式无数据块不缓存", true, http.StatusOK, "data: [DONE]\n\n", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := captureEntry(t, tt.stream, tt.status, tt.body, tt.readAll)
+			if (entry != nil) != tt.cached {
+				t.Fatalf("cached = %v, want %v", entry != nil, tt.cached)
+			}
+			if entry != nil && tt.stream && len(entry.Chunks) != 2 {
+				t.Fatalf("chunks = %d, want 2", len(entry.Chunks))
+			}
+		})
+	}
+}
+
+func TestCacheReplay(t *testing.T) {
+	defer func(n int) { responseCache.maxEntryBytes = n }(responseCache.maxEntryBytes)
+	responseCache.maxEntryBytes = 1024
+	streamEntry := captureEntry(t, true, http.StatusOK, testStreamBody, true)
+	plainEntry := captureEntry(t, false, http.StatusOK, `{"content":"Hello","finish_reason":"stop"}`, true)
+
+	tests := []struct {
+		name        string
+		entry       *cachedResponse
+		stream      bool
+		contentType string
+		want        string
+	}{
+		{"流式回放保持分块", streamEntry, true, "text/event-stream", testStreamBody},
+		{"非流式回放", plainEntry, false, "application/json", `{"content":"Hello","finish_reason":"stop"}`},
+		{"流式结果合并为非流式", streamEntry, false, "application/json", `{"content":"Hello","finish_reason":"stop"}`},
+		{"非流式结果作为一个块", plainEntry, true, "text/event-stream", "data: {\"content\":\"Hello\",\"finish_reason\":\"stop\"}\n\ndata: [DONE]\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.entry.response(tt.stream)
+			body, _ := io.ReadAll(resp.Body)
+			if ct := resp.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Fatalf("Content-Type = %s, want %s", ct, tt.contentType)
+			}
+			if string(body) != tt.want {
+				t.Fatalf("body = %s, want %s", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskResponseCache(t *testing.T) {
+	entry := &cachedResponse{Body: json.RawMessage(`{"content":"` + strings.Repeat("x", 100) + `"}`), Model: "m", CreatedAt: time.Now()}
+	data, _ := json.Marshal(entry)
+	size := int64(len(data))
+	c, err := openDiskResponseCache(t.TempDir(), size*5/2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", entry)
+	if got, ok := c.Get("a"); !ok || string(got.Body) != string(entry.Body) {
+		t.Fatalf("Get = %v, %v", got, ok)
+	}
+
+	// 超过大小上限时淘汰最久未访问的条目
+	c.Set("b", entry)
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(c.path("b"), old, old)
+	c.Set("c", entry)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Fatalf("Get(%s) ok = %v, want %v", key, ok, want)
+		}
+	}
+
+	// 过期条目视为不存在并被删除
+	expired := *entry
+	expired.CreatedAt = time.Now().Add(-2 * time.Hour)
+	c.Set("d", &expired)
+	if _, ok := c.Get("d"); ok {
+		t.Fatal("过期条目应视为不存在")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 请求合并配置（COALESCE_REQUESTS=true时开启）
+var coalescing struct {
+	enabled bool
+	scope   string // key：只合并同一调用方的请求；global：合并所有调用方的相同请求
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// 一次进行中的上游调用：响应体读入缓冲区，由所有参与者各自从头读取
+type flight struct {
+	key    string
+	ready  chan struct{} // 收到响应头或调用失败时关闭
+	cancel context.CancelFunc
+
+	// 以下字段在ready关闭后只读
+	status     int
+	header     http.Header
+	served     requestInfo // 上游调用记录的上游、模型和故障转移
+	respHeader http.Header // 上游调用期间设置的客户端响应Header
+	err        error
+
+	mu           sync.Mutex
+	buf          []byte
+	done         bool
+	readErr      error         // 读取上游响应体的错误（正常结束为io.EOF）
+	notify       chan struct{} // 有新数据或结束时关闭并替换
+	participants int
+}
+
+// 初始化请求合并：COALESCE_REQUESTS、COALESCE_SCOPE
+func initCoalescing() {
+	coalescing.enabled = getEnv("COALESCE_REQUESTS", "false") == "true"
+	coalescing.scope = getEnv("COALESCE_SCOPE", "key")
+	if coalescing.scope != "global" {
+		coalescing.scope = "key"
+	}
+	coalescing.flights = make(map[string]*flight)
+	if coalescing.enabled {
+		slog.Info("请求合并", "scope", coalescing.scope)
+	}
+}
+
+// 合并Key：作用域和按键排序的完整请求体（含stream，流式和非流式请求分别合并）
+func coalesceKey(ctx context.Context, openaiRequest map[string]interface{}) string {
+	body, err := json.Marshal(openaiRequest)
+	if err != nil {
+		return ""
+	}
+	scope := "global"
+	if coalescing.scope == "key" {
+		scope = "anonymous"
+		if info := getRequestInfo(ctx); info != nil {
+			scope = info.Key
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte(scope + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 转发请求，相同的进行中请求共用一次上游调用
+// 第一个请求发起调用，后到的请求加入并先收到已缓冲的部分；shared表示响应来自其他请求发起的调用
+func forwardCoalesced(ctx context.Context, openaiRequest map[string]interface{}) (resp *http.Response, shared bool, err error) {
+	if !coalescing.enabled {
+		resp, err := forwardWithFailover(ctx, openaiRequest)
+		return resp, false, err
+	}
+	key := coalesceKey(ctx, openaiRequest)
+	if key == "" {
+		resp, err := forwardWithFailover(ctx, openaiRequest)
+		return resp, false, err
+	}
+
+	coalescing.mu.Lock()
+	f, shared := coalescing.flights[key]
+	var upstreamCtx context.Context
+	if !shared {
+		// 上游调用不随发起者断开而取消，所有参与者都离开后才取消
+		f = &flight{key: key, ready: make(chan struct{}), notify: make(chan struct{})}
+		upstreamCtx, f.cancel = context.WithCancel(flightContext(ctx))
+		coalescing.flights[key] = f
+	}
+	f.mu.Lock()
+	f.participants++
+	f.mu.Unlock()
+	coalescing.mu.Unlock()
+
+	role := "leader"
+	if shared {
+		role = "follower"
+	}
+	metricCoalesced.add(1, role)
+	if !shared {
+		go f.run(upstreamCtx, openaiRequest)
+	}
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		f.leave()
+		return nil, shared, contextError(ctx)
+	}
+	f.shareServedBy(ctx)
+	if f.err != nil {
+		f.leave()
+		return nil, shared, f.err
+	}
+	if shared {
+		logger(ctx).Debug("合并到进行中的上游请求", "upstream", f.served.Upstream)
+		setResponseHeader(ctx, "X-Gateway-Coalesced", "true")
+	}
+	return &http.Response{
+		StatusCode: f.status,
+		Status:     fmt.Sprintf("%d %s", f.status, http.StatusText(f.status)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     f.header.Clone(),
+		Body:       &flightReader{ctx: ctx, flight: f},
+	}, shared, nil
+}
+
+// 上游调用的Context：不随发起者取消，使用独立的requestInfo和响应Header，
+// 发起者结束后上游调用不会再写入它的gin上下文；只沿用trace上下文，Key和会话仅在按Key合并时沿用
+func flightContext(ctx context.Context) context.Context {
+	info := &requestInfo{header: http.Header{}, requestHeader: http.Header{}, Key: "coalesced", Start: time.Now()}
+	if leader := getRequestInfo(ctx); leader != nil {
+		snapshot := leader.snapshot()
+		info.CorrelationID, info.Route = snapshot.CorrelationID, snapshot.Route
+		if coalescing.scope == "key" {
+			info.Key, info.SessionID = snapshot.Key, snapshot.SessionID
+		}
+	}
+	flightCtx := context.WithValue(context.Background(), requestInfoKey{}, info)
+	if s, ok := ctx.Value(spanKey{}).(*span); ok && s != nil {
+		flightCtx = context.WithValue(flightCtx, spanKey{}, s)
+	}
+	return flightCtx
+}
+
+// 把上游调用记录的请求模型、故障转移、处理上游和响应Header复制给参与者
+func (f *flight) shareServedBy(ctx context.Context) {
+	if f.served.RequestedModel != "" {
+		recordRequestedModel(ctx, f.served.RequestedModel)
+	}
+	for _, from := range f.served.Failover {
+		recordFailover(ctx, from)
+	}
+	for name, values := range f.respHeader {
+		switch name {
+		case "X-Gateway-Upstream", "X-Gateway-Model", "X-Gateway-Failover":
+			continue
+		}
+		for _, value := range values {
+			setResponseHeader(ctx, name, value)
+		}
+	}
+	if f.served.Upstream != "" {
+		recordServedBy(ctx, f.served.Upstream, f.served.Model)
+	}
+}
+
+// 发起上游调用并将响应体读入缓冲区
+func (f *flight) run(ctx context.Context, openaiRequest map[string]interface{}) {
+	defer f.cancel()
+	resp, err := forwardWithFailover(ctx, openaiRequest)
+	if info := getRequestInfo(ctx); info != nil {
+		f.served = info.snapshot()
+		info.mu.Lock()
+		f.respHeader = info.header.Clone()
+		info.mu.Unlock()
+	}
+	if err != nil {
+		f.err = err
+		f.finish(err)
+		close(f.ready)
+		return
+	}
+	defer resp.Body.Close()
+	f.status, f.header = resp.StatusCode, resp.Header
+	close(f.ready)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			f.mu.Lock()
+			f.buf = append(f.buf, buf[:n]...)
+			close(f.notify)
+			f.notify = make(chan struct{})
+			f.mu.Unlock()
+		}
+		if err != nil {
+			f.finish(err)
+			return
+		}
+	}
+}
+
+// 上游调用结束：不再接受新的参与者，通知所有读取者
+func (f *flight) finish(err error) {
+	coalescing.mu.Lock()
+	if coalescing.flights[f.key] == f {
+		delete(coalescing.flights, f.key)
+	}
+	coalescing.mu.Unlock()
+	f.mu.Lock()
+	f.done, f.readErr = true, err
+	close(f.notify)
+	f.notify = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// 参与者离开；最后一个参与者在上游调用结束前离开时取消上游调用
+func (f *flight) leave() {
+	coalescing.mu.Lock()
+	f.mu.Lock()
+	f.participants--
+	abandoned := f.participants == 0 && !f.done
+	f.mu.Unlock()
+	if abandoned && coalescing.flights[f.key] == f {
+		// 取消中的调用不再接受新的参与者
+		delete(coalescing.flights, f.key)
+	}
+	coalescing.mu.Unlock()
+	if abandoned {
+		f.cancel()
+	}
+}
+
+// 参与者各自的响应体：从缓冲区开头读起，读到末尾时等待新数据
+type flightReader struct {
+	ctx    context.Context
+	flight *flight
+	offset int
+	once   sync.Once
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+	for {
+		f.mu.Lock()
+		if r.offset < len(f.buf) {
+			n := copy(p, f.buf[r.offset:])
+			r.offset += n
+			f.mu.Unlock()
+			return n, nil
+		}
+		if f.done {
+			err := f.readErr
+			f.mu.Unlock()
+			return 0, err
+		}
+		notify := f.notify
+		f.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-r.ctx.Done():
+			return 0, contextError(r.ctx)
+		}
+	}
+}
+
+func (r *flightReader) Close() error {
+	r.once.Do(r.flight.leave)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 开启请求合并，目标服务在release关闭前阻塞
+func startCoalesceBackend(t *testing.T) (*int64, chan struct{}) {
+	t.Helper()
+	t.Setenv("COALESCE_REQUESTS", "true")
+	release := make(chan struct{})
+	hits := startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		echoTarget(w, r)
+	})
+	t.Cleanup(func() { coalescing.enabled = false })
+	return hits, release
+}
+
+// 等待进行中的上游调用累计到want个参与者
+func waitParticipants(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		coalescing.mu.Lock()
+		n := 0
+		for _, f := range coalescing.flights {
+			f.mu.Lock()
+			n += f.participants
+			f.mu.Unlock()
+		}
+		coalescing.mu.Unlock()
+		if n == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("等待%d个参与者超时", want)
+}
+
+// 在后台发送请求，返回完成时关闭的通道
+func serveAsync(ctx context.Context, router http.Handler, body string) (*httptest.ResponseRecorder, chan struct{}) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(w, req)
+	}()
+	return w, done
+}
+
+func TestCoalesceIdenticalRequests(t *testing.T) {
+	hits, release := startCoalesceBackend(t)
+	router := newRouter()
+	const body = `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`
+
+	const n = 4
+	var recorders []*httptest.ResponseRecorder
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		w, done := serveAsync(context.Background(), router, body)
+		recorders = append(recorders, w)
+		wg.Add(1)
+		go func() { <-done; wg.Done() }()
+		waitParticipants(t, i+1)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt64(hits); got != 1 {
+		t.Fatalf("target hits = %d, want 1", got)
+	}
+	for i, w := range recorders {
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "echo:hi") {
+			t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body)
+		}
+		if w.Header().Get("X-Gateway-Upstream") != "default" {
+			t.Fatalf("request %d: 每个参与者都应返回处理上游: %v", i, w.Header())
+		}
+		if coalesced := w.Header().Get("X-Gateway-Coalesced") == "true"; coalesced != (i > 0) {
+			t.Fatalf("request %d: X-Gateway-Coalesced = %q", i, w.Header().Get("X-Gateway-Coalesced"))
+		}
+	}
+}
+
+func TestCoalesceLeaderCancel(t *testing.T) {
+	hits, release := startCoalesceBackend(t)
+	router := newRouter()
+	const body = `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	_, leaderDone := serveAsync(leaderCtx, router, body)
+	waitParticipants(t, 1)
+	follower, followerDone := serveAsync(context.Background(), router, body)
+	waitParticipants(t, 2)
+
+	// 发起者断开后上游调用继续，跟随者仍收到完整响应
+	cancel()
+	<-leaderDone
+	close(release)
+	<-followerDone
+
+	if follower.Code != http.StatusOK || !strings.Contains(follower.Body.String(), "echo:hi") {
+		t.Fatalf("follower status = %d: %s", follower.Code, follower.Body)
+	}
+	if got := atomic.LoadInt64(hits); got != 1 {
+		t.Fatalf("target hits = %d, want 1", got)
+	}
+}
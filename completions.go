@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 旧版Completions接口专有、不透传给目标服务的字段
+var completionOnlyFields = map[string]bool{
+	"prompt":   true,
+	"suffix":   true,
+	"echo":     true,
+	"logprobs": true,
+	"best_of":  true,
+	"n":        true,
+	"stream":   true,
+}
+
+// 单次请求最多生成的choice数（n×prompt条数），每个choice对应一次上游调用
+const maxCompletionChoices = 128
+
+// 非流式请求同时进行的上游调用数
+const completionConcurrency = 8
+
+// 模拟文本续写时注入的system提示
+const completionSystemPrompt = "Continue the text provided by the user. Output only the continuation itself, without any preamble or explanation."
+
+// 旧版Completions响应中的单个choice
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// 旧版Completions响应结构（流式chunk结构相同）
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// Token用量统计
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// 解析prompt字段（字符串或字符串数组，不支持token数组）
+func parseCompletionPrompts(v interface{}) ([]string, error) {
+	switch p := v.(type) {
+	case nil:
+		return []string{""}, nil
+	case string:
+		return []string{p}, nil
+	case []interface{}:
+		if len(p) == 0 {
+			return []string{""}, nil
+		}
+		prompts := make([]string, 0, len(p))
+		for _, item := range p {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("不支持token数组形式的prompt，请传入字符串或字符串数组")
+			}
+			prompts = append(prompts, s)
+		}
+		return prompts, nil
+	default:
+		return nil, fmt.Errorf("prompt格式错误，应为字符串或字符串数组")
+	}
+}
+
+// 将单条prompt转换为目标服务的chat请求
+func buildChatRequestFromPrompt(completionRequest map[string]interface{}, prompt, suffix string) map[string]interface{} {
+	chatRequest := make(map[string]interface{}, len(completionRequest)+1)
+	for k, v := range completionRequest {
+		if !completionOnlyFields[k] {
+			chatRequest[k] = v
+		}
+	}
+
+	systemPrompt := completionSystemPrompt
+	if suffix != "" {
+		systemPrompt += " The continuation will be immediately followed by the text below, so it must connect naturally to it:\n" + suffix
+	}
+	chatRequest["messages"] = []map[string]interface{}{
+		{"role": "system", "content": systemPrompt},
+		{"role": "user", "content": prompt},
+	}
+	return chatRequest
+}
+
+// 旧版文本续写接口（/v1/completions），转换为chat请求后复用Token和转发流程
+func completionsHandler(c *gin.Context) {
+	// 1. 读取Completions格式请求
+	var completionRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&completionRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("解析请求体失败: %s", err),
+				"type":    "invalid_request_error",
+			},
+		})
+		return
+	}
+
+	// 2. 解析Completions专有参数
+	prompts, err := parseCompletionPrompts(completionRequest["prompt"])
+	if err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", err.Error()})
+		return
+	}
+	suffix := stringValue(completionRequest["suffix"])
+	echo, _ := strconv.ParseBool(stringValue(completionRequest["echo"]))
+	if intValue(completionRequest["logprobs"]) > 0 {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", "不支持logprobs参数"})
+		return
+	}
+	if bestOf := completionRequest["best_of"]; bestOf != nil && intValue(bestOf) != 1 {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", "不支持best_of参数"})
+		return
+	}
+	n := intValue(completionRequest["n"])
+	if n < 1 {
+		n = 1
+	}
+	if n*len(prompts) > maxCompletionChoices {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("n与prompt条数的乘积不能超过%d", maxCompletionChoices)})
+		return
+	}
+	isStream, _ := strconv.ParseBool(stringValue(completionRequest["stream"]))
+
+	// 3. 每条prompt重复n次，依次构建chat请求
+	var chatRequests []map[string]interface{}
+	var chatPrompts []string
+	model := ""
+	for _, prompt := range prompts {
+		for i := 0; i < n; i++ {
+			chatRequest := buildChatRequestFromPrompt(completionRequest, prompt, suffix)
+			model, _ = prepareTargetRequest(chatRequest)
+			chatRequests = append(chatRequests, chatRequest)
+			chatPrompts = append(chatPrompts, prompt)
+		}
+	}
+
+	if isStream {
+		streamCompletions(c, chatRequests, chatPrompts, model, echo)
+		return
+	}
+
+	// 4. 非流式：以有限并发调用目标服务，按原顺序汇总为text_completion
+	results, err := callTargetConcurrently(c.Request.Context(), chatRequests)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	completionResp := CompletionResponse{
+		ID:      newObjectID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   servedModel(c.Request.Context(), model),
+		Usage:   &Usage{},
+	}
+	for i, result := range results {
+		text := result.Content
+		if echo {
+			text = chatPrompts[i] + text
+		}
+		finishReason := result.FinishReason
+		completionResp.Choices = append(completionResp.Choices, CompletionChoice{
+			Text:         text,
+			Index:        i,
+			FinishReason: &finishReason,
+		})
+		completionResp.Usage.PromptTokens += result.PromptTokens
+		completionResp.Usage.CompletionTokens += result.CompletionTokens
+	}
+	completionResp.Usage.TotalTokens = completionResp.Usage.PromptTokens + completionResp.Usage.CompletionTokens
+
+	c.JSON(http.StatusOK, completionResp)
+}
+
+// 以最多completionConcurrency个并发调用目标服务，结果与请求顺序一致；任一调用失败时取消其余调用并返回该错误
+func callTargetConcurrently(ctx context.Context, chatRequests []map[string]interface{}) ([]*targetResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*targetResult, len(chatRequests))
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		sem      = make(chan struct{}, completionConcurrency)
+	)
+	for i, chatRequest := range chatRequests {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, chatRequest map[string]interface{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := callTargetOnce(ctx, chatRequest)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = result
+		}(i, chatRequest)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// 流式Completions：依次转发每个chat请求，并将目标SSE转换为text_completion chunk
+func streamCompletions(c *gin.Context, chatRequests []map[string]interface{}, chatPrompts []string, model string, echo bool) {
+	completionID := newObjectID("cmpl-")
+	created := time.Now().Unix()
+	newChunk := func(index int, text string, finishReason *string) CompletionResponse {
+		return CompletionResponse{
+			ID:      completionID,
+			Object:  "text_completion",
+			Created: created,
+			Model:   model,
+			Choices: []CompletionChoice{{Text: text, Index: index, FinishReason: finishReason}},
+		}
+	}
+
+	headerSent := false
+	for i, chatRequest := range chatRequests {
+		resp, err := openTargetStream(c.Request.Context(), chatRequest)
+		if err != nil {
+			// 尚未开始输出时按普通错误返回
+			if !headerSent {
+				writeProxyError(c, err)
+			} else {
+				writeSSEError(c, err)
+			}
+			return
+		}
+		model = servedModel(c.Request.Context(), model)
+		if !headerSent {
+			setSSEHeaders(c)
+			c.Status(http.StatusOK)
+			headerSent = true
+		}
+
+		// echo模式先输出原始prompt
+		if echo && chatPrompts[i] != "" {
+			writeSSEData(c, newChunk(i, chatPrompts[i], nil))
+		}
+
+		finishReason := "stop"
+		err = readTargetStream(c.Request.Context(), resp.Body, func(targetChunk map[string]interface{}) error {
+			if fr := stringValue(targetChunk["finish_reason"]); fr != "" {
+				finishReason = fr
+			}
+			if content := stringValue(targetChunk["content"]); content != "" {
+				writeSSEData(c, newChunk(i, content, nil))
+			}
+			return nil
+		})
+		resp.Body.Close()
+		if err != nil {
+			if !clientGone(c.Request.Context()) {
+				writeSSEError(c, err)
+			}
+			return
+		}
+		writeSSEData(c, newChunk(i, "", &finishReason))
+	}
+
+	c.Writer.WriteString("data: [DONE]\n\n")
+	c.Writer.Flush()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompletionsValidation(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"logprobs为null", `{"model":"m","prompt":"hi","logprobs":null}`, http.StatusOK},
+		{"logprobs为0", `{"model":"m","prompt":"hi","logprobs":0}`, http.StatusOK},
+		{"logprobs大于0", `{"model":"m","prompt":"hi","logprobs":5}`, http.StatusBadRequest},
+		{"best_of为1", `{"model":"m","prompt":"hi","best_of":1}`, http.StatusOK},
+		{"best_of大于1", `{"model":"m","prompt":"hi","best_of":3}`, http.StatusBadRequest},
+		{"choice数超过上限", `{"model":"m","prompt":["a","b"],"n":65}`, http.StatusBadRequest},
+		{"token数组prompt", `{"model":"m","prompt":[1,2,3]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveJSON(completionsHandler, tt.body); w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestCompletionsChoicesOrderAndEcho(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	w := serveJSON(completionsHandler, `{"model":"m","prompt":["a","b"],"n":2,"echo":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp CompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := []string{"aecho:a", "aecho:a", "becho:b", "becho:b"}
+	if len(resp.Choices) != len(want) {
+		t.Fatalf("choices = %d, want %d", len(resp.Choices), len(want))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.Text != want[i] {
+			t.Fatalf("choice %d = %+v, want text %q", i, choice, want[i])
+		}
+	}
+	if resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 24 {
+		t.Fatalf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestCompletionsConcurrentFanOut(t *testing.T) {
+	var inFlight, peak int64
+	startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		echoTarget(w, r)
+	})
+
+	start := time.Now()
+	w := serveJSON(completionsHandler, `{"model":"m","prompt":"hi","n":16}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	// 16次调用、每次50ms：串行需要800ms，并发8时约100ms
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("elapsed = %s, 非流式调用应并发执行", elapsed)
+	}
+	if p := atomic.LoadInt64(&peak); p > completionConcurrency {
+		t.Fatalf("peak = %d, want <= %d", p, completionConcurrency)
+	}
+}
+
+func TestCompletionsErrorCancelsRest(t *testing.T) {
+	startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if lastMessageText(readTargetRequest(r)) == "bad" {
+			http.Error(w, `{"error":"boom"}`, http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		echoTarget(w, r)
+	})
+	w := serveJSON(completionsHandler, `{"model":"m","prompt":["ok","bad","ok"]}`)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "downstream_error") {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCompletionsStream(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	w := serveJSON(completionsHandler, `{"model":"m","prompt":["a","b"],"stream":true}`)
+	if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Fatalf("body = %s", w.Body)
+	}
+	texts := map[int]string{}
+	finished := 0
+	for _, event := range sseData(w.Body.String()) {
+		choice := event["choices"].([]interface{})[0].(map[string]interface{})
+		index := intValue(choice["index"])
+		texts[index] += stringValue(choice["text"])
+		if choice["finish_reason"] != nil {
+			finished++
+		}
+	}
+	if texts[0] != "echo:a" || texts[1] != "echo:b" || finished != 2 {
+		t.Fatalf("texts = %v, finished = %d", texts, finished)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Embedding上游服务配置（EMBEDDING_UPSTREAMS，JSON数组）
+type EmbeddingUpstream struct {
+	Name      string   `json:"name"`
+	URL       string   `json:"url"`
+	Models    []string `json:"models"`     // 该上游支持的模型，"*"表示任意模型
+	BatchSize int      `json:"batch_size"` // 单次请求最多包含的input条数
+	UseToken  bool     `json:"use_token"`  // 是否附带网关获取的JWT Token
+	APIKey    string   `json:"api_key"`    // 可选：以Bearer方式发送的API Key
+}
+
+var (
+	embeddingUpstreams  []EmbeddingUpstream
+	embeddingClient     = &http.Client{}
+	embeddingCache      *lruCache[[]float64]
+	embeddingConcurrent int
+)
+
+// Embeddings接口中单条向量结果
+type EmbeddingData struct {
+	Object    string      `json:"object"`
+	Index     int         `json:"index"`
+	Embedding interface{} `json:"embedding"` // float数组或base64字符串
+}
+
+// Embeddings接口响应结构
+type EmbeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// 初始化Embedding相关配置
+func initEmbeddingConfig() {
+	if _, err := loadJSONEnv("EMBEDDING_UPSTREAMS", &embeddingUpstreams); err != nil {
+		slog.Error("EMBEDDING_UPSTREAMS配置错误，已忽略", "error", err)
+		embeddingUpstreams = nil
+	}
+	for i := range embeddingUpstreams {
+		if embeddingUpstreams[i].BatchSize <= 0 {
+			embeddingUpstreams[i].BatchSize = 128
+		}
+		if embeddingUpstreams[i].Name == "" {
+			embeddingUpstreams[i].Name = fmt.Sprintf("embedding-%d", i)
+		}
+	}
+	embeddingClient.Timeout = getEnvDuration("EMBEDDING_TIMEOUT", 30*time.Second)
+	embeddingConcurrent = getEnvInt("EMBEDDING_CONCURRENCY", 4)
+	if embeddingConcurrent < 1 {
+		embeddingConcurrent = 1
+	}
+	embeddingCache = newLRUCache[[]float64](
+		getEnvInt("EMBEDDING_CACHE_SIZE", 10000),
+		getEnvDuration("EMBEDDING_CACHE_TTL", time.Hour),
+	)
+	slog.Info("Embedding上游", "count", len(embeddingUpstreams))
+}
+
+// 按模型名查找Embedding上游
+func findEmbeddingUpstream(model string) *EmbeddingUpstream {
+	for i := range embeddingUpstreams {
+		for _, m := range embeddingUpstreams[i].Models {
+			if m == model || m == "*" {
+				return &embeddingUpstreams[i]
+			}
+		}
+	}
+	return nil
+}
+
+// 解析input字段：字符串、字符串数组、token数组或token数组的数组
+func parseEmbeddingInputs(v interface{}) ([]interface{}, error) {
+	switch in := v.(type) {
+	case string:
+		return []interface{}{in}, nil
+	case []interface{}:
+		if len(in) == 0 {
+			return nil, fmt.Errorf("input不能为空")
+		}
+		// 单个token数组视为一条输入
+		if _, ok := in[0].(float64); ok {
+			return []interface{}{in}, nil
+		}
+		return in, nil
+	default:
+		return nil, fmt.Errorf("input格式错误，应为字符串、字符串数组或token数组")
+	}
+}
+
+// 计算缓存键：上游+模型+输入内容的SHA256
+func embeddingCacheKey(upstream, model string, input interface{}) string {
+	inputBytes, _ := json.Marshal(input)
+	h := sha256.New()
+	h.Write([]byte(upstream))
+	h.Write([]byte{0})
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(inputBytes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 截断向量维度并重新做L2归一化
+func truncateEmbedding(vec []float64, dimensions int) []float64 {
+	if dimensions <= 0 || dimensions >= len(vec) {
+		return vec
+	}
+	out := make([]float64, dimensions)
+	copy(out, vec[:dimensions])
+	var norm float64
+	for _, x := range out {
+		norm += x * x
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range out {
+			out[i] /= norm
+		}
+	}
+	return out
+}
+
+// 将向量编码为little-endian float32的base64字符串（与OpenAI一致）
+func encodeEmbeddingBase64(vec []float64) string {
+	buf := make([]byte, 4*len(vec))
+	for i, x := range vec {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(float32(x)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// 调用Embedding上游处理一个批次，返回与inputs顺序一致的向量和token用量
+func callEmbeddingUpstream(ctx context.Context, upstream *EmbeddingUpstream, model string, inputs []interface{}) ([][]float64, int, error) {
+	payloadBytes, err := json.Marshal(map[string]interface{}{
+		"model":           model,
+		"input":           inputs,
+		"encoding_format": "float",
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("序列化Embedding请求失败: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.URL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, 0, fmt.Errorf("构建Embedding请求失败: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if upstream.UseToken {
+		token, err := getToken(ctx)
+		if err != nil {
+			return nil, 0, &proxyError{http.StatusInternalServerError, "token_error", fmt.Sprintf("获取Token失败: %s", err)}
+		}
+		setTargetHeaders(req, token)
+	}
+	if upstream.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+upstream.APIKey)
+	}
+
+	resp, err := embeddingClient.Do(req)
+	auditUpstream(ctx, upstream.Name, upstream.URL, 1, req, payloadBytes, resp, err)
+	if err != nil {
+		return nil, 0, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("请求Embedding上游%s失败: %s", upstream.Name, err)}
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("读取Embedding响应失败: %s", err)}
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, 0, &proxyError{resp.StatusCode, "downstream_error", fmt.Sprintf("Embedding上游%s返回错误（状态码：%d）: %s", upstream.Name, resp.StatusCode, redactSecrets(string(respBody)))}
+	}
+
+	var upstreamResp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(respBody, &upstreamResp); err != nil {
+		return nil, 0, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("解析Embedding响应失败: %s", err)}
+	}
+
+	// 按index重组，保证与输入顺序一致
+	vectors := make([][]float64, len(inputs))
+	for _, d := range upstreamResp.Data {
+		if d.Index < 0 || d.Index >= len(inputs) {
+			return nil, 0, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("Embedding响应index越界: %d", d.Index)}
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	for i, vec := range vectors {
+		if vec == nil {
+			return nil, 0, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("Embedding响应缺少第%d条结果", i)}
+		}
+	}
+	return vectors, upstreamResp.Usage.PromptTokens, nil
+}
+
+// 获取一组输入的向量：优先读缓存，未命中部分按批次并发请求上游
+// 返回与inputs顺序一致的完整向量、上游token用量和缓存命中数
+func getEmbeddings(ctx context.Context, upstream *EmbeddingUpstream, model string, inputs []interface{}) ([][]float64, int, int, error) {
+	vectors := make([][]float64, len(inputs))
+	keys := make([]string, len(inputs))
+	var missing []int
+	firstIndex := make(map[string]int, len(inputs)) // 同一请求内重复的输入只请求一次
+	duplicates := make(map[int]int)
+	for i, input := range inputs {
+		keys[i] = embeddingCacheKey(upstream.Name, model, input)
+		if vec, ok := embeddingCache.Get(keys[i]); ok {
+			vectors[i] = vec
+		} else if j, ok := firstIndex[keys[i]]; ok {
+			duplicates[i] = j
+		} else {
+			firstIndex[keys[i]] = i
+			missing = append(missing, i)
+		}
+	}
+	cacheHits := len(inputs) - len(missing) - len(duplicates)
+
+	// 未命中的输入按上游批次大小切分
+	var batches [][]int
+	for start := 0; start < len(missing); start += upstream.BatchSize {
+		end := start + upstream.BatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		batches = append(batches, missing[start:end])
+	}
+
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		totalTokens int
+		firstErr    error
+		sem         = make(chan struct{}, embeddingConcurrent)
+	)
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch []int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			batchInputs := make([]interface{}, len(batch))
+			for j, idx := range batch {
+				batchInputs[j] = inputs[idx]
+			}
+			batchVectors, tokens, err := callEmbeddingUpstream(ctx, upstream, model, batchInputs)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			totalTokens += tokens
+			for j, idx := range batch {
+				vectors[idx] = batchVectors[j]
+				embeddingCache.Set(keys[idx], batchVectors[j])
+			}
+		}(batch)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, 0, 0, firstErr
+	}
+	for i, j := range duplicates {
+		vectors[i] = vectors[j]
+	}
+	return vectors, totalTokens, cacheHits, nil
+}
+
+// Embeddings接口（/v1/embeddings）：按模型路由到Embedding上游，自动分批、缓存
+func embeddingsHandler(c *gin.Context) {
+	// 1. 读取请求
+	var embeddingRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&embeddingRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("解析请求体失败: %s", err),
+				"type":    "invalid_request_error",
+			},
+		})
+		return
+	}
+
+	// 2. 校验参数
+	model := stringValue(embeddingRequest["model"])
+	upstream := findEmbeddingUpstream(model)
+	if upstream == nil {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "model_not_found", fmt.Sprintf("未配置模型%s的Embedding上游", model)})
+		return
+	}
+	inputs, err := parseEmbeddingInputs(embeddingRequest["input"])
+	if err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", err.Error()})
+		return
+	}
+	encodingFormat := stringValue(embeddingRequest["encoding_format"])
+	if encodingFormat == "" {
+		encodingFormat = "float"
+	}
+	if encodingFormat != "float" && encodingFormat != "base64" {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("不支持的encoding_format: %s", encodingFormat)})
+		return
+	}
+	dimensions := intValue(embeddingRequest["dimensions"])
+
+	// 3. 获取向量
+	vectors, tokens, cacheHits, err := getEmbeddings(c.Request.Context(), upstream, model, inputs)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+
+	// 4. 按请求的维度和编码格式组装响应
+	embeddingResp := EmbeddingResponse{Object: "list", Model: model}
+	for i, vec := range vectors {
+		vec = truncateEmbedding(vec, dimensions)
+		var embedding interface{} = vec
+		if encodingFormat == "base64" {
+			embedding = encodeEmbeddingBase64(vec)
+		}
+		embeddingResp.Data = append(embeddingResp.Data, EmbeddingData{Object: "embedding", Index: i, Embedding: embedding})
+	}
+	embeddingResp.Usage.PromptTokens = tokens
+	embeddingResp.Usage.TotalTokens = tokens
+
+	c.Header("X-Embedding-Upstream", upstream.Name)
+	c.Header("X-Embedding-Cache-Hits", strconv.Itoa(cacheHits))
+	c.JSON(http.StatusOK, embeddingResp)
+}
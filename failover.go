@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 路由配置（ROUTES，JSON数组）：模型→主上游及有序的故障转移链
+type Route struct {
+	Model      string        `json:"model"`       // 对外模型名，"*"匹配任意模型
+	Upstream   string        `json:"upstream"`    // 主上游名称，默认为default上游
+	Target     string        `json:"target"`      // 转发给上游时使用的模型名，默认与model相同
+	Fallbacks  []RouteTarget `json:"fallbacks"`   // 按顺序尝试的备用上游/模型
+	FallbackOn []string      `json:"fallback_on"` // 触发故障转移的错误：5xx、429、timeout、connection_error、context_length_exceeded或具体状态码
+	Hedge      *HedgePolicy  `json:"hedge"`       // 对冲请求策略，未配置时不对冲
+}
+
+// 故障转移目标：另一个上游上的同一模型，或另一个模型
+type RouteTarget struct {
+	Upstream string `json:"upstream"`
+	Model    string `json:"model"`
+}
+
+var routes []*Route
+
+// 默认触发故障转移的错误
+var defaultFallbackOn = []string{"5xx", "429", "timeout", "connection_error"}
+
+// 初始化路由配置，并把路由中的模型加入模型列表
+func initRoutes() {
+	routes = nil
+	if _, err := loadJSONEnv("ROUTES", &routes); err != nil {
+		slog.Error("ROUTES配置错误，已忽略", "error", err)
+		routes = nil
+	}
+	for _, route := range routes {
+		if route.FallbackOn == nil {
+			route.FallbackOn = defaultFallbackOn
+		}
+		if route.Hedge != nil {
+			route.Hedge.applyDefaults()
+		}
+		targets := append([]RouteTarget{{Upstream: route.Upstream}}, route.Fallbacks...)
+		for _, t := range targets {
+			if t.Upstream != "" && findUpstream(t.Upstream) == nil {
+				slog.Warn("路由引用了不存在的上游", "route", route.Model, "upstream", t.Upstream)
+			}
+		}
+		if route.Model != "*" && !containsString(config.Models, route.Model) {
+			config.Models = append(config.Models, route.Model)
+		}
+		slog.Info("路由", "route", route.Model, "upstream", route.Upstream, "fallbacks", len(route.Fallbacks), "hedge", route.Hedge != nil)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 按模型名查找路由，精确匹配优先于"*"
+func findRoute(model string) *Route {
+	var wildcard *Route
+	for _, route := range routes {
+		if route.Model == model {
+			return route
+		}
+		if route.Model == "*" && wildcard == nil {
+			wildcard = route
+		}
+	}
+	return wildcard
+}
+
+// 路由目标解析后的上游和模型
+type resolvedTarget struct {
+	Upstream *Upstream
+	Model    string
+}
+
+// 返回按顺序尝试的上游和模型（第一个为主目标）
+func (r *Route) resolve(model string) []resolvedTarget {
+	primary := resolvedTarget{Upstream: defaultUpstream(), Model: model}
+	if r == nil {
+		return []resolvedTarget{primary}
+	}
+	if u := findUpstream(r.Upstream); u != nil {
+		primary.Upstream = u
+	}
+	if r.Target != "" {
+		primary.Model = r.Target
+	}
+	targets := []resolvedTarget{primary}
+	for _, fb := range r.Fallbacks {
+		target := resolvedTarget{Upstream: primary.Upstream, Model: primary.Model}
+		if fb.Upstream != "" {
+			if target.Upstream = findUpstream(fb.Upstream); target.Upstream == nil {
+				continue
+			}
+		}
+		if fb.Model != "" {
+			target.Model = fb.Model
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// 路由的对冲策略（未配置时为nil）
+func (r *Route) hedgePolicy() *HedgePolicy {
+	if r == nil {
+		return nil
+	}
+	return r.Hedge
+}
+
+// 判断结果是否触发故障转移，返回触发原因（空串表示不触发）
+// 需要检查响应体时会读取并还原resp.Body
+func (r *Route) failoverReason(resp *http.Response, err error) string {
+	if r == nil {
+		return ""
+	}
+	var reasons []string
+	if err != nil {
+		if _, ok := err.(*proxyError); ok {
+			// Token获取失败等网关自身错误，换上游无意义
+			return ""
+		}
+		if classifyNetworkError(err) == "timeout" {
+			reasons = append(reasons, "timeout")
+		} else {
+			reasons = append(reasons, "connection_error")
+		}
+	} else {
+		if resp.StatusCode < http.StatusBadRequest {
+			return ""
+		}
+		reasons = append(reasons, strconv.Itoa(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			reasons = append(reasons, "5xx")
+		}
+		if resp.StatusCode < http.StatusInternalServerError && containsString(r.FallbackOn, "context_length_exceeded") {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			if strings.Contains(string(body), "context_length_exceeded") {
+				reasons = append(reasons, "context_length_exceeded")
+			}
+		}
+	}
+	for _, reason := range reasons {
+		if containsString(r.FallbackOn, reason) {
+			return reason
+		}
+	}
+	return ""
+}
+
+// 按路由依次尝试主目标和备用目标，返回第一个未触发故障转移的结果
+// 返回的错误为原始网络错误或*proxyError
+func forwardWithFailover(ctx context.Context, openaiRequest map[string]interface{}) (*http.Response, error) {
+	model := stringValue(openaiRequest["model"])
+	recordRequestedModel(ctx, model)
+	route := findRoute(model)
+	targets := route.resolve(model)
+
+	for i, target := range targets {
+		request := openaiRequest
+		if target.Model != model {
+			request = make(map[string]interface{}, len(openaiRequest))
+			for k, v := range openaiRequest {
+				request[k] = v
+			}
+			request["model"] = target.Model
+		}
+
+		resp, err := forwardToUpstream(ctx, target.Upstream, request, route)
+		reason := route.failoverReason(resp, err)
+		if reason == "" || i == len(targets)-1 || ctx.Err() != nil {
+			recordServedBy(ctx, target.Upstream.Name, target.Model)
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		next := targets[i+1]
+		logger(ctx).Warn("故障转移", "model", target.Model, "upstream", target.Upstream.Name, "reason", reason, "to_upstream", next.Upstream.Name, "to_model", next.Model)
+		recordFailover(ctx, fmt.Sprintf("%s/%s;reason=%s", target.Upstream.Name, target.Model, reason))
+		metricFailovers.add(1, route.Model, target.Upstream.Name, next.Upstream.Name, reason)
+	}
+	return nil, fmt.Errorf("没有可用的上游")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardWithFailover(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallbackOn   string
+		primary      http.HandlerFunc // 模型m在primary上的响应，nil表示连接失败
+		status       int
+		wantUpstream string
+		wantModel    string
+		wantFailover string
+	}{
+		{
+			name:         "5xx转移到备用上游",
+			primary:      func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			status:       http.StatusOK,
+			wantUpstream: "backup",
+			wantModel:    "m",
+			wantFailover: "primary/m;reason=5xx",
+		},
+		{
+			name:         "连接失败转移到备用上游",
+			status:       http.StatusOK,
+			wantUpstream: "backup",
+			wantModel:    "m",
+			wantFailover: "primary/m;reason=connection_error",
+		},
+		{
+			name:         "4xx不触发故障转移",
+			primary:      func(w http.ResponseWriter, r *http.Request) { http.Error(w, `{"error":"bad"}`, http.StatusBadRequest) },
+			status:       http.StatusBadRequest,
+			wantUpstream: "primary",
+			wantModel:    "m",
+		},
+		{
+			name:       "上下文超长转移到备用模型",
+			fallbackOn: `,"fallback_on":["context_length_exceeded"]`,
+			primary: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"error":{"code":"context_length_exceeded"}}`, http.StatusBadRequest)
+			},
+			status:       http.StatusOK,
+			wantUpstream: "primary",
+			wantModel:    "m-long",
+			wantFailover: "primary/m;reason=context_length_exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestBackend(t, echoTarget)
+			backup := httptest.NewServer(http.HandlerFunc(echoTarget))
+			defer backup.Close()
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req := readTargetRequest(r)
+				if req["model"] == "m" {
+					tt.primary(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"content": "long:" + stringValue(req["model"]), "finish_reason": "stop"})
+			}))
+			defer primary.Close()
+			if tt.primary == nil {
+				primary.Close()
+			}
+
+			t.Setenv("UPSTREAMS", fmt.Sprintf(`[{"name":"primary","url":%q,"retry":{"max_attempts":1}},{"name":"backup","url":%q,"retry":{"max_attempts":1}}]`, primary.URL, backup.URL))
+			fallbacks := `[{"upstream":"backup"}]`
+			if tt.fallbackOn != "" {
+				fallbacks = `[{"model":"m-long"}]`
+			}
+			t.Setenv("ROUTES", `[{"model":"m","upstream":"primary","fallbacks":`+fallbacks+tt.fallbackOn+`}]`)
+			initGateway()
+
+			w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("X-Gateway-Upstream"); got != tt.wantUpstream {
+				t.Fatalf("X-Gateway-Upstream = %q, want %q", got, tt.wantUpstream)
+			}
+			if got := w.Header().Get("X-Gateway-Model"); got != tt.wantModel {
+				t.Fatalf("X-Gateway-Model = %q, want %q", got, tt.wantModel)
+			}
+			if got := w.Header().Get("X-Gateway-Failover"); got != tt.wantFailover {
+				t.Fatalf("X-Gateway-Failover = %q, want %q", got, tt.wantFailover)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), `"model":"`+tt.wantModel+`"`) {
+				t.Fatalf("响应中的model应为实际处理的模型: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	old := routes
+	t.Cleanup(func() { routes = old })
+	routes = []*Route{{Model: "*", Upstream: "any"}, {Model: "m", Upstream: "exact"}}
+	tests := []struct{ model, want string }{
+		{"m", "exact"},
+		{"other", "any"},
+	}
+	for _, tt := range tests {
+		if got := findRoute(tt.model); got == nil || got.Upstream != tt.want {
+			t.Fatalf("findRoute(%q) = %+v, want upstream %s", tt.model, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI兼容的File对象
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+// 本地文件存储：内容保存为<id>.data，元数据保存为<id>.json
+type fileStore struct {
+	mu    sync.Mutex
+	dir   string
+	files map[string]*FileObject
+}
+
+var files *fileStore
+
+// 初始化文件存储并加载已有文件
+func initFileStore(dataDir string) error {
+	dir := filepath.Join(dataDir, "files")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("创建文件目录失败: %s", err)
+	}
+	files = &fileStore{dir: dir, files: make(map[string]*FileObject)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("读取文件目录失败: %s", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var file FileObject
+		if err := json.Unmarshal(data, &file); err != nil {
+			slog.Warn("忽略损坏的文件元数据", "file", entry.Name(), "error", err)
+			continue
+		}
+		files.files[file.ID] = &file
+	}
+	return nil
+}
+
+// 文件内容路径
+func (s *fileStore) contentPath(id string) string {
+	return filepath.Join(s.dir, id+".data")
+}
+
+// 保存文件内容和元数据
+func (s *fileStore) Create(filename, purpose string, content io.Reader) (*FileObject, error) {
+	file := &FileObject{
+		ID:        newObjectID("file-"),
+		Object:    "file",
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+	out, err := os.Create(s.contentPath(file.ID))
+	if err != nil {
+		return nil, fmt.Errorf("创建文件失败: %s", err)
+	}
+	n, err := io.Copy(out, content)
+	out.Close()
+	if err != nil {
+		os.Remove(s.contentPath(file.ID))
+		return nil, fmt.Errorf("写入文件失败: %s", err)
+	}
+	file.Bytes = n
+	if err := s.register(file); err != nil {
+		os.Remove(s.contentPath(file.ID))
+		return nil, err
+	}
+	return file, nil
+}
+
+// 将已存在的本地文件移动到存储中并登记为File对象
+func (s *fileStore) Import(path, filename, purpose string) (*FileObject, error) {
+	file := &FileObject{
+		ID:        newObjectID("file-"),
+		Object:    "file",
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件信息失败: %s", err)
+	}
+	file.Bytes = info.Size()
+	if err := os.Rename(path, s.contentPath(file.ID)); err != nil {
+		return nil, fmt.Errorf("移动文件失败: %s", err)
+	}
+	if err := s.register(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// 写入元数据并加入索引
+func (s *fileStore) register(file *FileObject) error {
+	data, _ := json.Marshal(file)
+	if err := writeFileAtomic(filepath.Join(s.dir, file.ID+".json"), data); err != nil {
+		return fmt.Errorf("保存文件元数据失败: %s", err)
+	}
+	s.mu.Lock()
+	s.files[file.ID] = file
+	s.mu.Unlock()
+	return nil
+}
+
+// 查询文件
+func (s *fileStore) Get(id string) (*FileObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	return file, ok
+}
+
+// 按创建时间倒序列出文件，purpose为空表示全部
+func (s *fileStore) List(purpose string) []*FileObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*FileObject, 0, len(s.files))
+	for _, file := range s.files {
+		if purpose == "" || file.Purpose == purpose {
+			list = append(list, file)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return list
+}
+
+// 删除文件
+func (s *fileStore) Delete(id string) bool {
+	s.mu.Lock()
+	_, ok := s.files[id]
+	delete(s.files, id)
+	s.mu.Unlock()
+	if ok {
+		os.Remove(s.contentPath(id))
+		os.Remove(filepath.Join(s.dir, id+".json"))
+	}
+	return ok
+}
+
+// 先写临时文件再重命名，避免进程中断导致文件损坏
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 上传文件（POST /v1/files，multipart表单：file、purpose）
+func uploadFileHandler(c *gin.Context) {
+	purpose := c.PostForm("purpose")
+	if purpose == "" {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", "缺少purpose参数"})
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("读取上传文件失败: %s", err)})
+		return
+	}
+	content, err := header.Open()
+	if err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("读取上传文件失败: %s", err)})
+		return
+	}
+	defer content.Close()
+
+	file, err := files.Create(header.Filename, purpose, content)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// 列出文件（GET /v1/files）
+func listFilesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": files.List(c.Query("purpose"))})
+}
+
+// 查询文件（GET /v1/files/:id）
+func getFileHandler(c *gin.Context) {
+	file, ok := files.Get(c.Param("id"))
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到文件: %s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+// 下载文件内容（GET /v1/files/:id/content）
+func getFileContentHandler(c *gin.Context) {
+	file, ok := files.Get(c.Param("id"))
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到文件: %s", c.Param("id"))})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+	c.File(files.contentPath(file.ID))
+}
+
+// 删除文件（DELETE /v1/files/:id）
+func deleteFileHandler(c *gin.Context) {
+	id := c.Param("id")
+	if !files.Delete(id) {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到文件: %s", id)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
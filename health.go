@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// 主动健康检查配置：按间隔探测每个副本
+type HealthCheckConfig struct {
+	Interval           Duration        `json:"interval"`            // 探测间隔，0表示不做主动探测
+	Timeout            Duration        `json:"timeout"`             // 单次探测超时，默认5s
+	Path               string          `json:"path"`                // 探测路径（替换副本URL的路径），为空时探测副本URL本身
+	Method             string          `json:"method"`              // 默认GET，配置request时默认POST
+	Request            json.RawMessage `json:"request"`             // 探测请求体（带Token发送，如最小的chat请求）
+	ExpectedStatus     []int           `json:"expected_status"`     // 视为健康的状态码，默认2xx
+	HealthyThreshold   int             `json:"healthy_threshold"`   // 连续成功多少次恢复健康，默认2
+	UnhealthyThreshold int             `json:"unhealthy_threshold"` // 连续失败多少次标记不健康，默认3
+}
+
+// 熔断器配置：按真实流量的错误情况摘除副本
+type BreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"` // 连续失败多少次熔断，默认5
+	ErrorRate           float64  `json:"error_rate"`           // 窗口内错误率达到该值熔断，默认0.5
+	MinRequests         int      `json:"min_requests"`         // 计算错误率的最少请求数，默认20
+	Window              Duration `json:"window"`               // 错误率统计窗口，默认30s
+	OpenDuration        Duration `json:"open_duration"`        // 熔断持续时间，默认30s
+	HalfOpenRequests    int      `json:"half_open_requests"`   // 半开状态允许的试探请求数，默认1
+}
+
+func (h *HealthCheckConfig) applyDefaults() {
+	if h.Timeout <= 0 {
+		h.Timeout = Duration(5 * time.Second)
+	}
+	if h.Method == "" {
+		h.Method = http.MethodGet
+		if len(h.Request) > 0 {
+			h.Method = http.MethodPost
+		}
+	}
+	if h.HealthyThreshold <= 0 {
+		h.HealthyThreshold = 2
+	}
+	if h.UnhealthyThreshold <= 0 {
+		h.UnhealthyThreshold = 3
+	}
+}
+
+func (b *BreakerConfig) applyDefaults() {
+	if b.ConsecutiveFailures <= 0 {
+		b.ConsecutiveFailures = 5
+	}
+	if b.ErrorRate <= 0 {
+		b.ErrorRate = 0.5
+	}
+	if b.MinRequests <= 0 {
+		b.MinRequests = 20
+	}
+	if b.Window <= 0 {
+		b.Window = Duration(30 * time.Second)
+	}
+	if b.OpenDuration <= 0 {
+		b.OpenDuration = Duration(30 * time.Second)
+	}
+	if b.HalfOpenRequests <= 0 {
+		b.HalfOpenRequests = 1
+	}
+}
+
+// 副本的健康状态和熔断器
+type endpointHealth struct {
+	mu sync.Mutex
+	cb *BreakerConfig
+
+	// 主动探测
+	healthy     bool
+	probeOK     int // 连续探测成功次数
+	probeFailed int // 连续探测失败次数
+	lastProbe   time.Time
+	lastError   string
+
+	// 熔断器
+	state       string
+	openedAt    time.Time
+	halfOpenUse int // 半开状态已放行的试探请求数
+	consecutive int // 连续失败次数
+	windowStart time.Time
+	windowTotal int
+	windowFail  int
+}
+
+func newEndpointHealth(cb *BreakerConfig) *endpointHealth {
+	return &endpointHealth{cb: cb, healthy: true, state: breakerClosed, windowStart: time.Now()}
+}
+
+// 副本当前是否可以接收请求（不改变状态）
+func (h *endpointHealth) available() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.healthy {
+		return false
+	}
+	switch h.state {
+	case breakerOpen:
+		return time.Since(h.openedAt) >= time.Duration(h.cb.OpenDuration)
+	case breakerHalfOpen:
+		return h.halfOpenUse < h.cb.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// 副本被选中发送请求时占用名额：可用性判断和占用试探名额在同一次加锁内完成，
+// 熔断时间已过则进入半开状态；并发请求不会越过HalfOpenRequests限制，不可用时返回false
+func (h *endpointHealth) tryAcquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.healthy {
+		return false
+	}
+	switch h.state {
+	case breakerOpen:
+		if time.Since(h.openedAt) < time.Duration(h.cb.OpenDuration) {
+			return false
+		}
+		h.state = breakerHalfOpen
+		h.halfOpenUse = 1
+		return true
+	case breakerHalfOpen:
+		if h.halfOpenUse >= h.cb.HalfOpenRequests {
+			return false
+		}
+		h.halfOpenUse++
+		return true
+	default:
+		return true
+	}
+}
+
+// 归还tryAcquire占用的试探名额：请求被取消、结果不计入熔断统计时调用，避免半开状态的名额被永久占用
+func (h *endpointHealth) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == breakerHalfOpen && h.halfOpenUse > 0 {
+		h.halfOpenUse--
+	}
+}
+
+// 记录一次真实请求的结果（被动异常检测），返回熔断器状态是否变化
+func (h *endpointHealth) record(success bool) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	before := h.state
+
+	now := time.Now()
+	if now.Sub(h.windowStart) > time.Duration(h.cb.Window) {
+		h.windowStart, h.windowTotal, h.windowFail = now, 0, 0
+	}
+	h.windowTotal++
+	if success {
+		h.consecutive = 0
+	} else {
+		h.consecutive++
+		h.windowFail++
+	}
+
+	switch h.state {
+	case breakerHalfOpen:
+		if success {
+			h.state = breakerClosed
+			h.windowStart, h.windowTotal, h.windowFail = now, 0, 0
+		} else {
+			h.state, h.openedAt = breakerOpen, now
+		}
+	case breakerClosed:
+		tooManyFailures := h.consecutive >= h.cb.ConsecutiveFailures
+		highErrorRate := h.windowTotal >= h.cb.MinRequests && float64(h.windowFail)/float64(h.windowTotal) >= h.cb.ErrorRate
+		if tooManyFailures || highErrorRate {
+			h.state, h.openedAt = breakerOpen, now
+		}
+	}
+	return h.state, h.state != before
+}
+
+// 记录一次主动探测结果，返回健康状态是否变化
+func (h *endpointHealth) recordProbe(hc *HealthCheckConfig, err error) (bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	before := h.healthy
+	h.lastProbe = time.Now()
+	if err == nil {
+		h.lastError = ""
+		h.probeOK++
+		h.probeFailed = 0
+		if !h.healthy && h.probeOK >= hc.HealthyThreshold {
+			h.healthy = true
+		}
+	} else {
+		h.lastError = err.Error()
+		h.probeFailed++
+		h.probeOK = 0
+		if h.healthy && h.probeFailed >= hc.UnhealthyThreshold {
+			h.healthy = false
+		}
+	}
+	return h.healthy, h.healthy != before
+}
+
+// 健康状态快照（用于管理接口）
+type endpointHealthStatus struct {
+	URL         string  `json:"url"`
+	Weight      int     `json:"weight"`
+	Available   bool    `json:"available"`
+	Healthy     bool    `json:"healthy"`
+	Breaker     string  `json:"breaker"`
+	Outstanding int64   `json:"outstanding"`
+	LatencyEWMA float64 `json:"latency_ewma_ms"`
+	TTFTEWMA    float64 `json:"ttft_ewma_ms"`
+	Consecutive int     `json:"consecutive_failures"`
+	WindowTotal int     `json:"window_requests"`
+	WindowFail  int     `json:"window_failures"`
+	LastProbe   string  `json:"last_probe,omitempty"`
+	LastError   string  `json:"last_error,omitempty"`
+}
+
+func (e *Endpoint) status() endpointHealthStatus {
+	available := e.health.available()
+	e.health.mu.Lock()
+	s := endpointHealthStatus{
+		URL:         e.URL,
+		Weight:      e.Weight,
+		Available:   available,
+		Healthy:     e.health.healthy,
+		Breaker:     e.health.state,
+		Consecutive: e.health.consecutive,
+		WindowTotal: e.health.windowTotal,
+		WindowFail:  e.health.windowFail,
+		LastError:   e.health.lastError,
+	}
+	if !e.health.lastProbe.IsZero() {
+		s.LastProbe = e.health.lastProbe.Format(time.RFC3339)
+	}
+	e.health.mu.Unlock()
+	s.Outstanding = e.inFlight()
+	e.mu.Lock()
+	s.LatencyEWMA, s.TTFTEWMA = e.latencyEWMA, e.ttftEWMA
+	e.mu.Unlock()
+	return s
+}
+
+// 上游是否至少有一个可用副本
+func (u *Upstream) healthy() bool {
+	for _, e := range u.Endpoints {
+		if e.health.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// 记录真实请求结果：网络错误和5xx计为失败，客户端取消的请求不计（归还其试探名额）
+func recordEndpointResult(ctx context.Context, upstream *Upstream, endpoint *Endpoint, resp *http.Response, err error) {
+	if err != nil && ctx.Err() != nil {
+		endpoint.health.release()
+		return
+	}
+	success := err == nil && resp.StatusCode < http.StatusInternalServerError
+	if state, changed := endpoint.health.record(success); changed {
+		slog.Warn("熔断器状态变化", "upstream", upstream.Name, "endpoint", endpoint.URL, "state", state)
+	}
+}
+
+// 计算探测URL：配置了path时替换副本URL的路径和查询参数
+func probeURL(endpointURL, path string) string {
+	if path == "" {
+		return endpointURL
+	}
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return endpointURL
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return endpointURL
+	}
+	u.Path, u.RawQuery = ref.Path, ref.RawQuery
+	return u.String()
+}
+
+// 对副本做一次主动探测
+func probeEndpoint(ctx context.Context, hc *HealthCheckConfig, endpoint *Endpoint) error {
+	ctx, cancel := context.WithTimeout(withoutRecording(ctx), time.Duration(hc.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, hc.Method, probeURL(endpoint.URL, hc.Path), bytes.NewReader(hc.Request))
+	if err != nil {
+		return err
+	}
+	if len(hc.Request) > 0 {
+		token, err := getToken(ctx)
+		if err != nil {
+			return fmt.Errorf("获取Token失败: %s", err)
+		}
+		setTargetHeaders(req, token)
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if len(hc.ExpectedStatus) > 0 {
+		for _, status := range hc.ExpectedStatus {
+			if status == resp.StatusCode {
+				return nil
+			}
+		}
+	} else if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("探测返回状态码%d", resp.StatusCode)
+}
+
+// 启动所有配置了主动探测的上游的健康检查协程
+func startHealthChecks(ctx context.Context) {
+	if recording.mode == recordModeReplay {
+		slog.Info("回放模式下不做主动健康探测")
+		return
+	}
+	for _, upstream := range upstreams {
+		if upstream.HealthCheck == nil || upstream.HealthCheck.Interval <= 0 {
+			continue
+		}
+		for _, endpoint := range upstream.Endpoints {
+			go runHealthCheck(ctx, upstream, endpoint)
+		}
+	}
+}
+
+func runHealthCheck(ctx context.Context, upstream *Upstream, endpoint *Endpoint) {
+	hc := upstream.HealthCheck
+	ticker := time.NewTicker(time.Duration(hc.Interval))
+	defer ticker.Stop()
+	for {
+		err := probeEndpoint(ctx, hc, endpoint)
+		if ctx.Err() != nil {
+			return
+		}
+		if healthy, changed := endpoint.health.recordProbe(hc, err); changed {
+			if healthy {
+				slog.Info("上游副本恢复健康", "upstream", upstream.Name, "endpoint", endpoint.URL)
+			} else {
+				slog.Warn("上游副本探测失败，已摘除", "upstream", upstream.Name, "endpoint", endpoint.URL, "error", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 上游健康状态管理接口（GET /admin/upstreams）
+func upstreamHealthHandler(c *gin.Context) {
+	result := make([]gin.H, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		endpoints := make([]endpointHealthStatus, 0, len(upstream.Endpoints))
+		for _, endpoint := range upstream.Endpoints {
+			endpoints = append(endpoints, endpoint.status())
+		}
+		result = append(result, gin.H{
+			"name":      upstream.Name,
+			"balancer":  upstream.Balancer,
+			"healthy":   upstream.healthy(),
+			"endpoints": endpoints,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": result})
+}
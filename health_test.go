@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testBreakerConfig() *BreakerConfig {
+	cb := &BreakerConfig{ConsecutiveFailures: 3, MinRequests: 4, ErrorRate: 0.5, OpenDuration: Duration(time.Hour)}
+	cb.applyDefaults()
+	return cb
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool // 依次记录的请求结果
+		want    string
+	}{
+		{"成功保持关闭", []bool{true, true, true}, breakerClosed},
+		{"连续失败未达阈值", []bool{true, true, true, false, false, true, true, false, false}, breakerClosed},
+		{"连续失败熔断", []bool{true, false, false, false}, breakerOpen},
+		{"错误率熔断", []bool{false, true, false, true}, breakerOpen},
+		{"请求数不足不按错误率熔断", []bool{false, true, false}, breakerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newEndpointHealth(testBreakerConfig())
+			for _, success := range tt.results {
+				h.record(success)
+			}
+			if h.state != tt.want {
+				t.Fatalf("state = %s, want %s", h.state, tt.want)
+			}
+			if got := h.available(); got != (tt.want == breakerClosed) {
+				t.Fatalf("available = %v", got)
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		success bool
+		want    string
+	}{
+		{"试探成功恢复", true, breakerClosed},
+		{"试探失败重新熔断", false, breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newEndpointHealth(testBreakerConfig())
+			h.state, h.openedAt = breakerOpen, time.Now().Add(-2*time.Hour)
+			if !h.available() {
+				t.Fatal("熔断时间已过，应可以试探")
+			}
+			if !h.tryAcquire() {
+				t.Fatal("熔断时间已过，应占用试探名额")
+			}
+			if h.state != breakerHalfOpen {
+				t.Fatalf("state = %s, want half_open", h.state)
+			}
+			if h.available() {
+				t.Fatal("试探名额已用完，不应再放行")
+			}
+			if state, changed := h.record(tt.success); state != tt.want || !changed {
+				t.Fatalf("record = %s, %v", state, changed)
+			}
+		})
+	}
+}
+
+func TestBreakerReleaseOnCancel(t *testing.T) {
+	h := newEndpointHealth(testBreakerConfig())
+	h.state, h.openedAt = breakerOpen, time.Now().Add(-2*time.Hour)
+	endpoint := &Endpoint{URL: "http://a", Weight: 1, health: h}
+	h.tryAcquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recordEndpointResult(ctx, &Upstream{Name: "u"}, endpoint, nil, errors.New("canceled"))
+	if h.state != breakerHalfOpen || !h.available() {
+		t.Fatalf("被取消的试探请求应归还名额：state=%s use=%d", h.state, h.halfOpenUse)
+	}
+}
+
+func TestBreakerHalfOpenConcurrentPick(t *testing.T) {
+	// 熔断时间已过的副本只有HalfOpenRequests个试探名额，并发pick不能超出
+	endpoints := testEndpoints(1)
+	endpoints[0].health.state, endpoints[0].health.openedAt = breakerOpen, time.Now().Add(-2*time.Hour)
+	b := &balancer{strategy: balanceRoundRobin, endpoints: endpoints}
+
+	var picked int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.pick("", false, nil) != nil {
+				atomic.AddInt64(&picked, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if want := int64(endpoints[0].health.cb.HalfOpenRequests); picked != want {
+		t.Fatalf("picked = %d, want %d", picked, want)
+	}
+}
+
+func TestRecordProbe(t *testing.T) {
+	hc := &HealthCheckConfig{}
+	hc.applyDefaults()
+	h := newEndpointHealth(testBreakerConfig())
+	probeErr := errors.New("down")
+
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{probeErr, true},
+		{probeErr, true},
+		{probeErr, false}, // 连续3次失败
+		{nil, false},
+		{nil, true}, // 连续2次成功
+	}
+	for i, step := range steps {
+		if healthy, _ := h.recordProbe(hc, step.err); healthy != step.healthy {
+			t.Fatalf("step %d: healthy = %v, want %v", i, healthy, step.healthy)
+		}
+	}
+}
+
+func TestUpstreamAdminAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		header     map[string]string
+		status     int
+	}{
+		{"未配置ADMIN_TOKEN", "", map[string]string{"Authorization": "Bearer x"}, http.StatusForbidden},
+		{"未携带Token", "secret", nil, http.StatusUnauthorized},
+		{"Token错误", "secret", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"Token正确", "secret", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.adminToken)
+			startTestBackend(t, echoTarget)
+			w := serveRequest(newRouter(), http.MethodGet, "/admin/upstreams", "", tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 对冲请求策略（路由的hedge字段）：主请求在延迟内没有收到首字节时，向同一上游的另一个副本发送相同请求，
+// 先返回的成功响应胜出，另一个被取消
+type HedgePolicy struct {
+	Delay       Duration `json:"delay"`        // 固定延迟；配置了percentile时为样本不足时使用的延迟
+	Percentile  float64  `json:"percentile"`   // 按最近首字节延迟的百分位（如95）决定延迟
+	MinDelay    Duration `json:"min_delay"`    // 按百分位计算的延迟下限
+	MinSamples  int      `json:"min_samples"`  // 按百分位计算前所需的最少样本数，默认20
+	MaxFraction float64  `json:"max_fraction"` // 对冲请求最多占请求数的比例，默认0.1
+	Burst       int      `json:"burst"`        // 对冲预算的初始额度，默认10
+
+	budget  *retryBudget
+	mu      sync.Mutex
+	samples [2]*latencyWindow // 非流式（完整响应）和流式（首字节）延迟
+}
+
+// 最近若干次延迟样本（毫秒）
+type latencyWindow struct {
+	values []float64
+	next   int
+}
+
+const hedgeLatencyWindow = 500
+
+// 填充对冲策略默认值
+func (h *HedgePolicy) applyDefaults() {
+	if h.MinSamples <= 0 {
+		h.MinSamples = 20
+	}
+	if h.MaxFraction <= 0 || h.MaxFraction > 1 {
+		h.MaxFraction = 0.1
+	}
+	if h.Burst <= 0 {
+		h.Burst = 10
+	}
+	h.budget = newRetryBudget(h.MaxFraction, h.Burst)
+	h.samples = [2]*latencyWindow{{}, {}}
+}
+
+func hedgeSampleIndex(isStream bool) int {
+	if isStream {
+		return 1
+	}
+	return 0
+}
+
+// 记录一次成功响应的首字节延迟
+func (h *HedgePolicy) observe(d time.Duration, isStream bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := h.samples[hedgeSampleIndex(isStream)]
+	ms := float64(d) / float64(time.Millisecond)
+	if len(w.values) < hedgeLatencyWindow {
+		w.values = append(w.values, ms)
+	} else {
+		w.values[w.next] = ms
+	}
+	w.next = (w.next + 1) % hedgeLatencyWindow
+}
+
+// 本次请求的对冲延迟，<=0表示不对冲
+func (h *HedgePolicy) delay(isStream bool) time.Duration {
+	if h.Percentile <= 0 {
+		return time.Duration(h.Delay)
+	}
+	h.mu.Lock()
+	w := h.samples[hedgeSampleIndex(isStream)]
+	if len(w.values) < h.MinSamples {
+		h.mu.Unlock()
+		return time.Duration(h.Delay)
+	}
+	values := append([]float64(nil), w.values...)
+	h.mu.Unlock()
+
+	sort.Float64s(values)
+	i := int(float64(len(values)-1) * h.Percentile / 100)
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	d := time.Duration(values[i] * float64(time.Millisecond))
+	if d < time.Duration(h.MinDelay) {
+		d = time.Duration(h.MinDelay)
+	}
+	return d
+}
+
+// 一次（主或对冲）尝试的结果
+type hedgeResult struct {
+	resp     *http.Response
+	err      error
+	endpoint *Endpoint
+	index    int // 启动顺序，0为主请求
+	cancel   context.CancelFunc
+	elapsed  time.Duration
+	hedge    bool
+}
+
+// 响应体关闭时取消该尝试的Context
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// 发送一次尝试，必要时对冲：返回胜出的响应和发送它的副本
+// 胜出条件为没有网络错误且状态码小于500；都未胜出时返回最先完成的结果，由调用方按重试策略处理
+func (h *HedgePolicy) send(ctx context.Context, route string, upstream *Upstream, primary *Endpoint, payloadBytes []byte, token, requestID string, attempt int, isStream bool) (*http.Response, *Endpoint, error) {
+	h.budget.deposit()
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	// release为对冲请求占用的并发槽位的释放函数，在响应体关闭或请求失败时调用（主请求的槽位由调用方持有）
+	launch := func(endpoint *Endpoint, hedge bool, release func()) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			resp, err := sendUpstreamAttempt(attemptCtx, upstream, endpoint, payloadBytes, token, requestID, attempt, isStream)
+			// 被取消的一方不计入副本的熔断统计
+			recordEndpointResult(attemptCtx, upstream, endpoint, resp, err)
+			if release != nil {
+				if err != nil {
+					release()
+				} else {
+					resp.Body = &admissionBody{ReadCloser: resp.Body, release: release}
+				}
+			}
+			results <- hedgeResult{resp: resp, err: err, endpoint: endpoint, index: index, cancel: cancel, elapsed: time.Since(start), hedge: hedge}
+		}()
+	}
+
+	launch(primary, false, nil)
+	pending := 1
+	var timer <-chan time.Time
+	if d := h.delay(isStream); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	var first *hedgeResult
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil && r.resp.StatusCode < http.StatusInternalServerError {
+				for i, cancel := range cancels {
+					if i != r.index {
+						cancel()
+					}
+				}
+				// 被取消的一方稍后返回时关闭其响应体
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if loser := <-results; loser.resp != nil {
+							loser.resp.Body.Close()
+						}
+					}
+				}(pending)
+				if first != nil && first.resp != nil {
+					first.resp.Body.Close()
+				}
+				h.observe(r.elapsed, isStream)
+				if len(cancels) > 1 {
+					outcome := "primary_won"
+					if r.hedge {
+						outcome = "hedge_won"
+					}
+					metricHedges.add(1, route, upstream.Name, outcome)
+				}
+				r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: r.cancel}
+				return r.resp, r.endpoint, nil
+			}
+			if first == nil {
+				first = &r
+			} else {
+				if r.resp != nil {
+					r.resp.Body.Close()
+				}
+				r.cancel()
+			}
+		case <-timer:
+			timer = nil
+			// 对冲请求不排队：上游没有空闲并发槽位时放弃对冲
+			release, ok := upstream.admission.tryAcquire()
+			if !ok {
+				metricHedges.add(1, route, upstream.Name, "saturated")
+				continue
+			}
+			if !h.budget.withdraw() {
+				release()
+				metricHedges.add(1, route, upstream.Name, "capped")
+				continue
+			}
+			endpoint := upstream.pool.pickOther(primary)
+			if endpoint == nil {
+				release()
+				metricHedges.add(1, route, upstream.Name, "no_endpoint")
+				continue
+			}
+			logger(ctx).Debug("首字节超时，发送对冲请求", "upstream", upstream.Name, "primary", primary.URL, "hedge", endpoint.URL, "request_id", requestID)
+			launch(endpoint, true, release)
+			pending++
+		}
+	}
+
+	// 没有胜出的响应：返回最先完成的结果
+	if len(cancels) > 1 {
+		metricHedges.add(1, route, upstream.Name, "both_failed")
+	}
+	if first.resp != nil {
+		first.resp.Body = &cancelOnClose{ReadCloser: first.resp.Body, cancel: first.cancel}
+	} else {
+		first.cancel()
+	}
+	return first.resp, first.endpoint, first.err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 计数器某组标签当前的值
+func metricValue(m *metricVec, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// 启动两个副本组成的上游pool（extra为附加的上游配置字段），路由m按hedge配置对冲
+func startHedgeBackend(t *testing.T, hedge, extra string, target http.HandlerFunc) *int64 {
+	t.Helper()
+	var hits int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		target(w, r)
+	})
+	a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+	t.Cleanup(a.Close)
+	t.Cleanup(b.Close)
+	t.Setenv("UPSTREAMS", fmt.Sprintf(`[{"name":"pool","endpoints":[{"url":%q},{"url":%q}],"retry":{"max_attempts":1}%s}]`, a.URL, b.URL, extra))
+	t.Setenv("ROUTES", `[{"model":"m","upstream":"pool","hedge":`+hedge+`}]`)
+	startTestBackend(t, echoTarget)
+	return &hits
+}
+
+func TestHedgeSlowPrimary(t *testing.T) {
+	// 第一个到达的请求（主请求）一直等到被取消，对冲请求立即返回
+	var first int32
+	primaryCanceled := make(chan struct{})
+	hits := startHedgeBackend(t, `{"delay":"20ms"}`, `,"concurrency":{"max_concurrent":2}`, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&first, 0, 1) {
+			io.Copy(io.Discard, r.Body) // 读完请求体后服务端才能感知连接断开
+			select {
+			case <-r.Context().Done():
+				close(primaryCanceled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		echoTarget(w, r)
+	})
+	won := metricValue(metricHedges, "m", "pool", "hedge_won")
+
+	start := time.Now()
+	w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "echo:hi") {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("对冲请求应先返回，耗时%s", elapsed)
+	}
+	if got := atomic.LoadInt64(hits); got != 2 {
+		t.Fatalf("target hits = %d, want 2", got)
+	}
+	if got := metricValue(metricHedges, "m", "pool", "hedge_won") - won; got != 1 {
+		t.Fatalf("hedge_won = %v, want 1", got)
+	}
+	select {
+	case <-primaryCanceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("对冲胜出后主请求应被取消")
+	}
+	// 主请求和对冲请求的并发槽位都已释放
+	if _, active := upstreams[0].admission.depth(); active != 0 {
+		t.Fatalf("active = %d, want 0", active)
+	}
+}
+
+func TestHedgeSaturated(t *testing.T) {
+	// 上游只有一个并发槽位，被主请求占用，对冲请求不排队直接放弃
+	hits := startHedgeBackend(t, `{"delay":"10ms"}`, `,"concurrency":{"max_concurrent":1}`, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		echoTarget(w, r)
+	})
+	saturated := metricValue(metricHedges, "m", "pool", "saturated")
+
+	w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got := atomic.LoadInt64(hits); got != 1 {
+		t.Fatalf("target hits = %d, want 1", got)
+	}
+	if got := metricValue(metricHedges, "m", "pool", "saturated") - saturated; got != 1 {
+		t.Fatalf("saturated = %v, want 1", got)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	// 每个请求都比对冲延迟慢；预算只够一次对冲
+	hits := startHedgeBackend(t, `{"delay":"10ms","burst":1,"max_fraction":0.01}`, "", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		echoTarget(w, r)
+	})
+	capped := metricValue(metricHedges, "m", "pool", "capped")
+
+	router := newRouter()
+	for i := 0; i < 3; i++ {
+		w := serveRequest(router, http.MethodPost, "/chat/completions", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if got := atomic.LoadInt64(hits); got != 4 {
+		t.Fatalf("target hits = %d, want 4（一次对冲）", got)
+	}
+	if got := metricValue(metricHedges, "m", "pool", "capped") - capped; got != 2 {
+		t.Fatalf("capped = %v, want 2", got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 日志中需要整体脱敏的字段名（小写）
+var sensitiveLogKeys = map[string]bool{
+	"authorization":  true,
+	"x-trust-token":  true,
+	"x_trust_token":  true,
+	"x-api-key":      true,
+	"token":          true,
+	"access_token":   true,
+	"jwt":            true,
+	"api_key":        true,
+	"apikey":         true,
+	"password":       true,
+	"secret":         true,
+	"cookie":         true,
+	"set-cookie":     true,
+	"client_secret":  true,
+	"refresh_token":  true,
+	"session_token":  true,
+	"x-session-auth": true,
+}
+
+// 日志文本中需要脱敏的内容
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// JSON中的敏感字段值
+	{regexp.MustCompile(`("(?i:token|access_token|refresh_token|jwt|api_key|apikey|password|secret|client_secret)"\s*:\s*")[^"]*(")`), `${1}[REDACTED]${2}`},
+	// JWT
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), `[REDACTED]`},
+	// Bearer凭证
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), `${1}[REDACTED]`},
+	// sk-开头的API Key
+	{regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`), `[REDACTED]`},
+}
+
+// 脱敏文本中的Token、API Key等凭证
+func redactSecrets(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// 用于错误信息的响应体：脱敏并截断
+func sanitizeBody(body []byte) string {
+	const maxLen = 512
+	s := redactSecrets(string(body))
+	if len(s) > maxLen {
+		s = s[:maxLen] + "...（已截断）"
+	}
+	return s
+}
+
+// 对日志属性脱敏的slog.Handler
+type redactingHandler struct {
+	inner slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redactSecrets(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, redactAttr(a))
+	}
+	return &redactingHandler{inner: h.inner.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{inner: h.inner.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactSecrets(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]any, 0, len(group))
+		for _, ga := range group {
+			redacted = append(redacted, redactAttr(ga))
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		switch value := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, redactSecrets(value.Error()))
+		case http.Header:
+			headers := make([]any, 0, len(value))
+			for k, vs := range value {
+				headers = append(headers, redactAttr(slog.String(k, strings.Join(vs, ","))))
+			}
+			return slog.Group(a.Key, headers...)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// 日志配置
+var logging struct {
+	level             slog.LevelVar
+	successSampleRate float64
+}
+
+// 初始化结构化日志：LOG_LEVEL（debug、info、warn、error）、LOG_FORMAT（json、text）、
+// LOG_SUCCESS_SAMPLE_RATE（成功请求访问日志的采样比例，错误请求总是记录）
+func initLogging(w io.Writer) {
+	switch strings.ToLower(getEnv("LOG_LEVEL", "info")) {
+	case "debug":
+		logging.level.Set(slog.LevelDebug)
+	case "warn", "warning":
+		logging.level.Set(slog.LevelWarn)
+	case "error":
+		logging.level.Set(slog.LevelError)
+	default:
+		logging.level.Set(slog.LevelInfo)
+	}
+	rate, err := strconv.ParseFloat(getEnv("LOG_SUCCESS_SAMPLE_RATE", "1"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		rate = 1
+	}
+	logging.successSampleRate = rate
+
+	opts := &slog.HandlerOptions{Level: &logging.level}
+	var handler slog.Handler
+	if strings.ToLower(getEnv("LOG_FORMAT", "json")) == "text" {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(&redactingHandler{inner: handler}))
+}
+
+// 带请求级字段（关联ID、调用方Key、路由）的日志器
+func logger(ctx context.Context) *slog.Logger {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return slog.Default()
+	}
+	return slog.Default().With("correlation_id", info.CorrelationID, "key", info.Key, "route", info.Route)
+}
+
+// 访问日志：每个请求结束时记录一条，5xx为error、4xx为warn，成功请求按比例采样
+func accessLogMiddleware(c *gin.Context) {
+	c.Next()
+
+	info := getRequestInfo(c.Request.Context())
+	if info == nil {
+		return
+	}
+	snap := info.snapshot()
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	default:
+		if logging.successSampleRate < 1 && rand.Float64() >= logging.successSampleRate {
+			return
+		}
+	}
+
+	attrs := []any{
+		"correlation_id", snap.CorrelationID,
+		"key", snap.Key,
+		"method", c.Request.Method,
+		"route", snap.Route,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"latency_ms", time.Since(snap.Start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	}
+	if snap.Model != "" || snap.RequestedModel != "" {
+		attrs = append(attrs, "model", snap.RequestedModel, "served_model", snap.Model)
+	}
+	if snap.Upstream != "" {
+		attrs = append(attrs, "upstream", snap.Upstream)
+	}
+	if snap.PromptTokens > 0 || snap.CompletionTokens > 0 {
+		attrs = append(attrs, "prompt_tokens", snap.PromptTokens, "completion_tokens", snap.CompletionTokens)
+	}
+	if len(snap.Failover) > 0 {
+		attrs = append(attrs, "failover", snap.Failover)
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, "errors", c.Errors.String())
+	}
+	slog.Log(c.Request.Context(), level, "请求完成", attrs...)
+}
+
+// 进程启动时初始化日志（LOG_*环境变量只在启动时读取一次）
+func init() {
+	initLogging(os.Stdout)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"JWT", "token is eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig-_x", "token is [REDACTED]"},
+		{"Bearer凭证", "Authorization: Bearer abc.def-123", "Authorization: Bearer [REDACTED]"},
+		{"sk-开头的Key", "key=sk-abcdefgh12345", "key=[REDACTED]"},
+		{"JSON敏感字段", `{"access_token": "xyz", "model": "m"}`, `{"access_token": "[REDACTED]", "model": "m"}`},
+		{"JSON字段名大小写", `{"Password":"p@ss"}`, `{"Password":"[REDACTED]"}`},
+		{"普通文本不变", "hello sk-short world", "hello sk-short world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactSecrets(tt.in); got != tt.want {
+				t.Fatalf("redactSecrets(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeBody(t *testing.T) {
+	got := sanitizeBody([]byte(`{"token":"secret"}` + strings.Repeat("x", 1000)))
+	if strings.Contains(got, "secret") || !strings.HasSuffix(got, "...（已截断）") {
+		t.Fatalf("sanitizeBody = %q", got)
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(&redactingHandler{inner: slog.NewJSONHandler(&buf, nil)})
+	header := http.Header{"Authorization": {"Bearer abc"}, "Content-Type": {"application/json"}}
+	log.With("api_key", "k1").WithGroup("req").Info("调用 Bearer xyz",
+		"Authorization", "Bearer abc",
+		"body", `{"jwt":"eyJa.eyJb.c"}`,
+		"err", errors.New("failed with sk-abcdefghijk"),
+		"headers", header,
+		slog.Group("auth", "password", "p", "user", "u"),
+	)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("日志不是JSON: %s: %s", err, buf.String())
+	}
+	for _, secret := range []string{"abc", "xyz", "k1", "sk-abcdefghijk", "eyJa", `"p"`} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("日志中包含未脱敏内容%s: %s", secret, buf.String())
+		}
+	}
+	if record["msg"] != "调用 Bearer [REDACTED]" || record["api_key"] != "[REDACTED]" {
+		t.Fatalf("record = %v", record)
+	}
+	req := record["req"].(map[string]interface{})
+	if req["Authorization"] != "[REDACTED]" || req["err"] != "failed with [REDACTED]" {
+		t.Fatalf("req = %v", req)
+	}
+	headers := req["headers"].(map[string]interface{})
+	if headers["Authorization"] != "[REDACTED]" || headers["Content-Type"] != "application/json" {
+		t.Fatalf("headers = %v", headers)
+	}
+	auth := req["auth"].(map[string]interface{})
+	if auth["password"] != "[REDACTED]" || auth["user"] != "u" {
+		t.Fatalf("auth = %v", auth)
+	}
+}
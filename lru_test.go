@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *lruCache[int])
+		want map[string]bool // key -> 是否应存在
+	}{
+		{"淘汰最久未使用", func(c *lruCache[int]) {
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Set("c", 3)
+			c.Set("d", 4)
+		}, map[string]bool{"a": false, "b": true, "c": true, "d": true}},
+		{"读取刷新使用顺序", func(c *lruCache[int]) {
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Set("c", 3)
+			c.Get("a")
+			c.Set("d", 4)
+		}, map[string]bool{"a": true, "b": false, "c": true, "d": true}},
+		{"覆盖写入不增加条数", func(c *lruCache[int]) {
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Set("a", 10)
+			c.Set("c", 3)
+		}, map[string]bool{"a": true, "b": true, "c": true}},
+		{"删除", func(c *lruCache[int]) {
+			c.Set("a", 1)
+			c.Set("b", 2)
+			c.Delete("a")
+		}, map[string]bool{"a": false, "b": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newLRUCache[int](3, 0)
+			tt.run(c)
+			for key, want := range tt.want {
+				if _, ok := c.Get(key); ok != want {
+					t.Fatalf("Get(%s) ok = %v, want %v", key, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := newLRUCache[string](0, 20*time.Millisecond)
+	c.Set("a", "x")
+	if v, ok := c.Get("a"); !ok || v != "x" {
+		t.Fatalf("Get = %q, %v", v, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("过期条目应视为不存在")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("过期条目读取后应被清理，Len = %d", c.Len())
+	}
+}
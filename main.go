@@ -3,13 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,7 +22,12 @@ import (
 )
 
 var (
-	client = &http.Client{}
+	// Token服务使用的HTTP客户端（超时为TokenTimeout）
+	tokenClient = &http.Client{}
+	// 主动健康探测使用的HTTP客户端（超时由每次探测的Context控制）
+	probeClient = &http.Client{}
+	// 转发目标服务使用的HTTP客户端（超时为ServerTimeout）
+	targetClient = &http.Client{}
 	// 固定Header名
 	correlationIDHeader = "x-correlation-id"
 	userSessionIDHeader = "x-usersession-id"
@@ -29,15 +39,26 @@ var (
 		TokenMethod           string
 		TokenTimeout          time.Duration
 		TokenPayloadTokenType string // 新增：token_type的值
+		TokenCacheTTL         time.Duration
+		TokenRefreshMargin    time.Duration
 		// 目标服务配置
 		TargetURL    string
 		TargetMethod string
 		// 默认请求体参数
 		DefaultUser     string
 		DefaultMaxToken int
+		// 网关对外提供的模型列表（第一个为默认模型）
+		Models []string
 		// 代理服务配置
 		ServerPort    string
 		ServerTimeout time.Duration
+		// 停机配置：收到信号后先标记未就绪等待ShutdownDelay，再最多等待DrainTimeout排空进行中的请求
+		ShutdownDelay time.Duration
+		DrainTimeout  time.Duration
+		// 本地数据目录（上传文件、批量任务状态）
+		DataDir string
+		// 管理接口Token（/admin/*需携带，未配置时管理接口关闭）
+		AdminToken string
 	}{}
 )
 
@@ -89,6 +110,55 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// 读取JSON格式的结构化配置：环境变量值可以是JSON文本，或以@开头的JSON文件路径
+// 环境变量未设置时返回false
+func loadJSONEnv(key string, v interface{}) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return false, nil
+	}
+	data := []byte(value)
+	if strings.HasPrefix(value, "@") {
+		fileData, err := os.ReadFile(strings.TrimPrefix(value, "@"))
+		if err != nil {
+			return false, fmt.Errorf("读取%s配置文件失败: %s", key, err)
+		}
+		data = fileData
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("解析%s配置失败: %s", key, err)
+	}
+	return true, nil
+}
+
+// 读取时间间隔类型的环境变量，格式错误时使用默认值
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("环境变量格式错误，使用默认值", "key", key, "default", defaultValue.String(), "error", err)
+		return defaultValue
+	}
+	return d
+}
+
+// 读取整数类型的环境变量，格式错误时使用默认值
+func getEnvInt(key string, defaultValue int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("环境变量格式错误，使用默认值", "key", key, "default", defaultValue, "error", err)
+		return defaultValue
+	}
+	return n
+}
+
 // 初始化配置（从环境变量读取）
 func initConfig() {
 	// 1. Token服务配置
@@ -100,11 +170,17 @@ func initConfig() {
 	tokenTimeoutStr := getEnv("TOKEN_TIMEOUT", "5s")
 	timeout, err := time.ParseDuration(tokenTimeoutStr)
 	if err != nil {
-		fmt.Printf("TOKEN_TIMEOUT格式错误，使用默认值5s: %s\n", err)
+		slog.Warn("环境变量格式错误，使用默认值", "key", "TOKEN_TIMEOUT", "default", "5s", "error", err)
 		config.TokenTimeout = 5 * time.Second
 	} else {
 		config.TokenTimeout = timeout
 	}
+	// 在启动时设置一次，并发请求不再修改共享的client
+	tokenClient.Timeout = config.TokenTimeout
+
+	// Token缓存（JWT按exp缓存；非JWT按TOKEN_CACHE_TTL缓存，默认不缓存）
+	config.TokenCacheTTL = getEnvDuration("TOKEN_CACHE_TTL", 0)
+	config.TokenRefreshMargin = getEnvDuration("TOKEN_REFRESH_MARGIN", 30*time.Second)
 
 	// 2. 目标服务配置
 	config.TargetURL = getEnv("TARGET_URL", "http://localhost:8001/api/ai-call")
@@ -115,30 +191,45 @@ func initConfig() {
 	maxTokenStr := getEnv("DEFAULT_MAX_TOKEN", "2000")
 	maxToken, err := strconv.Atoi(maxTokenStr)
 	if err != nil {
-		fmt.Printf("DEFAULT_MAX_TOKEN格式错误，使用默认值2000: %s\n", err)
+		slog.Warn("环境变量格式错误，使用默认值", "key", "DEFAULT_MAX_TOKEN", "default", 2000, "error", err)
 		config.DefaultMaxToken = 2000
 	} else {
 		config.DefaultMaxToken = maxToken
 	}
 
+	// 模型列表（逗号分隔）
+	for _, m := range strings.Split(getEnv("MODELS", "gpt-3.5-turbo"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			config.Models = append(config.Models, m)
+		}
+	}
+
 	// 4. 代理服务配置
 	config.ServerPort = getEnv("SERVER_PORT", "8080")
 	serverTimeoutStr := getEnv("SERVER_TIMEOUT", "10s")
 	serverTimeout, err := time.ParseDuration(serverTimeoutStr)
 	if err != nil {
-		fmt.Printf("SERVER_TIMEOUT格式错误，使用默认值10s: %s\n", err)
+		slog.Warn("环境变量格式错误，使用默认值", "key", "SERVER_TIMEOUT", "default", "10s", "error", err)
 		config.ServerTimeout = 10 * time.Second
 	} else {
 		config.ServerTimeout = serverTimeout
 	}
+	targetClient.Timeout = config.ServerTimeout
+	config.ShutdownDelay = getEnvDuration("SHUTDOWN_DELAY", 0)
+	config.DrainTimeout = getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second)
+
+	config.DataDir = getEnv("DATA_DIR", "./data")
+	config.AdminToken = getEnv("ADMIN_TOKEN", "")
 
-	// 打印配置（调试用，生产环境可注释）
-	fmt.Println("=== 代理服务配置 ===")
-	fmt.Printf("TokenURL: %s\n", config.TokenURL)
-	fmt.Printf("TokenPayloadTokenType: %s\n", config.TokenPayloadTokenType)
-	fmt.Printf("TargetURL: %s\n", config.TargetURL)
-	fmt.Printf("ServerPort: %s\n", config.ServerPort)
-	fmt.Println("====================")
+	// 打印配置
+	slog.Info("代理服务配置",
+		"token_url", config.TokenURL,
+		"token_payload_token_type", config.TokenPayloadTokenType,
+		"target_url", config.TargetURL,
+		"models", strings.Join(config.Models, ","),
+		"server_port", config.ServerPort,
+		"drain_timeout", config.DrainTimeout.String(),
+		"data_dir", config.DataDir)
 }
 
 // 生成随机字符串（UUID v4）
@@ -147,7 +238,7 @@ func generateRandomString() string {
 }
 
 // 实时获取JWT Token（新增JSON payload）
-func getJWTToken() (string, error) {
+func getJWTToken(ctx context.Context) (string, error) {
 	// 构建Token请求的JSON payload
 	tokenPayload := map[string]string{
 		"token_type": config.TokenPayloadTokenType, // 核心：添加token_type字段
@@ -158,15 +249,14 @@ func getJWTToken() (string, error) {
 	}
 
 	// 构建Token请求（带payload）
-	req, err := http.NewRequest(config.TokenMethod, config.TokenURL, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, config.TokenMethod, config.TokenURL, bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return "", fmt.Errorf("构建Token请求失败: %s", err)
 	}
 	req.Header.Set("Content-Type", "application/json") // 确保Content-Type正确
 
 	// 发送Token请求
-	client.Timeout = config.TokenTimeout
-	resp, err := client.Do(req)
+	resp, err := tokenClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("请求Token失败: %s", err)
 	}
@@ -179,7 +269,7 @@ func getJWTToken() (string, error) {
 		return "", fmt.Errorf("读取Token响应失败: %s", err)
 	}
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return "", fmt.Errorf("解析Token响应失败（响应体：%s）: %s", string(body), err)
+		return "", fmt.Errorf("解析Token响应失败（响应体：%s）: %s", sanitizeBody(body), err)
 	}
 
 	// 兼容多字段名
@@ -191,7 +281,7 @@ func getJWTToken() (string, error) {
 	} else if t, ok := tokenResp["jwt"]; ok {
 		token = t.(string)
 	} else {
-		return "", fmt.Errorf("Token响应无有效字段（响应体：%s）", string(body))
+		return "", fmt.Errorf("Token响应无有效字段（响应体：%s）", sanitizeBody(body))
 	}
 
 	if token == "" {
@@ -200,6 +290,121 @@ func getJWTToken() (string, error) {
 	return token, nil
 }
 
+// Token缓存：JWT带exp时缓存到过期前TokenRefreshMargin，否则按TokenCacheTTL缓存（0表示不缓存）
+var tokenCache struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	fetch     *tokenFetch // 进行中的Token请求，并发的缓存未命中共用同一次请求
+	lastError string      // 最近一次Token请求的错误（成功时为空），供就绪检查使用
+}
+
+// 一次进行中的Token请求
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// 获取Token，优先使用缓存；请求Token服务时不持有缓存锁
+func getToken(ctx context.Context) (string, error) {
+	ctx, span := startSpan(ctx, "gateway.token", spanKindInternal)
+	defer span.finish()
+
+	tokenCache.mu.Lock()
+	if tokenCache.token != "" && time.Now().Before(tokenCache.expiresAt) {
+		token := tokenCache.token
+		tokenCache.mu.Unlock()
+		metricTokenCache.add(1, "hit")
+		span.setAttr("gateway.token.cache_hit", true)
+		return token, nil
+	}
+	metricTokenCache.add(1, "miss")
+	span.setAttr("gateway.token.cache_hit", false)
+	f := tokenCache.fetch
+	if f == nil {
+		f = &tokenFetch{done: make(chan struct{})}
+		tokenCache.fetch = f
+		// 请求不随发起者断开而取消，由TokenTimeout限制时长，其他等待者仍可使用结果
+		go fetchToken(context.WithoutCancel(ctx), f)
+	}
+	tokenCache.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return "", contextError(ctx)
+	}
+	if f.err != nil {
+		span.setError(f.err)
+		return "", f.err
+	}
+	return f.token, nil
+}
+
+// 请求Token服务并更新缓存
+func fetchToken(ctx context.Context, f *tokenFetch) {
+	start := time.Now()
+	token, err := getJWTToken(ctx)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metricTokenService.observe(time.Since(start).Seconds(), result)
+	if err != nil {
+		logger(ctx).Error("获取Token失败", "latency_ms", time.Since(start).Milliseconds(), "error", err)
+	} else {
+		logger(ctx).Debug("获取Token成功", "latency_ms", time.Since(start).Milliseconds())
+	}
+
+	tokenCache.mu.Lock()
+	tokenCache.fetch = nil
+	tokenCache.lastError = ""
+	if err != nil {
+		tokenCache.lastError = err.Error()
+	} else {
+		tokenCache.token = ""
+		if exp, ok := jwtExpiry(token); ok {
+			if expiresAt := exp.Add(-config.TokenRefreshMargin); time.Now().Before(expiresAt) {
+				tokenCache.token, tokenCache.expiresAt = token, expiresAt
+			}
+		} else if config.TokenCacheTTL > 0 {
+			tokenCache.token, tokenCache.expiresAt = token, time.Now().Add(config.TokenCacheTTL)
+		}
+	}
+	tokenCache.mu.Unlock()
+	f.token, f.err = token, err
+	close(f.done)
+}
+
+// 使缓存的Token失效（目标服务返回401时调用）
+func invalidateToken(token string) {
+	tokenCache.mu.Lock()
+	defer tokenCache.mu.Unlock()
+	if tokenCache.token == token {
+		tokenCache.token = ""
+	}
+}
+
+// 解析JWT的exp字段（不校验签名）
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Exp), 0), true
+}
+
 // 将目标服务响应转换为OpenAI格式（非流式）
 func convertToOpenAIResponse(targetResp []byte, model string) ([]byte, error) {
 	// 解析目标服务响应
@@ -253,42 +458,229 @@ func convertToOpenAIResponse(targetResp []byte, model string) ([]byte, error) {
 	return openAIRespBytes, nil
 }
 
-// 处理流式响应转换（目标SSE→OpenAI SSE）
-func handleStreamResponse(c *gin.Context, resp *http.Response, model string) error {
-	// 设置OpenAI流式响应Header
+// 目标服务非流式响应的关键字段
+type targetResult struct {
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	ToolCalls        []targetToolCall // 可选：目标服务以OpenAI格式返回的工具调用
+}
+
+// 目标服务返回的工具调用
+type targetToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// 解析OpenAI格式的tool_calls字段，格式不符的条目直接忽略
+func parseTargetToolCalls(v interface{}) []targetToolCall {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	var toolCalls []targetToolCall
+	for _, item := range items {
+		call, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		function, _ := call["function"].(map[string]interface{})
+		toolCalls = append(toolCalls, targetToolCall{
+			ID:        stringValue(call["id"]),
+			Name:      stringValue(function["name"]),
+			Arguments: stringValue(function["arguments"]),
+		})
+	}
+	return toolCalls
+}
+
+// 合并流式响应中的工具调用：chunk可携带完整的tool_calls，也可按index分片携带增量（arguments逐段拼接）
+type toolCallAccumulator struct {
+	calls   []*targetToolCall
+	byIndex map[int]*targetToolCall
+}
+
+func (a *toolCallAccumulator) add(v interface{}) {
+	items, _ := v.([]interface{})
+	for i, item := range items {
+		call, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key := i
+		if _, ok := call["index"]; ok {
+			key = intValue(call["index"])
+		}
+		function, _ := call["function"].(map[string]interface{})
+		if a.byIndex == nil {
+			a.byIndex = map[int]*targetToolCall{}
+		}
+		existing, ok := a.byIndex[key]
+		if !ok {
+			existing = &targetToolCall{ID: stringValue(call["id"]), Name: stringValue(function["name"])}
+			a.byIndex[key] = existing
+			a.calls = append(a.calls, existing)
+		}
+		existing.Arguments += stringValue(function["arguments"])
+	}
+}
+
+// 合并后的工具调用（按首次出现的顺序）
+func (a *toolCallAccumulator) result() []targetToolCall {
+	calls := make([]targetToolCall, 0, len(a.calls))
+	for _, call := range a.calls {
+		calls = append(calls, *call)
+	}
+	return calls
+}
+
+// 将任意JSON值转为字符串（nil返回空串）
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// 将任意JSON值转为整数（无法转换返回0）
+func intValue(v interface{}) int {
+	n, _ := strconv.Atoi(stringValue(v))
+	if n == 0 {
+		if f, ok := v.(float64); ok {
+			n = int(f)
+		}
+	}
+	return n
+}
+
+// 解析目标服务非流式响应
+func parseTargetResponse(targetResp []byte) (*targetResult, error) {
+	var targetData map[string]interface{}
+	if err := json.Unmarshal(targetResp, &targetData); err != nil {
+		return nil, fmt.Errorf("解析目标响应失败: %s", err)
+	}
+	result := &targetResult{
+		Content:          stringValue(targetData["content"]),
+		ToolCalls:        parseTargetToolCalls(targetData["tool_calls"]),
+		FinishReason:     stringValue(targetData["finish_reason"]),
+		PromptTokens:     intValue(targetData["prompt_tokens"]),
+		CompletionTokens: intValue(targetData["completion_tokens"]),
+	}
+	if result.FinishReason == "" {
+		result.FinishReason = "stop"
+	}
+	return result, nil
+}
+
+// 以非流式方式调用目标服务并解析结果
+func callTargetOnce(ctx context.Context, openaiRequest map[string]interface{}) (*targetResult, error) {
+	resp, err := forwardToTarget(ctx, openaiRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("读取目标响应失败: %s", err)}
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &proxyError{resp.StatusCode, "downstream_error", fmt.Sprintf("目标服务返回错误（状态码：%d）: %s", resp.StatusCode, redactSecrets(string(respBody)))}
+	}
+	result, err := parseTargetResponse(respBody)
+	if err != nil {
+		return nil, &proxyError{http.StatusBadGateway, "downstream_error", err.Error()}
+	}
+	recordUsage(ctx, result.PromptTokens, result.CompletionTokens, result.FinishReason)
+	return result, nil
+}
+
+// 以流式方式调用目标服务，目标返回错误状态码时不向客户端写入任何内容（调用方负责关闭响应体）
+func openTargetStream(ctx context.Context, openaiRequest map[string]interface{}) (*http.Response, error) {
+	openaiRequest["stream"] = true
+	resp, err := forwardToTarget(ctx, openaiRequest)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, &proxyError{resp.StatusCode, "downstream_error", fmt.Sprintf("目标服务返回错误（状态码：%d）: %s", resp.StatusCode, redactSecrets(string(respBody)))}
+	}
+	return resp, nil
+}
+
+// 从请求中取调用方API Key（Authorization: Bearer或x-api-key），未携带时返回空串
+func callerAPIKey(r *http.Request) string {
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if key == "" {
+		key = strings.TrimSpace(r.Header.Get("x-api-key"))
+	}
+	return key
+}
+
+// 生成OpenAI风格的对象ID（prefix含分隔符，如"cmpl-"、"resp_"）
+func newObjectID(prefix string) string {
+	return prefix + strings.ReplaceAll(generateRandomString(), "-", "")
+}
+
+// 以SSE data行写出JSON对象
+func writeSSEData(c *gin.Context, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(data)))
+	c.Writer.Flush()
+}
+
+// 在已开始的SSE流中写出错误事件
+func writeSSEError(c *gin.Context, err error) {
+	errType := "stream_error"
+	if pe, ok := err.(*proxyError); ok {
+		errType = pe.Type
+	}
+	writeSSEData(c, gin.H{
+		"error": gin.H{
+			"message": err.Error(),
+			"type":    errType,
+		},
+	})
+}
+
+// 设置SSE流式响应Header
+func setSSEHeaders(c *gin.Context) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
+}
 
-	// 逐行读取目标服务的流式响应
-	reader := bufio.NewReader(resp.Body)
-	chunkID := fmt.Sprintf("chatcmpl-%s", strings.ReplaceAll(generateRandomString(), "-", ""))
-	created := time.Now().Unix()
+// 逐行读取目标服务的SSE流，每解析出一个chunk调用一次onChunk
+// 读到EOF时返回nil；客户端断开时返回ctx的错误
+func readTargetStream(ctx context.Context, body io.Reader, onChunk func(targetChunk map[string]interface{}) error) error {
+	metrics := startStreamMetrics(getRequestInfo(ctx))
+	defer metrics.done()
+	_, span := startSpan(ctx, "gateway.stream", spanKindInternal)
+	chunks := 0
+	defer func() {
+		span.setAttr("gateway.stream.chunks", chunks)
+		if !metrics.first.IsZero() {
+			span.setAttr("gateway.stream.time_to_first_token_ms", metrics.first.Sub(metrics.start).Milliseconds())
+		}
+		span.finish()
+	}()
 
+	reader := bufio.NewReader(body)
 	for {
 		// 读取一行
 		line, err := reader.ReadString('\n')
 		if err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx)
+			}
 			if err == io.EOF {
-				// 发送结束chunk
-				finishChunk := OpenAIStreamChunk{
-					ID:      chunkID,
-					Object:  "chat.completion.chunk",
-					Created: created,
-					Model:   model,
-					Choices: []struct {
-						Delta        Delta  `json:"delta"`
-						FinishReason string `json:"finish_reason,omitempty"`
-					}{
-						{
-							Delta:        Delta{},
-							FinishReason: "stop",
-						},
-					},
-				}
-				finishBytes, _ := json.Marshal(finishChunk)
-				c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(finishBytes)))
-				c.Writer.Flush()
 				return nil
 			}
 			return fmt.Errorf("读取流式响应失败: %s", err)
@@ -309,7 +701,31 @@ func handleStreamResponse(c *gin.Context, resp *http.Response, model string) err
 		if err := json.Unmarshal([]byte(dataStr), &targetChunk); err != nil {
 			continue
 		}
+		if stringValue(targetChunk["content"]) != "" {
+			metrics.chunk()
+			chunks++
+		}
+		recordUsage(ctx, intValue(targetChunk["prompt_tokens"]), intValue(targetChunk["completion_tokens"]), stringValue(targetChunk["finish_reason"]))
+		if err := onChunk(targetChunk); err != nil {
+			return err
+		}
+
+		// 检查客户端是否断开连接（或服务停机）
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+	}
+}
+
+// 处理流式响应转换（目标SSE→OpenAI SSE）
+func handleStreamResponse(c *gin.Context, resp *http.Response, model string) error {
+	// 设置OpenAI流式响应Header
+	setSSEHeaders(c)
+
+	chunkID := fmt.Sprintf("chatcmpl-%s", strings.ReplaceAll(generateRandomString(), "-", ""))
+	created := time.Now().Unix()
 
+	err := readTargetStream(c.Request.Context(), resp.Body, func(targetChunk map[string]interface{}) error {
 		// 转换为OpenAI chunk格式
 		openAIChunk := OpenAIStreamChunk{
 			ID:      chunkID,
@@ -333,53 +749,78 @@ func handleStreamResponse(c *gin.Context, resp *http.Response, model string) err
 		// 发送到客户端
 		chunkBytes, err := json.Marshal(openAIChunk)
 		if err != nil {
-			continue
+			return nil
 		}
 		c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(chunkBytes)))
 		c.Writer.Flush()
-
-		// 检查客户端是否断开连接
-		if c.Request.Context().Err() != nil {
-			return nil
+		return nil
+	})
+	if err != nil {
+		// 客户端断开连接时直接结束；已开始输出后以SSE错误事件结束
+		if !clientGone(c.Request.Context()) {
+			writeSSEError(c, err)
 		}
+		return nil
 	}
-}
 
-// 核心代理处理函数
-func openaiProxyHandler(c *gin.Context) {
-	// 1. 获取JWT Token
-	token, err := getJWTToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": gin.H{
-				"message": fmt.Sprintf("获取Token失败: %s", err),
-				"type":    "token_error",
+	// 发送结束chunk
+	finishChunk := OpenAIStreamChunk{
+		ID:      chunkID,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   model,
+		Choices: []struct {
+			Delta        Delta  `json:"delta"`
+			FinishReason string `json:"finish_reason,omitempty"`
+		}{
+			{
+				Delta:        Delta{},
+				FinishReason: "stop",
 			},
-		})
-		return
+		},
 	}
+	finishBytes, _ := json.Marshal(finishChunk)
+	c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(finishBytes)))
+	c.Writer.Flush()
+	return nil
+}
 
-	// 2. 读取OpenAI格式请求
-	var openaiRequest map[string]interface{}
-	if err := c.ShouldBindJSON(&openaiRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"message": fmt.Sprintf("解析请求体失败: %s", err),
-				"type":    "invalid_request_error",
-			},
-		})
-		return
+// 代理错误（携带HTTP状态码和OpenAI错误类型）
+type proxyError struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *proxyError) Error() string {
+	return e.Message
+}
+
+// 以OpenAI错误格式返回给客户端
+func writeProxyError(c *gin.Context, err error) {
+	status, errType := http.StatusInternalServerError, "internal_error"
+	if pe, ok := err.(*proxyError); ok {
+		status, errType = pe.Status, pe.Type
 	}
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": err.Error(),
+			"type":    errType,
+		},
+	})
+}
 
-	// 3. 补充默认参数
+// 补充默认参数，返回模型名和流式标识
+func prepareTargetRequest(openaiRequest map[string]interface{}) (string, bool) {
 	if _, ok := openaiRequest["user"]; !ok {
 		openaiRequest["user"] = config.DefaultUser
 	}
-	if _, ok := openaiRequest["max_token"]; !ok {
+	_, hasMaxToken := openaiRequest["max_token"]
+	_, hasMaxTokens := openaiRequest["max_tokens"]
+	if !hasMaxToken && !hasMaxTokens {
 		openaiRequest["max_tokens"] = config.DefaultMaxToken
 	}
 
-	// 4. 获取模型名和流式标识
 	model := "gpt-3.5-turbo"
 	if m, ok := openaiRequest["model"]; ok {
 		model = fmt.Sprintf("%v", m)
@@ -388,53 +829,258 @@ func openaiProxyHandler(c *gin.Context) {
 	if s, ok := openaiRequest["stream"]; ok {
 		isStream, _ = strconv.ParseBool(fmt.Sprintf("%v", s))
 	}
+	return model, isStream
+}
 
-	// 5. 序列化请求体
-	payloadBytes, err := json.Marshal(openaiRequest)
+// 添加目标服务要求的认证和追踪Header
+func setTargetHeaders(req *http.Request, token string) {
+	req.Header.Set("X-Trust-Token", token)
+	req.Header.Set(correlationIDHeader, generateRandomString())
+	req.Header.Set(userSessionIDHeader, generateRandomString())
+	req.Header.Set("Token_Type", "SESSION_TOKEN")
+	req.Header.Set("Content-Type", "application/json")
+}
+
+// 获取Token并将OpenAI格式请求按模型路由转发到目标服务（调用方负责关闭响应体）
+func forwardToTarget(ctx context.Context, openaiRequest map[string]interface{}) (*http.Response, error) {
+	exactStore, cached := lookupResponseCache(ctx, openaiRequest)
+	if cached != nil {
+		return cached, nil
+	}
+	semanticStore, cached := lookupSemanticCache(ctx, openaiRequest)
+	if cached != nil {
+		return cached, nil
+	}
+	resp, shared, err := forwardCoalesced(ctx, openaiRequest)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": gin.H{
-				"message": fmt.Sprintf("序列化请求体失败: %s", err),
-				"type":    "internal_error",
-			},
-		})
+		if _, ok := err.(*proxyError); !ok {
+			return nil, &proxyError{http.StatusBadGateway, "downstream_error", fmt.Sprintf("转发请求失败: %s", err)}
+		}
+		return nil, err
+	}
+	if !shared {
+		// 合并的请求只由发起调用的请求写入缓存
+		captureCacheableResponse(ctx, openaiRequest, resp, exactStore, semanticStore)
+	}
+	return resp, nil
+}
+
+// 预读过首字节的响应体
+type peekedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// 失败的请求按超时上限记入延迟样本，避免只会快速失败的副本因EWMA为0或很低而被优先选中；
+// 被取消的请求（客户端断开、对冲落败）不计
+func observeFailure(ctx context.Context, endpoint *Endpoint, start time.Time, isStream bool) {
+	if ctx.Err() != nil {
 		return
 	}
+	penalty := time.Since(start)
+	if targetClient.Timeout > penalty {
+		penalty = targetClient.Timeout
+	}
+	endpoint.observe(penalty, isStream)
+}
 
-	// 6. 构建目标请求
-	req, err := http.NewRequest(config.TargetMethod, config.TargetURL, bytes.NewBuffer(payloadBytes))
+// 向上游的一个副本发送一次请求；流式请求会预读首字节，首字节到达前的失败按请求失败处理
+func sendUpstreamAttempt(ctx context.Context, upstream *Upstream, endpoint *Endpoint, payloadBytes []byte, token, requestID string, attempt int, isStream bool) (resp *http.Response, err error) {
+	ctx, span := startSpan(ctx, "gateway.upstream "+upstream.Name, spanKindClient)
+	span.setAttr("gateway.upstream", upstream.Name)
+	span.setAttr("gateway.attempt", attempt)
+	span.setAttr("url.full", endpoint.URL)
+	span.setAttr("gen_ai.request.stream", isStream)
+	defer func() {
+		if err != nil {
+			span.setError(err)
+		} else {
+			span.setAttr("http.response.status_code", resp.StatusCode)
+			if resp.StatusCode >= http.StatusBadRequest {
+				span.setError(fmt.Errorf("状态码%d", resp.StatusCode))
+			}
+		}
+		span.finish()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, upstream.Method, endpoint.URL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	injectTraceContext(ctx, req.Header)
+	setTargetHeaders(req, token)
+	// 同一请求的多次尝试使用相同ID，便于上游做幂等去重
+	req.Header.Set(correlationIDHeader, requestID)
+	req.Header.Set("Idempotency-Key", requestID)
+	req.Header.Set("X-Gateway-Attempt", strconv.Itoa(attempt))
+	if info := getRequestInfo(ctx); info != nil && info.SessionID != "" {
+		req.Header.Set(userSessionIDHeader, info.SessionID)
+	}
+
+	start := time.Now()
+	endpoint.begin()
+	resp, err = targetClient.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		endpoint.end()
+		observeFailure(ctx, endpoint, start, isStream)
+		auditUpstream(ctx, upstream.Name, endpoint.URL, attempt, req, payloadBytes, nil, err)
+		return nil, err
+	}
+	if isStream && resp.StatusCode < http.StatusBadRequest {
+		reader := bufio.NewReader(resp.Body)
+		if _, err := reader.Peek(1); err != nil {
+			resp.Body.Close()
+			endpoint.end()
+			observeFailure(ctx, endpoint, start, isStream)
+			auditUpstream(ctx, upstream.Name, endpoint.URL, attempt, req, payloadBytes, nil, err)
+			return nil, err
+		}
+		resp.Body = peekedBody{reader, resp.Body}
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		endpoint.observe(time.Since(start), isStream)
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		observeFailure(ctx, endpoint, start, isStream)
+	}
+	resp.Body = &endpointBody{ReadCloser: resp.Body, endpoint: endpoint}
+	auditUpstream(ctx, upstream.Name, endpoint.URL, attempt, req, payloadBytes, resp, nil)
+	return resp, nil
+}
+
+// 将请求转发到指定上游（调用方负责关闭响应体）
+// 上游配置了并发限制时先按优先级排队获取槽位，槽位在响应体关闭（流式即输出结束）时释放
+func forwardToUpstream(ctx context.Context, upstream *Upstream, openaiRequest map[string]interface{}, route *Route) (*http.Response, error) {
+	release, err := upstream.admission.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sendWithRetry(ctx, upstream, openaiRequest, route)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &admissionBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// 按上游的重试策略发送请求，路由配置了对冲策略时每次尝试可对冲
+// 响应交给调用方后（流式即开始向客户端输出后）不再重试；网络错误原样返回，由调用方判断是否故障转移
+func sendWithRetry(ctx context.Context, upstream *Upstream, openaiRequest map[string]interface{}, route *Route) (*http.Response, error) {
+	// 1. 序列化请求体（每次尝试重放相同的请求体）
+	payloadBytes, err := json.Marshal(openaiRequest)
+	if err != nil {
+		return nil, &proxyError{http.StatusInternalServerError, "internal_error", fmt.Sprintf("序列化请求体失败: %s", err)}
+	}
+	isStream, _ := strconv.ParseBool(stringValue(openaiRequest["stream"]))
+	requestID := generateRandomString()
+	policy := &upstream.Retry
+	upstream.budget.deposit()
+
+	sessionID := ""
+	if info := getRequestInfo(ctx); info != nil {
+		sessionID = info.SessionID
+	}
+
+	tokenRefreshed := false
+	var failedEndpoint *Endpoint
+	for attempt := 1; ; attempt++ {
+		// 2. 获取JWT Token
+		token, err := getToken(ctx)
+		if err != nil {
+			return nil, &proxyError{http.StatusInternalServerError, "token_error", fmt.Sprintf("获取Token失败: %s", err)}
+		}
+
+		// 3. 选择副本并转发请求（重试时尽量换一个副本）
+		endpoint := upstream.pool.pick(sessionID, upstream.Sticky, failedEndpoint)
+		if endpoint == nil {
+			return nil, fmt.Errorf("上游%s没有可用副本（全部熔断或探测失败）", upstream.Name)
+		}
+		var resp *http.Response
+		if hedge := route.hedgePolicy(); hedge != nil {
+			resp, endpoint, err = hedge.send(ctx, route.Model, upstream, endpoint, payloadBytes, token, requestID, attempt, isStream)
+		} else {
+			resp, err = sendUpstreamAttempt(ctx, upstream, endpoint, payloadBytes, token, requestID, attempt, isStream)
+			recordEndpointResult(ctx, upstream, endpoint, resp, err)
+		}
+
+		// 4. 目标返回401时刷新Token并重试一次（不计入重试次数）
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && !tokenRefreshed {
+			resp.Body.Close()
+			invalidateToken(token)
+			tokenRefreshed = true
+			attempt--
+			continue
+		}
+
+		// 5. 判断是否需要重试
+		retryable := false
+		var wait time.Duration
+		if err != nil {
+			retryable = ctx.Err() == nil && policy.errorRetryable(err)
+		} else if policy.statusRetryable(resp.StatusCode) {
+			retryable = true
+			if *policy.RespectRetryAfter {
+				if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					wait = d
+					retryable = d <= time.Duration(policy.MaxRetryAfter)
+				}
+			}
+		}
+		if !retryable || attempt >= policy.MaxAttempts || !upstream.budget.withdraw() {
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+
+		// 6. 丢弃本次响应，退避后重试
+		failedEndpoint = endpoint
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("状态码%d", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		if wait == 0 {
+			wait = policy.backoff(attempt)
+		}
+		logger(ctx).Warn("上游请求失败，退避后重试", "upstream", upstream.Name, "endpoint", endpoint.URL, "request_id", requestID, "attempt", attempt, "reason", reason, "wait", wait.String())
+		metricRetries.add(1, upstream.Name, retryReason(resp, err))
+		if !sleepContext(ctx, wait) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 核心代理处理函数
+func openaiProxyHandler(c *gin.Context) {
+	// 1. 读取OpenAI格式请求
+	var openaiRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&openaiRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"error": gin.H{
-				"message": fmt.Sprintf("构建目标请求失败: %s", err),
-				"type":    "internal_error",
+				"message": fmt.Sprintf("解析请求体失败: %s", err),
+				"type":    "invalid_request_error",
 			},
 		})
 		return
 	}
 
-	// 7. 添加所有要求的Header
-	req.Header.Set("X-Trust-Token", token)
-	req.Header.Set(correlationIDHeader, generateRandomString())
-	req.Header.Set(userSessionIDHeader, generateRandomString())
-	req.Header.Set("Token_Type", "SESSION_TOKEN")
-	req.Header.Set("Content-Type", "application/json")
+	// 2. 补充默认参数，获取模型名和流式标识
+	model, isStream := prepareTargetRequest(openaiRequest)
 
-	// 8. 转发请求
-	client.Timeout = config.ServerTimeout
-	resp, err := client.Do(req)
+	// 3. 获取Token并转发请求
+	resp, err := forwardToTarget(c.Request.Context(), openaiRequest)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error": gin.H{
-				"message": fmt.Sprintf("转发请求失败: %s", err),
-				"type":    "downstream_error",
-			},
-		})
+		writeProxyError(c, err)
 		return
 	}
 	defer resp.Body.Close()
+	model = servedModel(c.Request.Context(), model)
 
-	// 9. 处理响应（流式/非流式）
+	// 4. 处理响应（流式/非流式）
 	if isStream {
 		if err := handleStreamResponse(c, resp, model); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -458,6 +1104,9 @@ func openaiProxyHandler(c *gin.Context) {
 		}
 
 		// 转换为OpenAI格式
+		if result, err := parseTargetResponse(respBody); err == nil && resp.StatusCode < http.StatusBadRequest {
+			recordUsage(c.Request.Context(), result.PromptTokens, result.CompletionTokens, result.FinishReason)
+		}
 		openAIResp, err := convertToOpenAIResponse(respBody, model)
 		if err != nil {
 			// 转换失败时透传原始响应
@@ -479,24 +1128,124 @@ func healthCheckHandler(c *gin.Context) {
 	})
 }
 
-func main() {
-	// 初始化配置（从环境变量）
+// 初始化网关各模块配置（HTTP服务和子命令共用）
+func initGateway() {
 	initConfig()
+	initUpstreams()
+	initPriorities()
+	initRoutes()
+	initTracing()
+	if err := initAudit(); err != nil {
+		panic(err)
+	}
+	initEmbeddingConfig()
+	initMetricLabels()
+	initResponsesConfig()
+	initResponseCache()
+	initSemanticCache()
+	initCoalescing()
+	initRecording()
+}
 
-	// 初始化Gin引擎
+// 管理接口鉴权：需携带Authorization: Bearer <ADMIN_TOKEN>，未配置ADMIN_TOKEN时接口关闭
+func adminAuthMiddleware(c *gin.Context) {
+	if config.AdminToken == "" {
+		writeProxyError(c, &proxyError{http.StatusForbidden, "permission_error", "管理接口未开启（未配置ADMIN_TOKEN）"})
+		c.Abort()
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		writeProxyError(c, &proxyError{http.StatusUnauthorized, "authentication_error", "管理接口Token无效"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// 注册所有路由
+func newRouter() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery(), inflightMiddleware, requestInfoMiddleware, accessLogMiddleware, metricsMiddleware, tracingMiddleware)
 
-	// 路由
 	r.GET("/health", healthCheckHandler)
-	r.POST("/chat/completions", openaiProxyHandler)
+	r.GET("/livez", livezHandler)
+	r.GET("/readyz", readyzHandler)
+	r.GET("/admin/upstreams", adminAuthMiddleware, upstreamHealthHandler)
+	r.GET("/admin/semantic-cache", adminAuthMiddleware, listSemanticCacheHandler)
+	r.DELETE("/admin/semantic-cache", adminAuthMiddleware, purgeSemanticCacheHandler)
+	r.GET("/admin/semantic-cache/:id", adminAuthMiddleware, getSemanticCacheHandler)
+	r.DELETE("/admin/semantic-cache/:id", adminAuthMiddleware, deleteSemanticCacheHandler)
+	r.GET("/metrics", metricsHandler)
+	r.POST("/chat/completions", auditMiddleware, openaiProxyHandler)
+	r.POST("/v1/completions", auditMiddleware, completionsHandler)
+	r.POST("/v1/embeddings", auditMiddleware, embeddingsHandler)
+	r.POST("/v1/responses", auditMiddleware, responsesHandler)
+	r.GET("/v1/responses/:id", getResponseHandler)
+	r.DELETE("/v1/responses/:id", deleteResponseHandler)
+	r.POST("/v1/messages", auditMiddleware, anthropicMessagesHandler)
+	r.POST("/api/chat", auditMiddleware, ollamaChatHandler)
+	r.POST("/api/generate", auditMiddleware, ollamaGenerateHandler)
+	r.GET("/api/tags", ollamaTagsHandler)
+	r.POST("/api/show", ollamaShowHandler)
+	r.GET("/api/version", ollamaVersionHandler)
+	r.POST("/v1/files", uploadFileHandler)
+	r.GET("/v1/files", listFilesHandler)
+	r.GET("/v1/files/:id", getFileHandler)
+	r.GET("/v1/files/:id/content", getFileContentHandler)
+	r.DELETE("/v1/files/:id", deleteFileHandler)
+	r.POST("/v1/batches", createBatchHandler)
+	r.GET("/v1/batches", listBatchesHandler)
+	r.GET("/v1/batches/:id", getBatchHandler)
+	r.POST("/v1/batches/:id/cancel", cancelBatchHandler)
+	return r
+}
+
+func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "batch":
+			os.Exit(runBatchCommand(os.Args[2:]))
+		case "verify-audit":
+			os.Exit(runVerifyAuditCommand(os.Args[2:]))
+		case "mock":
+			os.Exit(runMockCommand(os.Args[2:]))
+		}
+	}
+
+	// 初始化配置（从环境变量）
+	initGateway()
+
+	// 初始化Gin引擎和路由
+	r := newRouter()
+	gatewayRouter = r
+
+	// 初始化文件存储和批量任务（恢复重启前未完成的任务）
+	if err := initFileStore(config.DataDir); err != nil {
+		panic(err)
+	}
+	if err := initBatchManager(config.DataDir); err != nil {
+		panic(err)
+	}
+	onShutdown(batches.Stop)
+
+	// 启动后台任务（停机时停止）
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	onShutdown(stopWorkers)
+	startHealthChecks(workersCtx)
 
 	// 启动服务
-	fmt.Printf("OpenAI兼容代理服务启动成功 | 端口：%s\n", config.ServerPort)
-	fmt.Printf("接口：POST http://0.0.0.0:%s/chat/completions\n", config.ServerPort)
-	fmt.Printf("健康检查：GET http://0.0.0.0:%s/health\n", config.ServerPort)
+	slog.Info("OpenAI兼容代理服务启动成功",
+		"port", config.ServerPort,
+		"openai", "/chat/completions、/v1/completions、/v1/embeddings、/v1/responses",
+		"anthropic", "/v1/messages",
+		"ollama", "/api/{chat,generate,tags,show}",
+		"batch", "/v1/files、/v1/batches",
+		"health", "/health、/livez、/readyz")
 
-	if err := r.Run(":" + config.ServerPort); err != nil {
+	if err := serveWithGracefulShutdown(r); err != nil {
 		panic(fmt.Errorf("启动服务失败: %s", err))
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 启动测试用的Token服务和目标服务并写入配置，返回目标服务收到的请求数
+func startTestBackend(t *testing.T, target http.HandlerFunc) *int64 {
+	t.Helper()
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"token":"test-token"}`)
+	}))
+	var hits int64
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		target(w, r)
+	}))
+	t.Cleanup(tokenServer.Close)
+	t.Cleanup(targetServer.Close)
+
+	oldConfig, oldUpstreams, oldRoutes := config, upstreams, routes
+	t.Cleanup(func() { config, upstreams, routes = oldConfig, oldUpstreams, oldRoutes })
+	t.Setenv("TOKEN_URL", tokenServer.URL)
+	t.Setenv("TARGET_URL", targetServer.URL)
+	initGateway()
+	return &hits
+}
+
+// 读取目标服务收到的请求体
+func readTargetRequest(r *http.Request) map[string]interface{} {
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+	return req
+}
+
+// 目标请求最后一条消息的文本
+func lastMessageText(req map[string]interface{}) string {
+	messages, _ := req["messages"].([]interface{})
+	if len(messages) == 0 {
+		return ""
+	}
+	message, _ := messages[len(messages)-1].(map[string]interface{})
+	return stringValue(message["content"])
+}
+
+// 目标服务：回显最后一条消息，流式请求按单个字符分块
+func echoTarget(w http.ResponseWriter, r *http.Request) {
+	req := readTargetRequest(r)
+	text := "echo:" + lastMessageText(req)
+	if stream, _ := req["stream"].(bool); !stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"content": text, "finish_reason": "stop", "prompt_tokens": 3, "completion_tokens": len(text)})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, ch := range text {
+		data, _ := json.Marshal(map[string]interface{}{"content": string(ch)})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprintf(w, "data: {\"content\":\"\",\"finish_reason\":\"stop\",\"prompt_tokens\":3,\"completion_tokens\":%d}\n\n", len(text))
+	io.WriteString(w, "data: [DONE]\n\n")
+}
+
+// 以JSON请求体调用处理函数
+func serveJSON(h gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", h)
+	return serveRequest(r, http.MethodPost, "/", body, nil)
+}
+
+// 向路由发送请求，header为附加的请求Header
+func serveRequest(r http.Handler, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// 解析SSE响应中的data行（不含[DONE]）
+func sseData(body string) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event map[string]interface{}
+		if json.Unmarshal([]byte(data), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus指标（文本格式，手写实现，不依赖客户端库）
+type metricVec struct {
+	name    string
+	help    string
+	typ     string // counter、gauge、histogram
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter/gauge
+	counts      []uint64 // histogram各桶计数（非累计）
+	sum         float64
+	count       uint64
+}
+
+var metricsRegistry []*metricVec
+
+func registerMetric(m *metricVec) *metricVec {
+	m.series = make(map[string]*metricSeries)
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, typ: "counter", labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, typ: "gauge", labels: labels})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets})
+}
+
+// 取得（不存在时创建）一组标签值对应的时间序列，调用方需持有m.mu
+func (m *metricVec) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if m.typ == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// 计数器/仪表盘增加v
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// 仪表盘设置为v
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+// 直方图记录一个样本
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// 清空所有时间序列（用于抓取时重新采集的仪表盘）
+func (m *metricVec) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[string]*metricSeries)
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 按Prometheus文本格式输出
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var (
+	latencyBuckets      = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	ttftBuckets         = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30}
+	interTokenBuckets   = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	tokenServiceBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	queueWaitBuckets    = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+	metricRequests        = newCounter("gateway_requests_total", "Inbound requests by route, model, upstream, key and status (unconfigured models and unlisted keys as other).", "route", "model", "upstream", "key", "status")
+	metricRequestDuration = newHistogram("gateway_request_duration_seconds", "Inbound request latency.", latencyBuckets, "route", "model", "upstream", "key", "status")
+	metricTTFT            = newHistogram("gateway_stream_time_to_first_token_seconds", "Time from request start to the first streamed token.", ttftBuckets, "route", "model", "upstream")
+	metricInterToken      = newHistogram("gateway_stream_inter_token_seconds", "Time between consecutive streamed chunks.", interTokenBuckets, "route", "model", "upstream")
+	metricActiveStreams   = newGauge("gateway_active_streams", "Streams currently being relayed.", "route")
+	metricTokens          = newCounter("gateway_tokens_total", "Prompt and completion tokens reported by the target (unconfigured models and unlisted keys as other).", "direction", "model", "key")
+	metricTokenService    = newHistogram("gateway_token_service_duration_seconds", "Token service call latency.", tokenServiceBuckets, "result")
+	metricTokenCache      = newCounter("gateway_token_cache_requests_total", "Token lookups by cache result.", "result")
+	metricResponseCache   = newCounter("gateway_response_cache_requests_total", "Response cache lookups by result.", "result")
+	metricSemanticCache   = newCounter("gateway_semantic_cache_requests_total", "Semantic cache lookups by result.", "result")
+	metricHedges          = newCounter("gateway_hedged_requests_total", "Hedging decisions by route, upstream and outcome (primary_won, hedge_won, both_failed, capped, saturated, no_endpoint).", "route", "upstream", "outcome")
+	metricCoalesced       = newCounter("gateway_coalesced_requests_total", "Requests that started (leader) or joined (follower) an upstream call.", "role")
+	metricTokenHitRatio   = newGauge("gateway_token_cache_hit_ratio", "Share of token lookups served from cache.")
+	metricRetries         = newCounter("gateway_upstream_retries_total", "Upstream retries by reason.", "upstream", "reason")
+	metricFailovers       = newCounter("gateway_failovers_total", "Failovers from one upstream/model to the next.", "route", "from_upstream", "to_upstream", "reason")
+	metricBreakerState    = newGauge("gateway_circuit_breaker_state", "Circuit breaker state per endpoint (0=closed, 1=half_open, 2=open).", "upstream", "endpoint")
+	metricEndpointHealthy = newGauge("gateway_endpoint_healthy", "Whether the endpoint passes active health checks.", "upstream", "endpoint")
+	metricOutstanding     = newGauge("gateway_endpoint_outstanding_requests", "Requests in flight per endpoint.", "upstream", "endpoint")
+	metricInflight        = newGauge("gateway_inflight_requests", "Inbound requests in flight.")
+	metricQueueWait       = newHistogram("gateway_upstream_queue_wait_seconds", "Time spent waiting for an upstream concurrency slot.", queueWaitBuckets, "upstream", "priority")
+	metricShed            = newCounter("gateway_upstream_shed_total", "Requests rejected by upstream admission control (queue_full, preempted, queue_timeout).", "upstream", "priority", "reason")
+	metricQueueDepth      = newGauge("gateway_upstream_queue_depth", "Requests waiting for an upstream concurrency slot.", "upstream")
+	metricUpstreamActive  = newGauge("gateway_upstream_active_requests", "Requests holding an upstream concurrency slot.", "upstream")
+)
+
+// 来自客户端的标签取值限制：未配置的模型和未列出的调用方Key记为other，避免时间序列无限增长
+var metricLabels struct {
+	models map[string]bool // 模型列表、路由目标和Embedding上游中配置的模型
+	keys   map[string]bool // METRICS_KEY_LABELS中列出的Key标识（如key-1a2b3c4d）
+}
+
+// 初始化指标标签白名单（在路由和Embedding配置之后调用）
+func initMetricLabels() {
+	metricLabels.models = make(map[string]bool)
+	for _, m := range config.Models {
+		metricLabels.models[m] = true
+	}
+	for _, route := range routes {
+		metricLabels.models[route.Target] = true
+		for _, fb := range route.Fallbacks {
+			metricLabels.models[fb.Model] = true
+		}
+	}
+	for _, u := range embeddingUpstreams {
+		for _, m := range u.Models {
+			metricLabels.models[m] = true
+		}
+	}
+	delete(metricLabels.models, "")
+	delete(metricLabels.models, "*")
+
+	metricLabels.keys = make(map[string]bool)
+	for _, key := range strings.Split(getEnv("METRICS_KEY_LABELS", ""), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			metricLabels.keys[key] = true
+		}
+	}
+}
+
+// 模型标签：未配置的模型记为other
+func modelLabel(model string) string {
+	if model == "" || metricLabels.models[model] {
+		return model
+	}
+	return "other"
+}
+
+// 调用方Key标签：只有METRICS_KEY_LABELS中列出的Key单独统计，其余记为other
+func keyLabel(key string) string {
+	if key == "anonymous" || metricLabels.keys[key] {
+		return key
+	}
+	return "other"
+}
+
+// 抓取时采集的仪表盘
+func collectGaugeMetrics() {
+	metricBreakerState.reset()
+	metricEndpointHealthy.reset()
+	metricOutstanding.reset()
+	for _, upstream := range upstreams {
+		for _, endpoint := range upstream.Endpoints {
+			status := endpoint.status()
+			state := 0.0
+			switch status.Breaker {
+			case breakerHalfOpen:
+				state = 1
+			case breakerOpen:
+				state = 2
+			}
+			healthy := 0.0
+			if status.Healthy {
+				healthy = 1
+			}
+			metricBreakerState.set(state, upstream.Name, endpoint.URL)
+			metricEndpointHealthy.set(healthy, upstream.Name, endpoint.URL)
+			metricOutstanding.set(float64(status.Outstanding), upstream.Name, endpoint.URL)
+		}
+	}
+	metricInflight.set(float64(inflightRequests.Load()))
+	for _, upstream := range upstreams {
+		if upstream.admission != nil {
+			queued, active := upstream.admission.depth()
+			metricQueueDepth.set(float64(queued), upstream.Name)
+			metricUpstreamActive.set(float64(active), upstream.Name)
+		}
+	}
+
+	metricTokenCache.mu.Lock()
+	var hits, total float64
+	for _, s := range metricTokenCache.series {
+		total += s.value
+		if s.labelValues[0] == "hit" {
+			hits += s.value
+		}
+	}
+	metricTokenCache.mu.Unlock()
+	if total > 0 {
+		metricTokenHitRatio.set(hits / total)
+	}
+}
+
+// 指标接口（GET /metrics）
+func metricsHandler(c *gin.Context) {
+	collectGaugeMetrics()
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, m := range metricsRegistry {
+		m.write(c.Writer)
+	}
+}
+
+// 记录每个请求的数量、延迟和Token用量
+func metricsMiddleware(c *gin.Context) {
+	c.Next()
+
+	info := getRequestInfo(c.Request.Context())
+	if info == nil {
+		return
+	}
+	snap := info.snapshot()
+	status := strconv.Itoa(c.Writer.Status())
+	model, key := modelLabel(snap.Model), keyLabel(snap.Key)
+	metricRequests.add(1, snap.Route, model, snap.Upstream, key, status)
+	metricRequestDuration.observe(time.Since(snap.Start).Seconds(), snap.Route, model, snap.Upstream, key, status)
+	if snap.PromptTokens > 0 {
+		metricTokens.add(float64(snap.PromptTokens), "input", model, key)
+	}
+	if snap.CompletionTokens > 0 {
+		metricTokens.add(float64(snap.CompletionTokens), "output", model, key)
+	}
+}
+
+// 流式响应的首Token、Token间隔和活跃流统计
+type streamMetrics struct {
+	route, model, upstream string
+	start, first, last     time.Time
+}
+
+func startStreamMetrics(info *requestInfo) *streamMetrics {
+	m := &streamMetrics{start: time.Now()}
+	if info != nil {
+		snap := info.snapshot()
+		m.route, m.model, m.upstream, m.start = snap.Route, modelLabel(snap.Model), snap.Upstream, snap.Start
+	}
+	metricActiveStreams.add(1, m.route)
+	return m
+}
+
+// 收到一个含内容的chunk
+func (m *streamMetrics) chunk() {
+	now := time.Now()
+	if m.last.IsZero() {
+		m.first = now
+		metricTTFT.observe(now.Sub(m.start).Seconds(), m.route, m.model, m.upstream)
+	} else {
+		metricInterToken.observe(now.Sub(m.last).Seconds(), m.route, m.model, m.upstream)
+	}
+	m.last = now
+}
+
+func (m *streamMetrics) done() {
+	metricActiveStreams.add(-1, m.route)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := &metricVec{name: "test_total", help: "Test counter.", typ: "counter", labels: []string{"a"}, series: map[string]*metricSeries{}}
+	counter.add(1, `x"y`)
+	counter.add(2, `x"y`)
+	histogram := &metricVec{name: "test_seconds", help: "Test histogram.", typ: "histogram", buckets: []float64{0.1, 1}, series: map[string]*metricSeries{}}
+	histogram.observe(0.05)
+	histogram.observe(0.5)
+	histogram.observe(5)
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x\"y"} 3
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestMetricLabelBounds(t *testing.T) {
+	t.Setenv("METRICS_KEY_LABELS", "key-1a2b3c4d")
+	startTestBackend(t, echoTarget)
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"已配置的模型", modelLabel("gpt-3.5-turbo"), "gpt-3.5-turbo"},
+		{"未配置的模型", modelLabel("random-model-123"), "other"},
+		{"列出的Key", keyLabel("key-1a2b3c4d"), "key-1a2b3c4d"},
+		{"未列出的Key", keyLabel("key-ffffffff"), "other"},
+		{"匿名", keyLabel("anonymous"), "anonymous"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Fatalf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	r := newRouter()
+	if w := serveRequest(r, http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	// 客户端传入的任意模型名不产生新的时间序列
+	serveRequest(r, http.MethodPost, "/chat/completions", `{"model":"made-up-model","messages":[{"role":"user","content":"hi"}]}`, nil)
+
+	w := serveRequest(r, http.MethodGet, "/metrics", "", nil)
+	body := w.Body.String()
+	for _, want := range []string{
+		`gateway_requests_total{route="/chat/completions",model="gpt-3.5-turbo",upstream="default",key="anonymous",status="200"}`,
+		`gateway_tokens_total{direction="input",model="gpt-3.5-turbo",key="anonymous"}`,
+		`gateway_token_cache_requests_total{result="miss"}`,
+		`gateway_endpoint_healthy{upstream="default",endpoint=`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("/metrics缺少%s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "made-up-model") {
+		t.Fatal("未配置的模型应记为other")
+	}
+}
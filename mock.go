@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mock子命令参数：模拟Token服务和目标服务的默认行为
+type mockOptions struct {
+	TokenAddr        string
+	TokenPath        string
+	TargetAddr       string
+	TargetPath       string
+	TokenTTL         time.Duration
+	TokenLatency     time.Duration
+	TokenErrorRate   float64
+	Latency          time.Duration // 非流式响应延迟、流式首个chunk前的延迟
+	ChunkSize        int           // 每个流式chunk的字符数
+	ChunkDelay       time.Duration
+	ErrorRate        float64
+	ErrorStatus      int
+	UnauthorizedRate float64
+	Script           string
+}
+
+// 脚本规则：按模型和消息内容匹配，覆盖默认行为（按顺序取第一条匹配的规则）
+type mockRule struct {
+	Model            string          `json:"model,omitempty"`
+	Contains         string          `json:"contains,omitempty"` // 最后一条消息包含的文本
+	Times            int             `json:"times,omitempty"`    // 最多生效次数，0表示不限
+	Latency          *Duration       `json:"latency,omitempty"`
+	ChunkSize        int             `json:"chunk_size,omitempty"`
+	ChunkDelay       *Duration       `json:"chunk_delay,omitempty"`
+	Status           int             `json:"status,omitempty"`     // 直接返回该状态码
+	ErrorRate        float64         `json:"error_rate,omitempty"` // 按比例返回Status（未配置Status时为500）
+	UnauthorizedRate float64         `json:"unauthorized_rate,omitempty"`
+	Content          *string         `json:"content,omitempty"`
+	ToolCalls        json.RawMessage `json:"tool_calls,omitempty"`
+	FinishReason     string          `json:"finish_reason,omitempty"`
+	CutAfter         int             `json:"cut_after,omitempty"` // 流式输出该数量的chunk后断开连接
+
+	hits int
+}
+
+// 模拟服务状态
+type mockServer struct {
+	opts  mockOptions
+	rules []*mockRule
+
+	mu     sync.Mutex
+	tokens map[string]time.Time // 已签发的Token→过期时间
+	stats  map[string]int
+}
+
+func (m *mockServer) count(name string) {
+	m.mu.Lock()
+	m.stats[name]++
+	m.mu.Unlock()
+}
+
+// 签发JWT格式的Token（exp为过期时间，签名部分为随机值，网关不校验签名）
+func (m *mockServer) issueToken() (string, time.Time) {
+	expiresAt := time.Now().Add(m.opts.TokenTTL)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{"sub": "mock", "exp": expiresAt.Unix(), "jti": generateRandomString()})
+	signature := base64.RawURLEncoding.EncodeToString([]byte(generateRandomString()))
+	token := header + "." + base64.RawURLEncoding.EncodeToString(claims) + "." + signature
+	m.mu.Lock()
+	m.tokens[token] = expiresAt
+	m.stats["tokens_issued"]++
+	m.mu.Unlock()
+	return token, expiresAt
+}
+
+func (m *mockServer) tokenValid(token string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiresAt, ok := m.tokens[token]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Token服务：返回getJWTToken期望的{"token": "..."}
+func (m *mockServer) tokenHandler(c *gin.Context) {
+	m.count("token_requests")
+	if !sleepContext(c.Request.Context(), m.opts.TokenLatency) {
+		return
+	}
+	if rand.Float64() < m.opts.TokenErrorRate {
+		m.count("token_errors")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "mock token error"})
+		return
+	}
+	token, expiresAt := m.issueToken()
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_in": int(time.Until(expiresAt).Seconds())})
+}
+
+// 取第一条匹配的规则（命中次数达到Times后不再生效）
+func (m *mockServer) match(model, lastMessage string) *mockRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rule := range m.rules {
+		if rule.Model != "" && rule.Model != model {
+			continue
+		}
+		if rule.Contains != "" && !strings.Contains(lastMessage, rule.Contains) {
+			continue
+		}
+		if rule.Times > 0 && rule.hits >= rule.Times {
+			continue
+		}
+		rule.hits++
+		return rule
+	}
+	return nil
+}
+
+// 目标服务：非流式返回{content, tool_calls, finish_reason, prompt_tokens, completion_tokens}，
+// 流式返回"data: {content}"行，最后一个chunk携带finish_reason和用量，以"data: [DONE]"结束
+func (m *mockServer) targetHandler(c *gin.Context) {
+	m.count("target_requests")
+	var req map[string]interface{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		m.count("bad_requests")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid json: " + err.Error()})
+		return
+	}
+	model := stringValue(req["model"])
+	stream, _ := req["stream"].(bool)
+	prompt, lastMessage := mockPromptText(req["messages"])
+
+	rule := m.match(model, lastMessage)
+	if rule == nil {
+		rule = &mockRule{}
+	}
+	latency, chunkSize, chunkDelay := m.opts.Latency, m.opts.ChunkSize, m.opts.ChunkDelay
+	if rule.Latency != nil {
+		latency = time.Duration(*rule.Latency)
+	}
+	if rule.ChunkSize > 0 {
+		chunkSize = rule.ChunkSize
+	}
+	if rule.ChunkDelay != nil {
+		chunkDelay = time.Duration(*rule.ChunkDelay)
+	}
+
+	// 认证：Token须由本服务签发且未过期；按比例模拟401
+	if !m.tokenValid(c.GetHeader("X-Trust-Token")) || rand.Float64() < max(m.opts.UnauthorizedRate, rule.UnauthorizedRate) {
+		m.count("unauthorized")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token invalid or expired"})
+		return
+	}
+	// 错误注入
+	status := rule.Status
+	switch {
+	case rule.ErrorRate > 0:
+		status = 0
+		if rand.Float64() < rule.ErrorRate {
+			status = rule.Status
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+		}
+	case status == 0 && rand.Float64() < m.opts.ErrorRate:
+		status = m.opts.ErrorStatus
+	}
+	if !sleepContext(c.Request.Context(), latency) {
+		return
+	}
+	if status >= http.StatusBadRequest {
+		m.count("errors")
+		c.JSON(status, gin.H{"error": fmt.Sprintf("mock error %d", status)})
+		return
+	}
+
+	content := "Mock回复：" + lastMessage
+	if rule.Content != nil {
+		content = *rule.Content
+	}
+	finishReason := rule.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+		if len(rule.ToolCalls) > 0 {
+			finishReason = "tool_calls"
+		}
+	}
+	promptTokens, completionTokens := mockTokenCount(prompt), mockTokenCount(content)
+
+	if !stream {
+		resp := gin.H{"content": content, "finish_reason": finishReason, "prompt_tokens": promptTokens, "completion_tokens": completionTokens}
+		if len(rule.ToolCalls) > 0 {
+			resp["tool_calls"] = rule.ToolCalls
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	writeChunk := func(chunk gin.H) {
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		c.Writer.Flush()
+	}
+	chunks := 0
+	for rest := content; rest != ""; {
+		n := 0
+		for i := 0; i < chunkSize && n < len(rest); i++ {
+			_, size := utf8.DecodeRuneInString(rest[n:])
+			n += size
+		}
+		if chunks > 0 && !sleepContext(c.Request.Context(), chunkDelay) {
+			return
+		}
+		writeChunk(gin.H{"content": rest[:n]})
+		rest = rest[n:]
+		chunks++
+		if rule.CutAfter > 0 && chunks >= rule.CutAfter {
+			// 模拟连接中断：不发送结束chunk，由net/http直接断开连接
+			m.count("cut_streams")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	final := gin.H{"content": "", "finish_reason": finishReason, "prompt_tokens": promptTokens, "completion_tokens": completionTokens}
+	if len(rule.ToolCalls) > 0 {
+		final["tool_calls"] = rule.ToolCalls
+	}
+	writeChunk(final)
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+// 拼接全部消息文本（用于估算用量），并返回最后一条消息的文本
+func mockPromptText(v interface{}) (string, string) {
+	messages, _ := v.([]interface{})
+	var all []string
+	last := ""
+	for _, item := range messages {
+		msg, _ := item.(map[string]interface{})
+		switch content := msg["content"].(type) {
+		case string:
+			last = content
+		case []interface{}:
+			var parts []string
+			for _, part := range content {
+				if p, ok := part.(map[string]interface{}); ok {
+					parts = append(parts, stringValue(p["text"]))
+				}
+			}
+			last = strings.Join(parts, "")
+		default:
+			last = ""
+		}
+		all = append(all, last)
+	}
+	return strings.Join(all, "\n"), last
+}
+
+// 粗略估算Token数（约4个字符一个Token）
+func mockTokenCount(s string) int {
+	return utf8.RuneCountInString(s)/4 + 1
+}
+
+// 监听地址对应的本地URL
+func mockURL(addr, path string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "http://" + addr + path
+}
+
+func (m *mockServer) statsHandler(c *gin.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.JSON(http.StatusOK, m.stats)
+}
+
+// mock子命令：启动模拟Token服务和目标服务，用于本地开发和自动化测试
+// 默认地址与TOKEN_URL、TARGET_URL的默认值一致，网关无需额外配置即可连接
+func runMockCommand(args []string) int {
+	var opts mockOptions
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	fs.StringVar(&opts.TokenAddr, "token-addr", ":8000", "Token服务监听地址")
+	fs.StringVar(&opts.TokenPath, "token-path", "/api/get-jwt", "Token服务路径")
+	fs.StringVar(&opts.TargetAddr, "target-addr", ":8001", "目标服务监听地址（与Token服务相同时共用一个端口）")
+	fs.StringVar(&opts.TargetPath, "target-path", "/api/ai-call", "目标服务路径")
+	fs.DurationVar(&opts.TokenTTL, "token-ttl", 10*time.Minute, "Token有效期（过期后目标服务返回401）")
+	fs.DurationVar(&opts.TokenLatency, "token-latency", 0, "Token服务响应延迟")
+	fs.Float64Var(&opts.TokenErrorRate, "token-error-rate", 0, "Token服务返回500的比例")
+	fs.DurationVar(&opts.Latency, "latency", 50*time.Millisecond, "目标服务响应延迟（流式为首个chunk前的延迟）")
+	fs.IntVar(&opts.ChunkSize, "chunk-size", 4, "每个流式chunk的字符数")
+	fs.DurationVar(&opts.ChunkDelay, "chunk-delay", 20*time.Millisecond, "流式chunk之间的间隔")
+	fs.Float64Var(&opts.ErrorRate, "error-rate", 0, "目标服务返回错误的比例")
+	fs.IntVar(&opts.ErrorStatus, "error-status", http.StatusInternalServerError, "注入错误时返回的状态码")
+	fs.Float64Var(&opts.UnauthorizedRate, "unauthorized-rate", 0, "目标服务随机返回401的比例")
+	fs.StringVar(&opts.Script, "script", "", "脚本规则JSON文件（按模型和消息内容覆盖行为）")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 1
+	}
+
+	m := &mockServer{opts: opts, tokens: map[string]time.Time{}, stats: map[string]int{}}
+	if opts.Script != "" {
+		data, err := os.ReadFile(opts.Script)
+		if err == nil {
+			err = json.Unmarshal(data, &m.rules)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "读取脚本规则失败: %s\n", err)
+			return 2
+		}
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	// 不使用gin.Recovery：模拟连接中断的http.ErrAbortHandler需要交给net/http处理
+	tokenRouter := gin.New()
+	tokenRouter.Any(opts.TokenPath, m.tokenHandler)
+	tokenRouter.GET("/mock/stats", m.statsHandler)
+	targetRouter := tokenRouter
+	if opts.TargetAddr != opts.TokenAddr {
+		targetRouter = gin.New()
+		targetRouter.GET("/mock/stats", m.statsHandler)
+	}
+	targetRouter.POST(opts.TargetPath, m.targetHandler)
+
+	servers := []*http.Server{{Addr: opts.TokenAddr, Handler: tokenRouter}}
+	if targetRouter != tokenRouter {
+		servers = append(servers, &http.Server{Addr: opts.TargetAddr, Handler: targetRouter})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}(srv)
+	}
+	fmt.Fprintf(os.Stderr, "模拟Token服务：%s\n", mockURL(opts.TokenAddr, opts.TokenPath))
+	fmt.Fprintf(os.Stderr, "模拟目标服务：%s（统计：/mock/stats）\n", mockURL(opts.TargetAddr, opts.TargetPath))
+
+	code := 0
+	select {
+	case <-ctx.Done():
+	case err := <-errs:
+		fmt.Fprintf(os.Stderr, "启动模拟服务失败: %s\n", err)
+		code = 1
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+	return code
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 启动模拟Token服务和目标服务，并让网关连接到它们
+func startMockBackend(t *testing.T, opts mockOptions, rules []*mockRule) *mockServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	if opts.TokenTTL == 0 {
+		opts.TokenTTL = time.Minute
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 4
+	}
+	m := &mockServer{opts: opts, rules: rules, tokens: map[string]time.Time{}, stats: map[string]int{}}
+	r := gin.New()
+	r.POST("/token", m.tokenHandler)
+	r.POST("/target", m.targetHandler)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	oldConfig, oldUpstreams, oldRoutes := config, upstreams, routes
+	t.Cleanup(func() { config, upstreams, routes = oldConfig, oldUpstreams, oldRoutes })
+	t.Setenv("TOKEN_URL", srv.URL+"/token")
+	t.Setenv("TARGET_URL", srv.URL+"/target")
+	initGateway()
+	tokenCache.mu.Lock()
+	tokenCache.token, tokenCache.expiresAt = "", time.Time{}
+	tokenCache.mu.Unlock()
+	return m
+}
+
+func (m *mockServer) stat(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats[name]
+}
+
+func TestMockServer(t *testing.T) {
+	m := startMockBackend(t, mockOptions{ChunkSize: 2}, nil)
+	router := newRouter()
+
+	w := serveRequest(router, http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Choices[0].Message.Content != "Mock回复：hi" {
+		t.Fatalf("response = %s", w.Body)
+	}
+
+	// 流式按chunk-size分段输出，网关拼接后内容一致
+	w = serveRequest(router, http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","stream":true,"messages":[{"role":"user","content":"hi"}]}`, nil)
+	var content strings.Builder
+	for _, event := range sseData(w.Body.String()) {
+		choices, _ := event["choices"].([]interface{})
+		if len(choices) == 0 {
+			continue
+		}
+		delta, _ := choices[0].(map[string]interface{})["delta"].(map[string]interface{})
+		text, _ := delta["content"].(string)
+		content.WriteString(text)
+	}
+	if content.String() != "Mock回复：hi" {
+		t.Fatalf("stream content = %q", content.String())
+	}
+	if m.stat("tokens_issued") != 1 || m.stat("target_requests") != 2 {
+		t.Fatalf("stats = %v", m.stats)
+	}
+}
+
+func TestMockScriptRules(t *testing.T) {
+	content := "scripted"
+	rules := []*mockRule{
+		{Contains: "flaky", Status: http.StatusServiceUnavailable, Times: 1},
+		{Model: "gpt-3.5-turbo", Content: &content},
+	}
+	m := startMockBackend(t, mockOptions{}, rules)
+	router := newRouter()
+
+	// 第一次匹配返回503，网关重试后命中第二条规则
+	w := serveRequest(router, http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"flaky"}]}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "scripted") {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if m.stat("errors") != 1 || m.stat("target_requests") != 2 {
+		t.Fatalf("stats = %v", m.stats)
+	}
+}
+
+func TestMockRejectsUnknownToken(t *testing.T) {
+	m := &mockServer{opts: mockOptions{TokenTTL: time.Minute, ChunkSize: 1}, tokens: map[string]time.Time{}, stats: map[string]int{}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", m.targetHandler)
+	w := serveRequest(r, http.MethodPost, "/", `{"model":"m","messages":[]}`, map[string]string{"X-Trust-Token": "forged"})
+	if w.Code != http.StatusUnauthorized || m.stat("unauthorized") != 1 {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	token, _ := m.issueToken()
+	w = serveRequest(r, http.MethodPost, "/", `{"model":"m","messages":[]}`, map[string]string{"X-Trust-Token": token})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 兼容的Ollama版本号（部分编辑器插件会检查）
+const ollamaVersion = "0.5.7"
+
+// Ollama options到OpenAI参数的映射
+var ollamaOptionFields = map[string]string{
+	"temperature":       "temperature",
+	"top_p":             "top_p",
+	"num_predict":       "max_tokens",
+	"stop":              "stop",
+	"seed":              "seed",
+	"frequency_penalty": "frequency_penalty",
+	"presence_penalty":  "presence_penalty",
+}
+
+// 以Ollama错误格式返回给客户端
+func writeOllamaError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if pe, ok := err.(*proxyError); ok {
+		status = pe.Status
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// 规范化Ollama模型名（去掉默认的:latest标签），未配置的模型返回false
+func resolveOllamaModel(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ":latest")
+	for _, m := range config.Models {
+		if m == name {
+			return m, true
+		}
+	}
+	return name, false
+}
+
+// Ollama流式默认开启，未显式传入stream时视为true
+func ollamaStreamEnabled(request map[string]interface{}) bool {
+	s, ok := request["stream"]
+	if !ok || s == nil {
+		return true
+	}
+	isStream, _ := strconv.ParseBool(stringValue(s))
+	return isStream
+}
+
+// 将Ollama的base64图片转换为OpenAI的image_url内容块
+func ollamaImageParts(v interface{}) []map[string]interface{} {
+	images, _ := v.([]interface{})
+	var parts []map[string]interface{}
+	for _, image := range images {
+		data := stringValue(image)
+		mediaType := "image/png"
+		if decoded, err := base64.StdEncoding.DecodeString(data); err == nil {
+			mediaType = http.DetectContentType(decoded)
+		}
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": fmt.Sprintf("data:%s;base64,%s", mediaType, data)},
+		})
+	}
+	return parts
+}
+
+// 构建Ollama消息对应的OpenAI消息（带图片时使用内容块数组）
+func convertOllamaMessage(role, content string, images interface{}) map[string]interface{} {
+	imageParts := ollamaImageParts(images)
+	if len(imageParts) == 0 {
+		return map[string]interface{}{"role": role, "content": content}
+	}
+	parts := append([]map[string]interface{}{{"type": "text", "text": content}}, imageParts...)
+	return map[string]interface{}{"role": role, "content": parts}
+}
+
+// 将Ollama的options和format转换为OpenAI参数
+func applyOllamaOptions(chatRequest map[string]interface{}, ollamaRequest map[string]interface{}) {
+	if options, ok := ollamaRequest["options"].(map[string]interface{}); ok {
+		for from, to := range ollamaOptionFields {
+			if v, ok := options[from]; ok {
+				chatRequest[to] = v
+			}
+		}
+	}
+	switch format := ollamaRequest["format"].(type) {
+	case string:
+		if format == "json" {
+			chatRequest["response_format"] = map[string]interface{}{"type": "json_object"}
+		}
+	case map[string]interface{}:
+		chatRequest["response_format"] = map[string]interface{}{
+			"type":        "json_schema",
+			"json_schema": map[string]interface{}{"name": "response", "schema": format},
+		}
+	}
+}
+
+// 生成Ollama最终响应中的统计字段
+func ollamaDoneStats(start time.Time, finishReason string, promptTokens, completionTokens int) gin.H {
+	doneReason := "stop"
+	if finishReason == "length" {
+		doneReason = "length"
+	}
+	totalDuration := time.Since(start).Nanoseconds()
+	return gin.H{
+		"done":                 true,
+		"done_reason":          doneReason,
+		"total_duration":       totalDuration,
+		"load_duration":        0,
+		"prompt_eval_count":    promptTokens,
+		"prompt_eval_duration": 0,
+		"eval_count":           completionTokens,
+		"eval_duration":        totalDuration,
+	}
+}
+
+// 以NDJSON格式输出一行
+func writeNDJSON(c *gin.Context, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.Writer.Write(append(data, '\n'))
+	c.Writer.Flush()
+}
+
+// 流式调用目标服务，并把每段增量内容交给onDelta输出为NDJSON
+// 返回finish_reason和token用量（Content为空）；出错时已向客户端输出错误
+func streamOllama(c *gin.Context, chatRequest map[string]interface{}, onDelta func(content string)) (*targetResult, bool) {
+	resp, err := openTargetStream(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeOllamaError(c, err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	result := &targetResult{FinishReason: "stop"}
+	err = readTargetStream(c.Request.Context(), resp.Body, func(targetChunk map[string]interface{}) error {
+		if fr := stringValue(targetChunk["finish_reason"]); fr != "" {
+			result.FinishReason = fr
+		}
+		// 用量通常在最后一个chunk中给出
+		if n := intValue(targetChunk["prompt_tokens"]); n > 0 {
+			result.PromptTokens = n
+		}
+		if n := intValue(targetChunk["completion_tokens"]); n > 0 {
+			result.CompletionTokens = n
+		}
+		if content := stringValue(targetChunk["content"]); content != "" {
+			onDelta(content)
+		}
+		return nil
+	})
+	if err != nil {
+		if !clientGone(c.Request.Context()) {
+			writeNDJSON(c, gin.H{"error": err.Error()})
+		}
+		return nil, false
+	}
+	return result, true
+}
+
+// Ollama对话接口（/api/chat）
+func ollamaChatHandler(c *gin.Context) {
+	start := time.Now()
+	var ollamaRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&ollamaRequest); err != nil {
+		writeOllamaError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("解析请求体失败: %s", err)})
+		return
+	}
+	model, ok := resolveOllamaModel(stringValue(ollamaRequest["model"]))
+	if !ok {
+		writeOllamaError(c, &proxyError{http.StatusNotFound, "model_not_found", fmt.Sprintf("model '%s' not found", model)})
+		return
+	}
+
+	// 1. 转换消息
+	rawMessages, _ := ollamaRequest["messages"].([]interface{})
+	var messages []map[string]interface{}
+	for _, rawMessage := range rawMessages {
+		message, ok := rawMessage.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		messages = append(messages, convertOllamaMessage(stringValue(message["role"]), stringValue(message["content"]), message["images"]))
+	}
+	createdAt := func() string { return time.Now().UTC().Format(time.RFC3339Nano) }
+
+	// 没有消息时Ollama视为加载模型，直接返回done
+	if len(messages) == 0 {
+		c.JSON(http.StatusOK, gin.H{"model": model, "created_at": createdAt(), "message": gin.H{"role": "assistant", "content": ""}, "done_reason": "load", "done": true})
+		return
+	}
+
+	chatRequest := map[string]interface{}{"model": model, "messages": messages}
+	applyOllamaOptions(chatRequest, ollamaRequest)
+	prepareTargetRequest(chatRequest)
+
+	// 2. 流式：NDJSON逐行输出
+	if ollamaStreamEnabled(ollamaRequest) {
+		result, ok := streamOllama(c, chatRequest, func(content string) {
+			writeNDJSON(c, gin.H{"model": servedModel(c.Request.Context(), model), "created_at": createdAt(), "message": gin.H{"role": "assistant", "content": content}, "done": false})
+		})
+		if ok {
+			final := ollamaDoneStats(start, result.FinishReason, result.PromptTokens, result.CompletionTokens)
+			final["model"] = servedModel(c.Request.Context(), model)
+			final["created_at"] = createdAt()
+			final["message"] = gin.H{"role": "assistant", "content": ""}
+			writeNDJSON(c, final)
+		}
+		return
+	}
+
+	// 3. 非流式
+	result, err := callTargetOnce(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeOllamaError(c, err)
+		return
+	}
+	final := ollamaDoneStats(start, result.FinishReason, result.PromptTokens, result.CompletionTokens)
+	final["model"] = servedModel(c.Request.Context(), model)
+	final["created_at"] = createdAt()
+	final["message"] = gin.H{"role": "assistant", "content": result.Content}
+	c.JSON(http.StatusOK, final)
+}
+
+// Ollama文本生成接口（/api/generate）
+func ollamaGenerateHandler(c *gin.Context) {
+	start := time.Now()
+	var ollamaRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&ollamaRequest); err != nil {
+		writeOllamaError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("解析请求体失败: %s", err)})
+		return
+	}
+	model, ok := resolveOllamaModel(stringValue(ollamaRequest["model"]))
+	if !ok {
+		writeOllamaError(c, &proxyError{http.StatusNotFound, "model_not_found", fmt.Sprintf("model '%s' not found", model)})
+		return
+	}
+	createdAt := func() string { return time.Now().UTC().Format(time.RFC3339Nano) }
+
+	// 没有prompt时Ollama视为加载模型，直接返回done
+	prompt := stringValue(ollamaRequest["prompt"])
+	if prompt == "" && ollamaRequest["images"] == nil {
+		c.JSON(http.StatusOK, gin.H{"model": model, "created_at": createdAt(), "response": "", "done_reason": "load", "done": true})
+		return
+	}
+
+	// 1. 构建chat请求：system + prompt（suffix用于代码补全的中间填充）
+	var messages []map[string]interface{}
+	system := stringValue(ollamaRequest["system"])
+	if suffix := stringValue(ollamaRequest["suffix"]); suffix != "" {
+		system = strings.TrimSpace(system + "\n" + completionSystemPrompt + " The continuation will be immediately followed by the text below, so it must connect naturally to it:\n" + suffix)
+	}
+	if system != "" {
+		messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+	}
+	messages = append(messages, convertOllamaMessage("user", prompt, ollamaRequest["images"]))
+	chatRequest := map[string]interface{}{"model": model, "messages": messages}
+	applyOllamaOptions(chatRequest, ollamaRequest)
+	prepareTargetRequest(chatRequest)
+
+	// 2. 流式：NDJSON逐行输出
+	if ollamaStreamEnabled(ollamaRequest) {
+		result, ok := streamOllama(c, chatRequest, func(content string) {
+			writeNDJSON(c, gin.H{"model": servedModel(c.Request.Context(), model), "created_at": createdAt(), "response": content, "done": false})
+		})
+		if ok {
+			final := ollamaDoneStats(start, result.FinishReason, result.PromptTokens, result.CompletionTokens)
+			final["model"] = servedModel(c.Request.Context(), model)
+			final["created_at"] = createdAt()
+			final["response"] = ""
+			writeNDJSON(c, final)
+		}
+		return
+	}
+
+	// 3. 非流式
+	result, err := callTargetOnce(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeOllamaError(c, err)
+		return
+	}
+	final := ollamaDoneStats(start, result.FinishReason, result.PromptTokens, result.CompletionTokens)
+	final["model"] = servedModel(c.Request.Context(), model)
+	final["created_at"] = createdAt()
+	final["response"] = result.Content
+	c.JSON(http.StatusOK, final)
+}
+
+// 生成模型的伪digest（按模型名哈希，保证稳定）
+func ollamaModelDigest(model string) string {
+	sum := sha256.Sum256([]byte(model))
+	return hex.EncodeToString(sum[:])
+}
+
+// 模型详情（网关无法得知真实参数，使用固定描述）
+func ollamaModelDetails() gin.H {
+	return gin.H{
+		"parent_model":       "",
+		"format":             "gateway",
+		"family":             "gateway",
+		"families":           []string{"gateway"},
+		"parameter_size":     "",
+		"quantization_level": "",
+	}
+}
+
+// Ollama模型列表接口（/api/tags）
+func ollamaTagsHandler(c *gin.Context) {
+	modifiedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	models := make([]gin.H, 0, len(config.Models))
+	for _, m := range config.Models {
+		models = append(models, gin.H{
+			"name":        m,
+			"model":       m,
+			"modified_at": modifiedAt,
+			"size":        0,
+			"digest":      ollamaModelDigest(m),
+			"details":     ollamaModelDetails(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// Ollama模型详情接口（/api/show）
+func ollamaShowHandler(c *gin.Context) {
+	var ollamaRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&ollamaRequest); err != nil {
+		writeOllamaError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("解析请求体失败: %s", err)})
+		return
+	}
+	name := stringValue(ollamaRequest["model"])
+	if name == "" {
+		name = stringValue(ollamaRequest["name"])
+	}
+	model, ok := resolveOllamaModel(name)
+	if !ok {
+		writeOllamaError(c, &proxyError{http.StatusNotFound, "model_not_found", fmt.Sprintf("model '%s' not found", model)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"modelfile":    fmt.Sprintf("FROM %s\n", model),
+		"parameters":   "",
+		"template":     "{{ .Prompt }}",
+		"details":      ollamaModelDetails(),
+		"model_info":   gin.H{"general.architecture": "gateway", "general.basename": model},
+		"capabilities": []string{"completion"},
+		"modified_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Ollama版本接口（/api/version）
+func ollamaVersionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": ollamaVersion})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 解析NDJSON响应的每一行
+func ndjsonLines(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %s", line, err)
+		}
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestOllamaStreamUsage(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"chat", `{"model":"gpt-3.5-turbo:latest","messages":[{"role":"user","content":"hi"}]}`, "message"},
+		{"generate", `{"model":"gpt-3.5-turbo","prompt":"hi"}`, "response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestBackend(t, echoTarget)
+			handler := ollamaChatHandler
+			if tt.name == "generate" {
+				handler = ollamaGenerateHandler
+			}
+			w := serveJSON(handler, tt.body)
+			lines := ndjsonLines(t, w.Body.String())
+			var text string
+			for _, line := range lines[:len(lines)-1] {
+				if tt.field == "message" {
+					text += stringValue(line["message"].(map[string]interface{})["content"])
+				} else {
+					text += stringValue(line["response"])
+				}
+			}
+			final := lines[len(lines)-1]
+			if text != "echo:hi" || final["done"] != true || final["done_reason"] != "stop" {
+				t.Fatalf("text = %q, final = %v", text, final)
+			}
+			// 流式最后一行也要带上目标服务返回的用量
+			if intValue(final["prompt_eval_count"]) != 3 || intValue(final["eval_count"]) != len("echo:hi") {
+				t.Fatalf("final = %v", final)
+			}
+		})
+	}
+}
+
+func TestOllamaChat(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"非流式", `{"model":"gpt-3.5-turbo","stream":false,"messages":[{"role":"user","content":"hi"}]}`, 200, "echo:hi"},
+		{"未配置的模型", `{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`, 404, ""},
+		{"空消息视为加载", `{"model":"gpt-3.5-turbo","messages":[]}`, 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveJSON(ollamaChatHandler, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != 200 {
+				return
+			}
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if content := resp["message"].(map[string]interface{})["content"]; content != tt.want || resp["done"] != true {
+				t.Fatalf("response = %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestApplyOllamaOptions(t *testing.T) {
+	chatRequest := map[string]interface{}{}
+	var ollamaRequest map[string]interface{}
+	json.Unmarshal([]byte(`{"options":{"temperature":0.2,"num_predict":64,"num_ctx":4096},"format":"json"}`), &ollamaRequest)
+	applyOllamaOptions(chatRequest, ollamaRequest)
+	if chatRequest["temperature"] != 0.2 || chatRequest["max_tokens"] != float64(64) || chatRequest["num_ctx"] != nil {
+		t.Fatalf("chatRequest = %v", chatRequest)
+	}
+	if format := chatRequest["response_format"].(map[string]interface{}); format["type"] != "json_object" {
+		t.Fatalf("response_format = %v", format)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 是否正在停机排空（排空期间就绪检查失败，编排系统不再分配新流量）
+var draining atomic.Bool
+
+// 标记实例进入排空状态
+func setDraining() {
+	draining.Store(true)
+}
+
+// 单项就绪检查结果
+type readyCheck struct {
+	Status string `json:"status"` // ok、degraded或fail（degraded不影响就绪）
+	Detail string `json:"detail,omitempty"`
+}
+
+func checkOK(detail string) readyCheck {
+	return readyCheck{Status: "ok", Detail: detail}
+}
+
+func checkDegraded(detail string) readyCheck {
+	return readyCheck{Status: "degraded", Detail: detail}
+}
+
+func checkFail(detail string) readyCheck {
+	return readyCheck{Status: "fail", Detail: detail}
+}
+
+// 配置检查：Token服务和至少一个上游已配置
+func checkConfig() readyCheck {
+	if config.TokenURL == "" {
+		return checkFail("未配置TOKEN_URL")
+	}
+	if len(upstreams) == 0 {
+		return checkFail("未配置上游")
+	}
+	return checkOK("")
+}
+
+// Token检查：只查看缓存状态，不为每次探测请求Token服务
+// 没有缓存的Token时（未开启缓存、尚未请求或已过期）报告degraded，附带最近一次获取失败的原因
+func checkToken() readyCheck {
+	tokenCache.mu.Lock()
+	cached := tokenCache.token != "" && time.Now().Before(tokenCache.expiresAt)
+	lastError := tokenCache.lastError
+	tokenCache.mu.Unlock()
+	if cached {
+		return checkOK("cached")
+	}
+	if lastError != "" {
+		return checkDegraded("not cached，最近一次获取失败: " + lastError)
+	}
+	return checkDegraded("not cached")
+}
+
+// 上游检查：每个路由的故障转移链中至少有一个上游有可用副本（未配置路由时检查默认上游）
+func checkUpstreams() readyCheck {
+	if len(routes) == 0 {
+		if !defaultUpstream().healthy() {
+			return checkFail("上游" + defaultUpstream().Name + "没有可用副本")
+		}
+		return checkOK("")
+	}
+	for _, route := range routes {
+		ok := false
+		for _, target := range route.resolve(route.Model) {
+			if target.Upstream.healthy() {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return checkFail("路由" + route.Model + "没有可用上游")
+		}
+	}
+	return checkOK("")
+}
+
+// 存活检查（GET /livez）：进程能处理请求即存活
+func livezHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// 就绪检查（GET /readyz）：返回各项检查结果，任一失败时返回503
+func readyzHandler(c *gin.Context) {
+	checks := map[string]readyCheck{
+		"config":    checkConfig(),
+		"token":     checkToken(),
+		"upstreams": checkUpstreams(),
+		"draining":  checkOK(""),
+	}
+	if draining.Load() {
+		checks["draining"] = checkFail("实例正在停机")
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Status == "fail" {
+			status, code = "not_ready", http.StatusServiceUnavailable
+			break
+		}
+		if check.Status == "degraded" {
+			status = "degraded"
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks, "time": time.Now().Format(time.RFC3339)})
+}
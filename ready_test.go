@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 清空Token缓存，测试结束后恢复为空
+func resetTokenCache(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		tokenCache.mu.Lock()
+		tokenCache.token, tokenCache.expiresAt, tokenCache.lastError = "", time.Time{}, ""
+		tokenCache.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func()
+		status    int
+		want      string
+		wantToken string
+	}{
+		{"Token未缓存时降级但就绪", func() {}, http.StatusOK, "degraded", "degraded"},
+		{"最近一次获取失败时降级", func() { tokenCache.lastError = "connection refused" }, http.StatusOK, "degraded", "degraded"},
+		{"Token已缓存", func() { tokenCache.token, tokenCache.expiresAt = "t", time.Now().Add(time.Hour) }, http.StatusOK, "ready", "ok"},
+		{"上游没有可用副本", func() {
+			tokenCache.token, tokenCache.expiresAt = "t", time.Now().Add(time.Hour)
+			for _, e := range defaultUpstream().Endpoints {
+				e.health.healthy = false
+			}
+		}, http.StatusServiceUnavailable, "not_ready", "ok"},
+		{"停机排空", func() { draining.Store(true) }, http.StatusServiceUnavailable, "not_ready", "degraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestBackend(t, echoTarget)
+			// 就绪检查不应请求Token服务
+			var tokenHits int64
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&tokenHits, 1)
+				w.Write([]byte(`{"token":"t"}`))
+			}))
+			defer tokenServer.Close()
+			config.TokenURL = tokenServer.URL
+			resetTokenCache(t)
+			t.Cleanup(func() { draining.Store(false) })
+			tt.setup()
+
+			w := serveRequest(newRouter(), http.MethodGet, "/readyz", "", nil)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var resp struct {
+				Status string                `json:"status"`
+				Checks map[string]readyCheck `json:"checks"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Status != tt.want || resp.Checks["token"].Status != tt.wantToken {
+				t.Fatalf("readyz = %s", w.Body)
+			}
+			if n := atomic.LoadInt64(&tokenHits); n != 0 {
+				t.Fatalf("就绪检查请求了Token服务%d次", n)
+			}
+		})
+	}
+}
+
+func TestLivez(t *testing.T) {
+	startTestBackend(t, echoTarget)
+	draining.Store(true)
+	defer draining.Store(false)
+	if w := serveRequest(newRouter(), http.MethodGet, "/livez", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("排空期间存活检查仍应返回200，got %d", w.Code)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 录制/回放模式
+const (
+	recordModeRecord = "record" // 调用真实服务，并将交互保存为fixture
+	recordModeReplay = "replay" // 不访问网络，从fixture返回响应
+)
+
+// 录制/回放配置（RECORD_MODE为空时关闭）
+var recording struct {
+	mode   string
+	dir    string
+	timing bool            // 回放时按录制的时间间隔输出
+	ignore map[string]bool // 匹配时忽略的请求体顶层字段
+
+	mu     sync.Mutex
+	replay map[string]int // fixture→下一次回放的响应下标
+}
+
+// 一个fixture：同一规范化请求的全部录制响应（回放时依次循环使用）
+type fixture struct {
+	Method    string             `json:"method"`
+	Path      string             `json:"path"`
+	Body      json.RawMessage    `json:"body,omitempty"`
+	Responses []*fixtureResponse `json:"responses"`
+}
+
+type fixtureResponse struct {
+	Status   int               `json:"status"`
+	Header   map[string]string `json:"header,omitempty"`
+	HeaderMs int64             `json:"header_ms"` // 请求发出到收到响应头的时间
+	Chunks   []fixtureChunk    `json:"chunks"`
+}
+
+func (r *fixtureResponse) body() string {
+	var sb strings.Builder
+	for _, chunk := range r.Chunks {
+		sb.WriteString(chunk.Data)
+	}
+	return sb.String()
+}
+
+// 响应体的一段及其相对请求发出时间的偏移
+type fixtureChunk struct {
+	OffsetMs int64  `json:"offset_ms"`
+	Data     string `json:"data"`
+}
+
+type skipRecordingKey struct{}
+
+// 标记请求不参与录制/回放（如主动健康探测）
+func withoutRecording(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipRecordingKey{}, true)
+}
+
+// 初始化录制/回放：RECORD_MODE（record、replay）、FIXTURES_DIR、REPLAY_TIMING、REPLAY_IGNORE_FIELDS
+// 在Token、健康探测、目标服务和Embedding的HTTP客户端上安装录制/回放Transport（重复初始化时不重复安装）
+func initRecording() {
+	recording.mode = getEnv("RECORD_MODE", "")
+	if recording.mode == "" {
+		return
+	}
+	if recording.mode != recordModeRecord && recording.mode != recordModeReplay {
+		slog.Error("不支持的RECORD_MODE，已关闭录制/回放", "mode", recording.mode)
+		recording.mode = ""
+		return
+	}
+	recording.dir = getEnv("FIXTURES_DIR", "./fixtures")
+	recording.timing = getEnv("REPLAY_TIMING", "false") == "true"
+	recording.ignore = map[string]bool{}
+	for _, field := range strings.Split(getEnv("REPLAY_IGNORE_FIELDS", ""), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			recording.ignore[field] = true
+		}
+	}
+	recording.replay = map[string]int{}
+	if err := os.MkdirAll(recording.dir, 0o700); err != nil {
+		slog.Error("创建fixture目录失败，已关闭录制/回放", "dir", recording.dir, "error", err)
+		recording.mode = ""
+		return
+	}
+
+	for _, c := range []*http.Client{tokenClient, probeClient, targetClient, embeddingClient} {
+		if _, ok := c.Transport.(*recordingTransport); ok {
+			continue
+		}
+		next := c.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		c.Transport = &recordingTransport{next: next}
+	}
+	slog.Info("录制/回放模式", "mode", recording.mode, "dir", recording.dir, "timing", recording.timing)
+}
+
+// 规范化请求：方法、路径和去掉忽略字段、按键排序后的JSON请求体（非JSON按原文）
+func normalizeRequest(method, path string, body []byte) ([]byte, json.RawMessage) {
+	normalized := json.RawMessage(nil)
+	var v map[string]interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &v); err == nil {
+			for field := range recording.ignore {
+				delete(v, field)
+			}
+			normalized, _ = json.Marshal(v)
+		} else {
+			normalized, _ = json.Marshal(string(body))
+		}
+	}
+	key := append([]byte(method+" "+path+"\n"), normalized...)
+	return key, normalized
+}
+
+// 保存到fixture的请求体：脱敏其中的凭证（只用于阅读，匹配按未脱敏的规范化请求计算）
+func redactFixtureBody(body json.RawMessage) json.RawMessage {
+	if body == nil {
+		return nil
+	}
+	return json.RawMessage(redactSecrets(string(body)))
+}
+
+func fixturePath(key []byte) string {
+	sum := sha256.Sum256(key)
+	return filepath.Join(recording.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// 录制/回放Transport
+type recordingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(skipRecordingKey{}) != nil {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key, normalized := normalizeRequest(req.Method, req.URL.Path, body)
+	path := fixturePath(key)
+
+	if recording.mode == recordModeReplay {
+		return replayResponse(req, path)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	recorded := &fixtureResponse{Status: resp.StatusCode, Header: map[string]string{}, HeaderMs: time.Since(start).Milliseconds()}
+	for k := range resp.Header {
+		if !sensitiveLogKeys[strings.ToLower(k)] {
+			recorded.Header[k] = resp.Header.Get(k)
+		}
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		start:      start,
+		response:   recorded,
+		fixture:    &fixture{Method: req.Method, Path: req.URL.Path, Body: redactFixtureBody(normalized)},
+		path:       path,
+		redact:     req.URL.String() == config.TokenURL,
+	}
+	return resp, nil
+}
+
+// 录制响应体：每次读取记为一段，关闭时追加到fixture文件
+type recordingBody struct {
+	io.ReadCloser
+	once     sync.Once
+	start    time.Time
+	carry    []byte
+	response *fixtureResponse
+	fixture  *fixture
+	path     string
+	redact   bool // Token服务的响应：保存前脱敏，回放时使用占位Token
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		// 不完整的UTF-8字符留到下一段，保证fixture中的文本可读
+		data := append(b.carry, p[:n]...)
+		cut := len(data)
+		for i := 1; i <= 3 && i <= len(data); i++ {
+			if c := data[len(data)-i]; c >= 0xC0 {
+				if !utf8.FullRune(data[len(data)-i:]) {
+					cut = len(data) - i
+				}
+				break
+			} else if c < 0x80 {
+				break
+			}
+		}
+		b.carry = append([]byte(nil), data[cut:]...)
+		if cut > 0 {
+			b.response.Chunks = append(b.response.Chunks, fixtureChunk{OffsetMs: time.Since(b.start).Milliseconds(), Data: string(data[:cut])})
+		}
+	}
+	if err == io.EOF && len(b.carry) > 0 {
+		b.response.Chunks = append(b.response.Chunks, fixtureChunk{OffsetMs: time.Since(b.start).Milliseconds(), Data: string(b.carry)})
+		b.carry = nil
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(func() {
+		if b.redact {
+			for i := range b.response.Chunks {
+				b.response.Chunks[i].Data = redactSecrets(b.response.Chunks[i].Data)
+			}
+		}
+		if err := saveFixture(b.path, b.fixture, b.response); err != nil {
+			slog.Error("保存fixture失败", "path", b.path, "error", err)
+		}
+	})
+	return b.ReadCloser.Close()
+}
+
+// 将一次响应追加到fixture文件
+func saveFixture(path string, f *fixture, resp *fixtureResponse) error {
+	recording.mu.Lock()
+	defer recording.mu.Unlock()
+	if data, err := os.ReadFile(path); err == nil {
+		var existing fixture
+		if err := json.Unmarshal(data, &existing); err == nil {
+			f.Responses = existing.Responses
+		}
+	}
+	// 内容相同的响应只保留一份
+	for _, existing := range f.Responses {
+		if existing.Status == resp.Status && existing.body() == resp.body() {
+			return nil
+		}
+	}
+	f.Responses = append(f.Responses, resp)
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 从fixture构造响应；没有匹配的fixture时返回404
+func replayResponse(req *http.Request, path string) (*http.Response, error) {
+	recording.mu.Lock()
+	var f fixture
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+	var recorded *fixtureResponse
+	if err == nil && len(f.Responses) > 0 {
+		i := recording.replay[path] % len(f.Responses)
+		recording.replay[path]++
+		recorded = f.Responses[i]
+	}
+	recording.mu.Unlock()
+
+	if recorded == nil {
+		slog.Warn("回放模式下没有匹配的fixture", "method", req.Method, "path", req.URL.Path, "fixture", filepath.Base(path))
+		body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{
+			"message": fmt.Sprintf("回放模式下没有匹配的fixture（%s）", filepath.Base(path)),
+			"type":    "fixture_not_found",
+		}})
+		return &http.Response{
+			StatusCode:    http.StatusNotFound,
+			Status:        "404 Not Found",
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	start := time.Now()
+	if recording.timing && !sleepContext(req.Context(), time.Duration(recorded.HeaderMs)*time.Millisecond) {
+		return nil, req.Context().Err()
+	}
+	header := http.Header{}
+	for k, v := range recorded.Header {
+		header.Set(k, v)
+	}
+	header.Del("Content-Length")
+	return &http.Response{
+		StatusCode:    recorded.Status,
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &replayBody{ctx: req.Context(), start: start, chunks: recorded.Chunks},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// 回放响应体：按段输出，开启REPLAY_TIMING时等待到录制时的偏移
+type replayBody struct {
+	ctx     context.Context
+	start   time.Time
+	chunks  []fixtureChunk
+	pending []byte
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	if len(b.pending) == 0 {
+		if len(b.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if recording.timing {
+			wait := time.Until(b.start.Add(time.Duration(chunk.OffsetMs) * time.Millisecond))
+			if !sleepContext(b.ctx, wait) {
+				return 0, b.ctx.Err()
+			}
+		}
+		b.pending = []byte(chunk.Data)
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *replayBody) Close() error {
+	return nil
+}
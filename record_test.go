@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 开启录制/回放并启动测试后端，结束时恢复各HTTP客户端的Transport
+func startRecordingBackend(t *testing.T, mode, dir string, target http.HandlerFunc) *int64 {
+	t.Helper()
+	clients := []*http.Client{tokenClient, probeClient, targetClient, embeddingClient}
+	transports := make([]http.RoundTripper, len(clients))
+	for i, c := range clients {
+		transports[i] = c.Transport
+	}
+	t.Cleanup(func() {
+		for i, c := range clients {
+			c.Transport = transports[i]
+		}
+		recording.mode = ""
+	})
+	t.Setenv("RECORD_MODE", mode)
+	t.Setenv("FIXTURES_DIR", dir)
+	return startTestBackend(t, target)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	const body = `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"key sk-abcdefghijkl"}]}`
+
+	// 录制：fixture权限为0600，请求体和Token响应中的凭证已脱敏
+	startRecordingBackend(t, recordModeRecord, dir, echoTarget)
+	w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", body, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "echo:key sk-abcdefghijkl") {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) == 0 {
+		t.Fatal("没有生成fixture")
+	}
+	for _, name := range files {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != 0o600 {
+			t.Fatalf("%s mode = %o, want 600", name, st.Mode().Perm())
+		}
+		data, _ := os.ReadFile(name)
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			t.Fatalf("invalid fixture %s: %s", name, err)
+		}
+		if strings.Contains(string(f.Body), "sk-abcdefghijkl") || strings.Contains(f.Responses[0].body(), "test-token") {
+			t.Fatalf("fixture中包含凭证: %s", data)
+		}
+	}
+
+	// 回放：不访问目标服务，返回录制的响应
+	hits := startRecordingBackend(t, recordModeReplay, dir, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("回放模式不应访问目标服务")
+	})
+	w = serveRequest(newRouter(), http.MethodPost, "/chat/completions", body, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "echo:key sk-abcdefghijkl") {
+		t.Fatalf("replay status = %d: %s", w.Code, w.Body)
+	}
+	if atomic.LoadInt64(hits) != 0 {
+		t.Fatalf("target hits = %d", *hits)
+	}
+
+	// 没有匹配的fixture
+	w = serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"other"}]}`, nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing fixture status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// 请求级上下文信息：记录实际处理请求的上游和模型、用量等，供响应Header、指标和日志使用
+type requestInfo struct {
+	mu            sync.Mutex
+	header        http.Header // 客户端响应Header
+	requestHeader http.Header // 客户端请求Header
+	SessionID     string      // 客户端传入的x-usersession-id
+	CorrelationID string      // 关联ID：客户端传入的x-correlation-id或自动生成
+	Route         string      // 路由模板，如/chat/completions
+	Key           string      // 调用方API Key的标识（不含Key本身）
+	Start         time.Time
+
+	RequestedModel   string
+	Upstream         string
+	Model            string
+	Failover         []string // 故障转移经过的上游/模型及原因
+	PromptTokens     int
+	CompletionTokens int
+	FinishReason     string
+}
+
+type requestInfoKey struct{}
+
+// 为每个请求创建requestInfo并放入Request的Context
+func requestInfoMiddleware(c *gin.Context) {
+	info := &requestInfo{
+		header:        c.Writer.Header(),
+		requestHeader: c.Request.Header,
+		SessionID:     c.GetHeader(userSessionIDHeader),
+		CorrelationID: c.GetHeader(correlationIDHeader),
+		Route:         c.FullPath(),
+		Key:           apiKeyLabel(c.Request),
+		Start:         time.Now(),
+	}
+	if info.Route == "" {
+		info.Route = "unmatched"
+	}
+	if info.CorrelationID == "" || len(info.CorrelationID) > 128 {
+		info.CorrelationID = uuid.New().String()
+	}
+	c.Header(correlationIDHeader, info.CorrelationID)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestInfoKey{}, info))
+	c.Next()
+}
+
+// 从请求中取调用方API Key（Authorization: Bearer或x-api-key），返回其哈希标识；未携带时为anonymous
+func apiKeyLabel(r *http.Request) string {
+	key := callerAPIKey(r)
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// 从Context中取出requestInfo（不存在时返回nil）
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// 返回不含锁的副本
+func (info *requestInfo) snapshot() requestInfo {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return requestInfo{
+		SessionID:        info.SessionID,
+		CorrelationID:    info.CorrelationID,
+		Route:            info.Route,
+		Key:              info.Key,
+		Start:            info.Start,
+		RequestedModel:   info.RequestedModel,
+		Upstream:         info.Upstream,
+		Model:            info.Model,
+		Failover:         append([]string(nil), info.Failover...),
+		PromptTokens:     info.PromptTokens,
+		CompletionTokens: info.CompletionTokens,
+		FinishReason:     info.FinishReason,
+	}
+}
+
+// 记录实际处理请求的上游和模型，并写入响应Header
+func recordServedBy(ctx context.Context, upstream, model string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.Upstream = upstream
+	info.Model = model
+	info.header.Set("X-Gateway-Upstream", upstream)
+	if model != "" {
+		info.header.Set("X-Gateway-Model", model)
+	}
+}
+
+// 读取客户端请求Header
+func requestHeader(ctx context.Context, name string) string {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return ""
+	}
+	return info.requestHeader.Get(name)
+}
+
+// 设置客户端响应Header（须在写出响应前调用）
+func setResponseHeader(ctx context.Context, name, value string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.header.Set(name, value)
+}
+
+// 记录客户端请求的模型（一个请求多次调用目标服务时保留第一个）
+func recordRequestedModel(ctx context.Context, model string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.RequestedModel == "" {
+		info.RequestedModel = model
+	}
+}
+
+// 记录一次故障转移
+func recordFailover(ctx context.Context, from string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.Failover = append(info.Failover, from)
+	info.header.Add("X-Gateway-Failover", from)
+}
+
+// 累计目标服务返回的Token用量和结束原因（一个请求可能调用多次目标服务）
+func recordUsage(ctx context.Context, promptTokens, completionTokens int, finishReason string) {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.PromptTokens += promptTokens
+	info.CompletionTokens += completionTokens
+	if finishReason != "" {
+		info.FinishReason = finishReason
+	}
+}
+
+// 返回实际处理请求的模型，未经过网关转发时返回requested
+func servedModel(ctx context.Context, requested string) string {
+	info := getRequestInfo(ctx)
+	if info == nil {
+		return requested
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.Model == "" {
+		return requested
+	}
+	return info.Model
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Responses API不透传给目标服务的字段
+var responsesOnlyFields = map[string]bool{
+	"input":                true,
+	"instructions":         true,
+	"previous_response_id": true,
+	"store":                true,
+	"max_output_tokens":    true,
+	"metadata":             true,
+	"stream":               true,
+	"text":                 true,
+	"reasoning":            true,
+	"truncation":           true,
+	"include":              true,
+	"background":           true,
+}
+
+// 本地保存的Response（用于previous_response_id串联和查询）
+type storedResponse struct {
+	Response *ResponseObject
+	Messages []map[string]interface{} // 截至该Response的完整对话（不含instructions）
+	Owner    string                   // 创建该Response的调用方，只有同一调用方可以查询、删除和接续
+}
+
+var responseStore *lruCache[*storedResponse]
+
+// Response的归属：调用方API Key的完整SHA-256（不截断，避免不同调用方碰撞），未携带Key时为anonymous
+func responseOwner(r *http.Request) string {
+	key := callerAPIKey(r)
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// 按调用方读取本地保存的Response，属于其他调用方时视为不存在
+func getStoredResponse(c *gin.Context, id string) (*storedResponse, bool) {
+	stored, ok := responseStore.Get(id)
+	if !ok || stored.Owner != responseOwner(c.Request) {
+		return nil, false
+	}
+	return stored, true
+}
+
+// Response输出内容块
+type ResponseContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// Response输出项：message或function_call
+type ResponseOutputItem struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"`
+	Status  string            `json:"status"`
+	Role    string            `json:"role"`
+	Content []ResponseContent `json:"content"`
+
+	// function_call输出项的字段
+	CallID    string `json:"-"`
+	Name      string `json:"-"`
+	Arguments string `json:"-"`
+}
+
+// function_call输出项只输出工具调用相关字段
+func (item ResponseOutputItem) MarshalJSON() ([]byte, error) {
+	if item.Type == "function_call" {
+		return json.Marshal(map[string]interface{}{
+			"type":      item.Type,
+			"id":        item.ID,
+			"call_id":   item.CallID,
+			"name":      item.Name,
+			"arguments": item.Arguments,
+			"status":    item.Status,
+		})
+	}
+	type message ResponseOutputItem
+	return json.Marshal(message(item))
+}
+
+// Response对象
+type ResponseObject struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Error              interface{}          `json:"error"`
+	IncompleteDetails  interface{}          `json:"incomplete_details"`
+	Instructions       interface{}          `json:"instructions"`
+	MaxOutputTokens    interface{}          `json:"max_output_tokens"`
+	Model              string               `json:"model"`
+	Output             []ResponseOutputItem `json:"output"`
+	PreviousResponseID interface{}          `json:"previous_response_id"`
+	Temperature        interface{}          `json:"temperature"`
+	TopP               interface{}          `json:"top_p"`
+	Store              bool                 `json:"store"`
+	Metadata           interface{}          `json:"metadata"`
+	User               interface{}          `json:"user,omitempty"`
+	Usage              *ResponseUsage       `json:"usage"`
+}
+
+// Response的token用量
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// 初始化Responses API本地存储
+func initResponsesConfig() {
+	responseStore = newLRUCache[*storedResponse](
+		getEnvInt("RESPONSES_STORE_SIZE", 10000),
+		getEnvDuration("RESPONSES_STORE_TTL", time.Hour),
+	)
+}
+
+// 提取content中的文本：字符串或input_text/output_text内容块数组
+func responseContentText(v interface{}) (string, error) {
+	switch content := v.(type) {
+	case string:
+		return content, nil
+	case []interface{}:
+		var parts []string
+		for _, part := range content {
+			block, ok := part.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch stringValue(block["type"]) {
+			case "input_text", "output_text", "text":
+				parts = append(parts, stringValue(block["text"]))
+			default:
+				return "", fmt.Errorf("不支持的内容类型: %s", stringValue(block["type"]))
+			}
+		}
+		return strings.Join(parts, ""), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("content格式错误")
+	}
+}
+
+// 将input（字符串或输入项数组）转换为chat消息
+func convertResponseInput(v interface{}) ([]map[string]interface{}, error) {
+	switch input := v.(type) {
+	case string:
+		return []map[string]interface{}{{"role": "user", "content": input}}, nil
+	case []interface{}:
+		var messages []map[string]interface{}
+		for _, rawItem := range input {
+			item, ok := rawItem.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("input项格式错误")
+			}
+			itemType := stringValue(item["type"])
+			switch itemType {
+			case "", "message":
+				text, err := responseContentText(item["content"])
+				if err != nil {
+					return nil, err
+				}
+				role := stringValue(item["role"])
+				if role == "developer" {
+					role = "system"
+				}
+				messages = append(messages, map[string]interface{}{"role": role, "content": text})
+			case "function_call":
+				messages = append(messages, map[string]interface{}{
+					"role":    "assistant",
+					"content": "",
+					"tool_calls": []map[string]interface{}{{
+						"id":   stringValue(item["call_id"]),
+						"type": "function",
+						"function": map[string]interface{}{
+							"name":      stringValue(item["name"]),
+							"arguments": stringValue(item["arguments"]),
+						},
+					}},
+				})
+			case "function_call_output":
+				messages = append(messages, map[string]interface{}{
+					"role":         "tool",
+					"tool_call_id": stringValue(item["call_id"]),
+					"content":      stringValue(item["output"]),
+				})
+			default:
+				return nil, fmt.Errorf("不支持的input项类型: %s", itemType)
+			}
+		}
+		return messages, nil
+	default:
+		return nil, fmt.Errorf("input格式错误，应为字符串或数组")
+	}
+}
+
+// 将Responses格式的tools（{type:"function", name, description, parameters, strict}）转换为chat格式，
+// 已是chat格式（带function字段）的条目原样保留
+func convertResponseTools(v interface{}) ([]interface{}, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tools格式错误，应为数组")
+	}
+	tools := make([]interface{}, 0, len(items))
+	for _, rawItem := range items {
+		item, ok := rawItem.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tools项格式错误")
+		}
+		if toolType := stringValue(item["type"]); toolType != "function" {
+			return nil, fmt.Errorf("不支持的工具类型: %s", toolType)
+		}
+		if _, ok := item["function"]; ok {
+			tools = append(tools, item)
+			continue
+		}
+		function := map[string]interface{}{"name": item["name"]}
+		for _, field := range []string{"description", "parameters", "strict"} {
+			if value, ok := item[field]; ok {
+				function[field] = value
+			}
+		}
+		tools = append(tools, map[string]interface{}{"type": "function", "function": function})
+	}
+	return tools, nil
+}
+
+// 将Responses格式的tool_choice（{type:"function", name}）转换为chat格式，字符串原样保留
+func convertResponseToolChoice(v interface{}) interface{} {
+	choice, ok := v.(map[string]interface{})
+	if !ok || stringValue(choice["type"]) != "function" {
+		return v
+	}
+	if _, ok := choice["function"]; ok {
+		return v
+	}
+	return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": choice["name"]}}
+}
+
+// 工具调用对应的chat格式tool_calls（保存对话历史用）
+func chatToolCalls(toolCalls []targetToolCall) []map[string]interface{} {
+	calls := make([]map[string]interface{}, 0, len(toolCalls))
+	for _, call := range toolCalls {
+		calls = append(calls, map[string]interface{}{
+			"id":       call.ID,
+			"type":     "function",
+			"function": map[string]interface{}{"name": call.Name, "arguments": call.Arguments},
+		})
+	}
+	return calls
+}
+
+// Responses API（/v1/responses）：转换为chat请求后复用Token和转发流程
+func responsesHandler(c *gin.Context) {
+	// 1. 读取Responses格式请求
+	var responsesRequest map[string]interface{}
+	if err := c.ShouldBindJSON(&responsesRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("解析请求体失败: %s", err),
+				"type":    "invalid_request_error",
+			},
+		})
+		return
+	}
+
+	// 2. 组装对话历史：previous_response_id + input
+	var history []map[string]interface{}
+	previousID := stringValue(responsesRequest["previous_response_id"])
+	if previousID != "" {
+		previous, ok := getStoredResponse(c, previousID)
+		if !ok {
+			writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到previous_response_id对应的Response: %s", previousID)})
+			return
+		}
+		history = append(history, previous.Messages...)
+	}
+	inputMessages, err := convertResponseInput(responsesRequest["input"])
+	if err != nil {
+		writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", err.Error()})
+		return
+	}
+	history = append(history, inputMessages...)
+
+	// 3. 构建chat请求（instructions只作用于本次请求，不会被后续Response继承）
+	chatRequest := make(map[string]interface{}, len(responsesRequest)+1)
+	for k, v := range responsesRequest {
+		if !responsesOnlyFields[k] {
+			chatRequest[k] = v
+		}
+	}
+	messages := history
+	if instructions := stringValue(responsesRequest["instructions"]); instructions != "" {
+		messages = append([]map[string]interface{}{{"role": "system", "content": instructions}}, history...)
+	}
+	chatRequest["messages"] = messages
+	if rawTools, ok := responsesRequest["tools"]; ok {
+		tools, err := convertResponseTools(rawTools)
+		if err != nil {
+			writeProxyError(c, &proxyError{http.StatusBadRequest, "invalid_request_error", err.Error()})
+			return
+		}
+		chatRequest["tools"] = tools
+	}
+	if toolChoice, ok := responsesRequest["tool_choice"]; ok {
+		chatRequest["tool_choice"] = convertResponseToolChoice(toolChoice)
+	}
+	if maxOutputTokens, ok := responsesRequest["max_output_tokens"]; ok {
+		chatRequest["max_tokens"] = maxOutputTokens
+	}
+	model, _ := prepareTargetRequest(chatRequest)
+
+	store := true
+	if s, ok := responsesRequest["store"]; ok {
+		store, _ = strconv.ParseBool(stringValue(s))
+	}
+	isStream, _ := strconv.ParseBool(stringValue(responsesRequest["stream"]))
+
+	response := &ResponseObject{
+		ID:                 newObjectID("resp_"),
+		Object:             "response",
+		CreatedAt:          time.Now().Unix(),
+		Status:             "in_progress",
+		Instructions:       responsesRequest["instructions"],
+		MaxOutputTokens:    responsesRequest["max_output_tokens"],
+		Model:              model,
+		Output:             []ResponseOutputItem{},
+		PreviousResponseID: responsesRequest["previous_response_id"],
+		Temperature:        responsesRequest["temperature"],
+		TopP:               responsesRequest["top_p"],
+		Store:              store,
+		Metadata:           responsesRequest["metadata"],
+		User:               responsesRequest["user"],
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]interface{}{}
+	}
+
+	// 保存Response及其完整对话（含工具调用，便于下一轮以function_call_output接续）
+	saveResponse := func(outputText string, toolCalls []targetToolCall) {
+		if !store {
+			return
+		}
+		stored := &storedResponse{Response: response, Owner: responseOwner(c.Request)}
+		stored.Messages = append(stored.Messages, history...)
+		assistant := map[string]interface{}{"role": "assistant", "content": outputText}
+		if len(toolCalls) > 0 {
+			assistant["tool_calls"] = chatToolCalls(toolCalls)
+		}
+		stored.Messages = append(stored.Messages, assistant)
+		responseStore.Set(response.ID, stored)
+	}
+
+	if isStream {
+		streamResponse(c, chatRequest, response, saveResponse)
+		return
+	}
+
+	// 4. 非流式：调用目标服务并转换为Response对象
+	result, err := callTargetOnce(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	response.Model = servedModel(c.Request.Context(), response.Model)
+	completeResponse(response, newObjectID("msg_"), result.Content, result.ToolCalls, result.FinishReason, result.PromptTokens, result.CompletionTokens)
+	saveResponse(result.Content, result.ToolCalls)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// 填充Response的输出项、状态和用量：有文本（或没有工具调用）时输出message，随后每个工具调用输出一个function_call
+func completeResponse(response *ResponseObject, messageID, text string, toolCalls []targetToolCall, finishReason string, inputTokens, outputTokens int) {
+	response.Status = "completed"
+	if finishReason == "length" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = map[string]interface{}{"reason": "max_output_tokens"}
+	}
+	response.Output = []ResponseOutputItem{}
+	if text != "" || len(toolCalls) == 0 {
+		response.Output = append(response.Output, ResponseOutputItem{
+			Type:    "message",
+			ID:      messageID,
+			Status:  response.Status,
+			Role:    "assistant",
+			Content: []ResponseContent{{Type: "output_text", Text: text, Annotations: []interface{}{}}},
+		})
+	}
+	for _, call := range toolCalls {
+		callID := call.ID
+		if callID == "" {
+			callID = newObjectID("call_")
+		}
+		response.Output = append(response.Output, ResponseOutputItem{
+			Type:      "function_call",
+			ID:        newObjectID("fc_"),
+			Status:    "completed",
+			CallID:    callID,
+			Name:      call.Name,
+			Arguments: call.Arguments,
+		})
+	}
+	response.Usage = &ResponseUsage{
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		TotalTokens:  inputTokens + outputTokens,
+	}
+}
+
+// 流式Response：将目标SSE转换为Responses API的类型化事件序列
+// 文本到达时开始message输出项；工具调用在流结束后依次作为function_call输出项输出
+func streamResponse(c *gin.Context, chatRequest map[string]interface{}, response *ResponseObject, saveResponse func(string, []targetToolCall)) {
+	resp, err := openTargetStream(c.Request.Context(), chatRequest)
+	if err != nil {
+		writeProxyError(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	response.Model = servedModel(c.Request.Context(), response.Model)
+
+	setSSEHeaders(c)
+	c.Status(http.StatusOK)
+
+	sequence := 0
+	sendEvent := func(eventType string, payload map[string]interface{}) {
+		payload["type"] = eventType
+		payload["sequence_number"] = sequence
+		sequence++
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		c.Writer.WriteString(fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, string(data)))
+		c.Writer.Flush()
+	}
+
+	messageID := newObjectID("msg_")
+	messageStarted := false
+	startMessage := func() {
+		inProgressItem := ResponseOutputItem{Type: "message", ID: messageID, Status: "in_progress", Role: "assistant", Content: []ResponseContent{}}
+		emptyPart := ResponseContent{Type: "output_text", Text: "", Annotations: []interface{}{}}
+		sendEvent("response.output_item.added", map[string]interface{}{"output_index": 0, "item": inProgressItem})
+		sendEvent("response.content_part.added", map[string]interface{}{"item_id": messageID, "output_index": 0, "content_index": 0, "part": emptyPart})
+		messageStarted = true
+	}
+
+	sendEvent("response.created", map[string]interface{}{"response": response})
+	sendEvent("response.in_progress", map[string]interface{}{"response": response})
+
+	var text strings.Builder
+	var toolCalls toolCallAccumulator
+	finishReason := "stop"
+	inputTokens, outputTokens := 0, 0
+	err = readTargetStream(c.Request.Context(), resp.Body, func(targetChunk map[string]interface{}) error {
+		if fr := stringValue(targetChunk["finish_reason"]); fr != "" {
+			finishReason = fr
+		}
+		if n := intValue(targetChunk["prompt_tokens"]); n > 0 {
+			inputTokens = n
+		}
+		if n := intValue(targetChunk["completion_tokens"]); n > 0 {
+			outputTokens = n
+		}
+		toolCalls.add(targetChunk["tool_calls"])
+		delta := stringValue(targetChunk["content"])
+		if delta == "" {
+			return nil
+		}
+		if !messageStarted {
+			startMessage()
+		}
+		text.WriteString(delta)
+		sendEvent("response.output_text.delta", map[string]interface{}{"item_id": messageID, "output_index": 0, "content_index": 0, "delta": delta})
+		return nil
+	})
+	if err != nil {
+		if !clientGone(c.Request.Context()) {
+			response.Status = "failed"
+			response.Error = map[string]interface{}{"code": "server_error", "message": err.Error()}
+			sendEvent("response.failed", map[string]interface{}{"response": response})
+		}
+		return
+	}
+
+	calls := toolCalls.result()
+	completeResponse(response, messageID, text.String(), calls, finishReason, inputTokens, outputTokens)
+	for i, item := range response.Output {
+		if item.Type == "message" {
+			if !messageStarted {
+				startMessage()
+			}
+			sendEvent("response.output_text.done", map[string]interface{}{"item_id": messageID, "output_index": i, "content_index": 0, "text": text.String()})
+			sendEvent("response.content_part.done", map[string]interface{}{"item_id": messageID, "output_index": i, "content_index": 0, "part": item.Content[0]})
+			sendEvent("response.output_item.done", map[string]interface{}{"output_index": i, "item": item})
+			continue
+		}
+		inProgressItem := item
+		inProgressItem.Status, inProgressItem.Arguments = "in_progress", ""
+		sendEvent("response.output_item.added", map[string]interface{}{"output_index": i, "item": inProgressItem})
+		sendEvent("response.function_call_arguments.delta", map[string]interface{}{"item_id": item.ID, "output_index": i, "delta": item.Arguments})
+		sendEvent("response.function_call_arguments.done", map[string]interface{}{"item_id": item.ID, "output_index": i, "arguments": item.Arguments})
+		sendEvent("response.output_item.done", map[string]interface{}{"output_index": i, "item": item})
+	}
+	saveResponse(text.String(), calls)
+	if response.Status == "incomplete" {
+		sendEvent("response.incomplete", map[string]interface{}{"response": response})
+	} else {
+		sendEvent("response.completed", map[string]interface{}{"response": response})
+	}
+}
+
+// 查询本地保存的Response（GET /v1/responses/:id）
+func getResponseHandler(c *gin.Context) {
+	stored, ok := getStoredResponse(c, c.Param("id"))
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到Response: %s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, stored.Response)
+}
+
+// 删除本地保存的Response（DELETE /v1/responses/:id）
+func deleteResponseHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := getStoredResponse(c, id); !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到Response: %s", id)})
+		return
+	}
+	responseStore.Delete(id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "response.deleted", "deleted": true})
+}
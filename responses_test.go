@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newResponsesRouter(t *testing.T, target http.HandlerFunc) *gin.Engine {
+	t.Helper()
+	startTestBackend(t, target)
+	initResponsesConfig()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/responses", responsesHandler)
+	r.GET("/v1/responses/:id", getResponseHandler)
+	r.DELETE("/v1/responses/:id", deleteResponseHandler)
+	return r
+}
+
+// 目标服务：返回一个工具调用，流式请求在最后一个chunk中携带
+func toolCallTarget(w http.ResponseWriter, r *http.Request) {
+	req := readTargetRequest(r)
+	calls := []map[string]interface{}{{"id": "call_1", "type": "function", "function": map[string]interface{}{"name": "get_weather", "arguments": `{"city":"Paris"}`}}}
+	if stream, _ := req["stream"].(bool); stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		data, _ := json.Marshal(map[string]interface{}{"content": "", "tool_calls": calls, "finish_reason": "tool_calls", "prompt_tokens": 5, "completion_tokens": 7})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"content": "", "tool_calls": calls, "finish_reason": "tool_calls", "prompt_tokens": 5, "completion_tokens": 7})
+}
+
+func TestResponsesCreate(t *testing.T) {
+	r := newResponsesRouter(t, echoTarget)
+	w := serveRequest(r, http.MethodPost, "/v1/responses", `{"model":"m","input":"hi","instructions":"be brief"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp ResponseObject
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Status != "completed" || len(resp.Output) != 1 || resp.Output[0].Content[0].Text != "echo:hi" {
+		t.Fatalf("response = %s", w.Body)
+	}
+	if resp.Usage == nil || resp.Usage.InputTokens != 3 || resp.Usage.OutputTokens != len("echo:hi") {
+		t.Fatalf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestResponsesTools(t *testing.T) {
+	var forwarded map[string]interface{}
+	r := newResponsesRouter(t, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &forwarded)
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		toolCallTarget(w, req)
+	})
+
+	tools := `[{"type":"function","name":"get_weather","parameters":{"type":"object"}}]`
+	w := serveRequest(r, http.MethodPost, "/v1/responses", `{"model":"m","input":"weather?","tools":`+tools+`,"tool_choice":{"type":"function","name":"get_weather"}}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	tool := forwarded["tools"].([]interface{})[0].(map[string]interface{})
+	if tool["function"].(map[string]interface{})["name"] != "get_weather" {
+		t.Fatalf("forwarded tools = %v", forwarded["tools"])
+	}
+	if choice := forwarded["tool_choice"].(map[string]interface{}); choice["function"] == nil {
+		t.Fatalf("forwarded tool_choice = %v", choice)
+	}
+
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	output := resp["output"].([]interface{})
+	item := output[len(output)-1].(map[string]interface{})
+	if item["type"] != "function_call" || item["name"] != "get_weather" || item["call_id"] != "call_1" || item["arguments"] != `{"city":"Paris"}` {
+		t.Fatalf("function_call item = %v", item)
+	}
+
+	w = serveRequest(r, http.MethodPost, "/v1/responses", `{"model":"m","input":"x","tools":[{"type":"web_search"}]}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("不支持的工具类型应返回400，got %d", w.Code)
+	}
+}
+
+func TestResponsesStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		target http.HandlerFunc
+		want   []string // 必须依次出现的事件
+		usage  [2]int
+	}{
+		{"文本", echoTarget, []string{"response.created", "response.output_item.added", "response.output_text.delta", "response.output_text.done", "response.completed"}, [2]int{3, len("echo:hi")}},
+		{"工具调用", toolCallTarget, []string{"response.created", "response.output_item.added", "response.function_call_arguments.delta", "response.function_call_arguments.done", "response.output_item.done", "response.completed"}, [2]int{5, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResponsesRouter(t, tt.target)
+			w := serveRequest(r, http.MethodPost, "/v1/responses", `{"model":"m","input":"hi","stream":true}`, nil)
+			events := sseData(w.Body.String())
+			next := 0
+			var completed map[string]interface{}
+			for _, event := range events {
+				if next < len(tt.want) && event["type"] == tt.want[next] {
+					next++
+				}
+				if event["type"] == "response.completed" {
+					completed = event["response"].(map[string]interface{})
+				}
+			}
+			if next != len(tt.want) {
+				t.Fatalf("缺少事件 %s: %s", tt.want[next], w.Body)
+			}
+			usage := completed["usage"].(map[string]interface{})
+			if intValue(usage["input_tokens"]) != tt.usage[0] || intValue(usage["output_tokens"]) != tt.usage[1] {
+				t.Fatalf("usage = %v, want %v", usage, tt.usage)
+			}
+		})
+	}
+}
+
+func TestResponsesScopedToCaller(t *testing.T) {
+	var lastMessages []interface{}
+	r := newResponsesRouter(t, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var forwarded map[string]interface{}
+		json.Unmarshal(body, &forwarded)
+		lastMessages, _ = forwarded["messages"].([]interface{})
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		echoTarget(w, req)
+	})
+	alice := map[string]string{"Authorization": "Bearer alice-key"}
+	bob := map[string]string{"Authorization": "Bearer bob-key"}
+
+	w := serveRequest(r, http.MethodPost, "/v1/responses", `{"model":"m","input":"secret"}`, alice)
+	var created ResponseObject
+	json.Unmarshal(w.Body.Bytes(), &created)
+	path := "/v1/responses/" + created.ID
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		status int
+	}{
+		{"其他调用方查询", http.MethodGet, path, "", bob, http.StatusNotFound},
+		{"未携带Key查询", http.MethodGet, path, "", nil, http.StatusNotFound},
+		{"其他调用方删除", http.MethodDelete, path, "", bob, http.StatusNotFound},
+		{"其他调用方接续", http.MethodPost, "/v1/responses", `{"model":"m","input":"more","previous_response_id":"` + created.ID + `"}`, bob, http.StatusNotFound},
+		{"同一调用方查询", http.MethodGet, path, "", alice, http.StatusOK},
+		{"同一调用方接续", http.MethodPost, "/v1/responses", `{"model":"m","input":"more","previous_response_id":"` + created.ID + `"}`, alice, http.StatusOK},
+		{"同一调用方删除", http.MethodDelete, path, "", alice, http.StatusOK},
+		{"删除后查询", http.MethodGet, path, "", alice, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveRequest(r, tt.method, tt.path, tt.body, tt.header); w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	// 接续时带上之前的对话：user secret、assistant回复、user more
+	if len(lastMessages) != 3 {
+		t.Fatalf("forwarded messages = %v", lastMessages)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 上游重试策略
+type RetryPolicy struct {
+	MaxAttempts       int      `json:"max_attempts"`        // 最大尝试次数（含首次），1表示不重试
+	RetryableStatus   []int    `json:"retryable_status"`    // 可重试的HTTP状态码
+	RetryableErrors   []string `json:"retryable_errors"`    // 可重试的网络错误：connection_refused、connection_reset、timeout、eof、dns
+	InitialBackoff    Duration `json:"initial_backoff"`     // 首次重试前等待时间
+	MaxBackoff        Duration `json:"max_backoff"`         // 退避等待上限
+	Jitter            float64  `json:"jitter"`              // 随机抖动比例（0~1）
+	RespectRetryAfter *bool    `json:"respect_retry_after"` // 是否遵循上游的Retry-After
+	MaxRetryAfter     Duration `json:"max_retry_after"`     // Retry-After超过该值时不再重试
+	BudgetRatio       float64  `json:"budget_ratio"`        // 重试预算：重试次数最多占请求数的比例
+	BudgetMinRetries  int      `json:"budget_min_retries"`  // 重试预算的初始额度
+}
+
+// 填充重试策略默认值（可被RETRY_*环境变量覆盖）
+func (p *RetryPolicy) applyDefaults() {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = getEnvInt("RETRY_MAX_ATTEMPTS", 3)
+	}
+	if p.RetryableStatus == nil {
+		p.RetryableStatus = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if p.RetryableErrors == nil {
+		p.RetryableErrors = []string{"connection_refused", "connection_reset", "eof"}
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = Duration(getEnvDuration("RETRY_INITIAL_BACKOFF", 200*time.Millisecond))
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = Duration(getEnvDuration("RETRY_MAX_BACKOFF", 2*time.Second))
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = 0.2
+	}
+	if p.RespectRetryAfter == nil {
+		respect := true
+		p.RespectRetryAfter = &respect
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = Duration(10 * time.Second)
+	}
+	if p.BudgetRatio <= 0 {
+		p.BudgetRatio = 0.2
+	}
+	if p.BudgetMinRetries <= 0 {
+		p.BudgetMinRetries = 10
+	}
+}
+
+// 判断状态码是否可重试
+func (p *RetryPolicy) statusRetryable(status int) bool {
+	for _, s := range p.RetryableStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断网络错误是否可重试
+func (p *RetryPolicy) errorRetryable(err error) bool {
+	kind := classifyNetworkError(err)
+	for _, e := range p.RetryableErrors {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// 计算第attempt次重试前的等待时间（指数退避+抖动）
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := time.Duration(p.InitialBackoff)
+	for i := 1; i < attempt && d < time.Duration(p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if d > time.Duration(p.MaxBackoff) {
+		d = time.Duration(p.MaxBackoff)
+	}
+	return time.Duration(float64(d) * (1 - p.Jitter*rand.Float64()))
+}
+
+// 网络错误分类
+func classifyNetworkError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection_reset"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "connection_reset"
+	default:
+		return "other"
+	}
+}
+
+// 重试原因（用于指标）：状态码或网络错误分类
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		return classifyNetworkError(err)
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+// 解析Retry-After（秒数或HTTP日期），无效时返回false
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// 重试预算：每个请求存入ratio个额度，每次重试消耗1个，避免上游故障时重试风暴
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64, minRetries int) *retryBudget {
+	return &retryBudget{ratio: ratio, max: float64(minRetries), tokens: float64(minRetries)}
+}
+
+// 记录一次请求
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// 尝试消耗一次重试额度
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 按ctx等待一段时间，ctx结束时返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second), Jitter: 0.2}
+	tests := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // 不超过max_backoff
+		{10, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				// 抖动只会缩短等待时间，最多缩短jitter比例
+				d := p.backoff(tt.attempt)
+				if d > tt.base || d < time.Duration(float64(tt.base)*0.8) {
+					t.Fatalf("backoff(%d) = %s, want within [%s, %s]", tt.attempt, d, time.Duration(float64(tt.base)*0.8), tt.base)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.5, 2)
+	steps := []struct {
+		deposits int
+		want     bool
+	}{
+		{0, true}, // 初始额度
+		{0, true},
+		{0, false}, // 额度用完
+		{1, false}, // 0.5个额度不够一次重试
+		{1, true},
+		{10, true}, // 额度不超过初始额度
+		{0, true},
+		{0, false},
+	}
+	for i, step := range steps {
+		for j := 0; j < step.deposits; j++ {
+			b.deposit()
+		}
+		if got := b.withdraw(); got != step.want {
+			t.Fatalf("step %d: withdraw = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestClassifyNetworkError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), "connection_refused"},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), "connection_reset"},
+		{fmt.Errorf("write: %w", syscall.EPIPE), "connection_reset"},
+		{&net.DNSError{Err: "no such host", Name: "x"}, "dns"},
+		{context.DeadlineExceeded, "timeout"},
+		{io.ErrUnexpectedEOF, "eof"},
+		{fmt.Errorf("http2: connection reset by peer"), "connection_reset"},
+		{fmt.Errorf("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := classifyNetworkError(tt.err); got != tt.want {
+			t.Errorf("classify(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"3", 3 * time.Second, true},
+		{" 0 ", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true}, // 过去的时间视为立即重试
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+	if d, ok := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); !ok || d <= 50*time.Second || d > time.Minute {
+		t.Errorf("HTTP日期 = %s, %v", d, ok)
+	}
+}
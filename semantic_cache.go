@@ -0,0 +1,379 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// 语义缓存配置（SEMANTIC_CACHE_MODEL为空时关闭）
+var semanticCache struct {
+	upstream  *EmbeddingUpstream
+	model     string  // 计算问题向量使用的Embedding模型
+	threshold float64 // 命中所需的最低余弦相似度
+	scope     string  // key：按调用方API Key隔离；global：所有调用方共享
+	index     *semanticIndex
+}
+
+// 语义缓存中的一条：最后一条用户消息的向量和对应的目标服务响应
+type semanticEntry struct {
+	ID        string          `json:"id"`
+	Key       string          `json:"key"`   // 调用方API Key标识（scope为global时为global）
+	Model     string          `json:"model"` // 请求的模型
+	Prompt    string          `json:"prompt"`
+	CreatedAt time.Time       `json:"created_at"`
+	Hits      int             `json:"hits"`
+	Response  *cachedResponse `json:"response,omitempty"`
+
+	scope  string // Key、模型和上下文（除最后一条用户消息外的请求内容）的组合
+	vector []float64
+	elem   *list.Element
+}
+
+// 本地向量索引：按scope分组线性扫描，超过条数上限或过期时按写入顺序淘汰
+type semanticIndex struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List // 按写入时间排序，最早的在前
+	byID       map[string]*semanticEntry
+	byScope    map[string]map[string]*semanticEntry
+}
+
+// 初始化语义缓存：SEMANTIC_CACHE_MODEL（须在EMBEDDING_UPSTREAMS中配置）、SEMANTIC_CACHE_THRESHOLD、
+// SEMANTIC_CACHE_TTL、SEMANTIC_CACHE_MAX_ENTRIES、SEMANTIC_CACHE_SCOPE
+// 须在initEmbeddingConfig之后调用
+func initSemanticCache() {
+	semanticCache.upstream = nil
+	semanticCache.model = getEnv("SEMANTIC_CACHE_MODEL", "")
+	if semanticCache.model == "" {
+		return
+	}
+	semanticCache.upstream = findEmbeddingUpstream(semanticCache.model)
+	if semanticCache.upstream == nil {
+		slog.Error("SEMANTIC_CACHE_MODEL没有对应的Embedding上游，已关闭语义缓存", "model", semanticCache.model)
+		return
+	}
+	threshold, err := strconv.ParseFloat(getEnv("SEMANTIC_CACHE_THRESHOLD", "0.92"), 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		slog.Warn("SEMANTIC_CACHE_THRESHOLD无效，使用默认值0.92", "value", getEnv("SEMANTIC_CACHE_THRESHOLD", ""))
+		threshold = 0.92
+	}
+	semanticCache.threshold = threshold
+	semanticCache.scope = getEnv("SEMANTIC_CACHE_SCOPE", "key")
+	if semanticCache.scope != "global" {
+		semanticCache.scope = "key"
+	}
+	semanticCache.index = &semanticIndex{
+		maxEntries: getEnvInt("SEMANTIC_CACHE_MAX_ENTRIES", 10000),
+		ttl:        getEnvDuration("SEMANTIC_CACHE_TTL", 24*time.Hour),
+		order:      list.New(),
+		byID:       make(map[string]*semanticEntry),
+		byScope:    make(map[string]map[string]*semanticEntry),
+	}
+	slog.Info("语义缓存", "model", semanticCache.model, "upstream", semanticCache.upstream.Name,
+		"threshold", threshold, "scope", semanticCache.scope, "ttl", semanticCache.index.ttl.String())
+}
+
+// 取最后一条用户消息的文本，以及其余请求内容（之前的消息、工具定义、输出格式）的哈希
+// 只有上下文相同、最后的问题语义相近的请求才会命中；最后一条消息不是用户消息时不缓存
+func semanticPrompt(openaiRequest map[string]interface{}) (string, string, bool) {
+	messages, _ := openaiRequest["messages"].([]interface{})
+	if len(messages) == 0 {
+		return "", "", false
+	}
+	last, _ := messages[len(messages)-1].(map[string]interface{})
+	if stringValue(last["role"]) != "user" {
+		return "", "", false
+	}
+	prompt, err := responseContentText(last["content"])
+	if err != nil || strings.TrimSpace(prompt) == "" {
+		return "", "", false
+	}
+	rest, err := json.Marshal([]interface{}{messages[:len(messages)-1], openaiRequest["tools"], openaiRequest["tool_choice"], openaiRequest["response_format"]})
+	if err != nil {
+		return "", "", false
+	}
+	sum := sha256.Sum256(rest)
+	return prompt, hex.EncodeToString(sum[:]), true
+}
+
+// 查询语义缓存：命中时返回缓存的响应，未命中时返回写入回调
+// 计算向量失败只记录日志，不影响请求
+func lookupSemanticCache(ctx context.Context, openaiRequest map[string]interface{}) (cacheStore, *http.Response) {
+	if semanticCache.upstream == nil {
+		return nil, nil
+	}
+	prompt, contextHash, ok := semanticPrompt(openaiRequest)
+	if !ok {
+		return nil, nil
+	}
+	lookup, storable := cacheDirectives(ctx)
+	if !lookup && !storable {
+		setResponseHeader(ctx, "X-Semantic-Cache", "BYPASS")
+		metricSemanticCache.add(1, "bypass")
+		return nil, nil
+	}
+
+	key := "global"
+	if semanticCache.scope == "key" {
+		key = "anonymous"
+		if info := getRequestInfo(ctx); info != nil {
+			key = info.Key
+		}
+	}
+	model := stringValue(openaiRequest["model"])
+	scope := key + "\n" + model + "\n" + contextHash
+
+	vectors, _, _, err := getEmbeddings(ctx, semanticCache.upstream, semanticCache.model, []interface{}{prompt})
+	if err != nil {
+		logger(ctx).Warn("计算语义缓存向量失败，跳过语义缓存", "upstream", semanticCache.upstream.Name, "error", err)
+		metricSemanticCache.add(1, "error")
+		return nil, nil
+	}
+	vector := normalizeVector(vectors[0])
+
+	store := func(entry *cachedResponse) {
+		semanticCache.index.add(&semanticEntry{
+			ID:        "sem_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Key:       key,
+			Model:     model,
+			Prompt:    prompt,
+			CreatedAt: entry.CreatedAt,
+			Response:  entry,
+			scope:     scope,
+			vector:    vector,
+		})
+	}
+	if !lookup {
+		setResponseHeader(ctx, "X-Semantic-Cache", "BYPASS")
+		metricSemanticCache.add(1, "bypass")
+		return store, nil
+	}
+
+	entry, similarity := semanticCache.index.search(scope, vector, semanticCache.threshold)
+	if entry == nil {
+		setResponseHeader(ctx, "X-Semantic-Cache", "MISS")
+		metricSemanticCache.add(1, "miss")
+		return store, nil
+	}
+	setResponseHeader(ctx, "X-Semantic-Cache", "HIT")
+	setResponseHeader(ctx, "X-Semantic-Cache-Similarity", strconv.FormatFloat(similarity, 'f', 4, 64))
+	setResponseHeader(ctx, "X-Semantic-Cache-Entry", entry.ID)
+	metricSemanticCache.add(1, "hit")
+	recordServedBy(ctx, entry.Response.Upstream, entry.Response.Model)
+	isStream, _ := strconv.ParseBool(stringValue(openaiRequest["stream"]))
+	return nil, entry.Response.response(isStream)
+}
+
+// L2归一化，之后余弦相似度即为点积
+func normalizeVector(vec []float64) []float64 {
+	var norm float64
+	for _, x := range vec {
+		norm += x * x
+	}
+	out := make([]float64, len(vec))
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, x := range vec {
+		out[i] = x / norm
+	}
+	return out
+}
+
+func dotProduct(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// 加入一条，超过条数上限时淘汰最早写入的
+func (idx *semanticIndex) add(entry *semanticEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry.elem = idx.order.PushBack(entry)
+	idx.byID[entry.ID] = entry
+	if idx.byScope[entry.scope] == nil {
+		idx.byScope[entry.scope] = make(map[string]*semanticEntry)
+	}
+	idx.byScope[entry.scope][entry.ID] = entry
+	for idx.maxEntries > 0 && idx.order.Len() > idx.maxEntries {
+		idx.remove(idx.order.Front().Value.(*semanticEntry))
+	}
+}
+
+// 移除一条（调用方需持有idx.mu）
+func (idx *semanticIndex) remove(entry *semanticEntry) {
+	idx.order.Remove(entry.elem)
+	delete(idx.byID, entry.ID)
+	delete(idx.byScope[entry.scope], entry.ID)
+	if len(idx.byScope[entry.scope]) == 0 {
+		delete(idx.byScope, entry.scope)
+	}
+}
+
+// 清理过期条目（调用方需持有idx.mu）
+func (idx *semanticIndex) expire() {
+	if idx.ttl <= 0 {
+		return
+	}
+	for elem := idx.order.Front(); elem != nil; elem = idx.order.Front() {
+		entry := elem.Value.(*semanticEntry)
+		if time.Since(entry.CreatedAt) <= idx.ttl {
+			break
+		}
+		idx.remove(entry)
+	}
+}
+
+// 在同一scope中查找相似度最高且不低于阈值的条目
+func (idx *semanticIndex) search(scope string, vector []float64, threshold float64) (*semanticEntry, float64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.expire()
+	var best *semanticEntry
+	bestScore := threshold
+	for _, entry := range idx.byScope[scope] {
+		if score := dotProduct(entry.vector, vector); score >= bestScore {
+			best, bestScore = entry, score
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	best.Hits++
+	return best, bestScore
+}
+
+// 按调用方Key和模型筛选条目（空串表示不限），按写入时间排序
+func (idx *semanticIndex) filter(key, model string) []*semanticEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.expire()
+	var entries []*semanticEntry
+	for elem := idx.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*semanticEntry)
+		if (key == "" || entry.Key == key) && (model == "" || entry.Model == model) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// 条目摘要（列表接口不含响应内容）
+func (e *semanticEntry) summary() gin.H {
+	return gin.H{
+		"id":         e.ID,
+		"object":     "semantic_cache.entry",
+		"key":        e.Key,
+		"model":      e.Model,
+		"prompt":     e.Prompt,
+		"created_at": e.CreatedAt.Unix(),
+		"hits":       e.Hits,
+	}
+}
+
+// 语义缓存管理接口是否可用
+func semanticCacheEnabled(c *gin.Context) bool {
+	if semanticCache.upstream == nil {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", "语义缓存未开启"})
+		return false
+	}
+	return true
+}
+
+// 列出语义缓存条目（GET /admin/semantic-cache?key=&model=）
+func listSemanticCacheHandler(c *gin.Context) {
+	if !semanticCacheEnabled(c) {
+		return
+	}
+	entries := semanticCache.index.filter(c.Query("key"), c.Query("model"))
+	data := make([]gin.H, 0, len(entries))
+	semanticCache.index.mu.Lock()
+	for _, entry := range entries {
+		data = append(data, entry.summary())
+	}
+	semanticCache.index.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": data})
+}
+
+// 查看一条语义缓存，含缓存的响应（GET /admin/semantic-cache/:id）
+func getSemanticCacheHandler(c *gin.Context) {
+	if !semanticCacheEnabled(c) {
+		return
+	}
+	idx := semanticCache.index
+	idx.mu.Lock()
+	entry, ok := idx.byID[c.Param("id")]
+	var result gin.H
+	if ok {
+		result = entry.summary()
+		result["response"] = entry.Response
+	}
+	idx.mu.Unlock()
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到语义缓存条目: %s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// 删除一条语义缓存（DELETE /admin/semantic-cache/:id）
+func deleteSemanticCacheHandler(c *gin.Context) {
+	if !semanticCacheEnabled(c) {
+		return
+	}
+	id := c.Param("id")
+	idx := semanticCache.index
+	idx.mu.Lock()
+	entry, ok := idx.byID[id]
+	if ok {
+		idx.remove(entry)
+	}
+	idx.mu.Unlock()
+	if !ok {
+		writeProxyError(c, &proxyError{http.StatusNotFound, "invalid_request_error", fmt.Sprintf("未找到语义缓存条目: %s", id)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "semantic_cache.entry.deleted", "deleted": true})
+}
+
+// 清空语义缓存，可按调用方Key和模型筛选（DELETE /admin/semantic-cache?key=&model=）
+func purgeSemanticCacheHandler(c *gin.Context) {
+	if !semanticCacheEnabled(c) {
+		return
+	}
+	entries := semanticCache.index.filter(c.Query("key"), c.Query("model"))
+	idx := semanticCache.index
+	idx.mu.Lock()
+	purged := 0
+	for _, entry := range entries {
+		if idx.byID[entry.ID] == entry {
+			idx.remove(entry)
+			purged++
+		}
+	}
+	idx.mu.Unlock()
+	slog.Info("清空语义缓存", "key", c.Query("key"), "model", c.Query("model"), "purged", purged)
+	c.JSON(http.StatusOK, gin.H{"object": "semantic_cache.purged", "purged": purged})
+}
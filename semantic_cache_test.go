@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// 启动Embedding服务（包含weather的文本向量相同，其余文本正交）并开启语义缓存
+func startSemanticCacheBackend(t *testing.T) *int64 {
+	t.Helper()
+	embeddingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		data := make([]map[string]interface{}, len(req.Input))
+		for i, text := range req.Input {
+			vector := []float64{0, 1}
+			if strings.Contains(text, "weather") {
+				vector = []float64{1, 0.01}
+			}
+			data[i] = map[string]interface{}{"index": i, "embedding": vector}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(embeddingServer.Close)
+	t.Cleanup(func() { semanticCache.upstream = nil })
+	t.Setenv("EMBEDDING_UPSTREAMS", fmt.Sprintf(`[{"name":"emb","url":%q,"models":["emb"]}]`, embeddingServer.URL))
+	t.Setenv("SEMANTIC_CACHE_MODEL", "emb")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	return startTestBackend(t, echoTarget)
+}
+
+func TestSemanticCache(t *testing.T) {
+	hits := startSemanticCacheBackend(t)
+	router := newRouter()
+	chat := func(key, text string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":%q}]}`, text)
+		return serveRequest(router, http.MethodPost, "/chat/completions", body, map[string]string{"Authorization": "Bearer " + key})
+	}
+
+	steps := []struct {
+		key, text string
+		cache     string
+		hits      int64
+		content   string
+	}{
+		{"alice", "what is the weather in Paris", "MISS", 1, "echo:what is the weather in Paris"},
+		{"alice", "Paris weather today?", "HIT", 1, "echo:what is the weather in Paris"},
+		{"alice", "tell me a joke", "MISS", 2, "echo:tell me a joke"},
+		{"bob", "Paris weather today?", "MISS", 3, "echo:Paris weather today?"}, // 按调用方Key隔离
+	}
+	for i, step := range steps {
+		w := chat(step.key, step.text)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), step.content) {
+			t.Fatalf("step %d: status = %d: %s", i, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Semantic-Cache"); got != step.cache {
+			t.Fatalf("step %d: X-Semantic-Cache = %s, want %s", i, got, step.cache)
+		}
+		if got := atomic.LoadInt64(hits); got != step.hits {
+			t.Fatalf("step %d: target hits = %d, want %d", i, got, step.hits)
+		}
+		if step.cache == "HIT" && (w.Header().Get("X-Semantic-Cache-Similarity") == "" || w.Header().Get("X-Semantic-Cache-Entry") == "") {
+			t.Fatalf("step %d: 命中时应返回相似度和条目ID: %v", i, w.Header())
+		}
+	}
+
+	// Cache-Control: no-cache跳过查询
+	body := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"Paris weather today?"}]}`
+	w := serveRequest(router, http.MethodPost, "/chat/completions", body, map[string]string{"Authorization": "Bearer alice", "Cache-Control": "no-cache"})
+	if w.Header().Get("X-Semantic-Cache") != "BYPASS" || atomic.LoadInt64(hits) != 4 {
+		t.Fatalf("no-cache: X-Semantic-Cache = %s, hits = %d", w.Header().Get("X-Semantic-Cache"), *hits)
+	}
+}
+
+func TestSemanticCacheAdmin(t *testing.T) {
+	startSemanticCacheBackend(t)
+	router := newRouter()
+	for _, key := range []string{"alice", "bob"} {
+		body := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"weather"}]}`
+		serveRequest(router, http.MethodPost, "/chat/completions", body, map[string]string{"Authorization": "Bearer " + key})
+	}
+	admin := map[string]string{"Authorization": "Bearer secret"}
+
+	if w := serveRequest(router, http.MethodGet, "/admin/semantic-cache", "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("未携带管理Token: status = %d", w.Code)
+	}
+	w := serveRequest(router, http.MethodGet, "/admin/semantic-cache?key="+apiKeyLabelFor("alice"), "", admin)
+	var list struct {
+		Data []struct {
+			ID     string `json:"id"`
+			Prompt string `json:"prompt"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 || list.Data[0].Prompt != "weather" {
+		t.Fatalf("list = %d: %s", w.Code, w.Body)
+	}
+	id := list.Data[0].ID
+
+	if w := serveRequest(router, http.MethodGet, "/admin/semantic-cache/"+id, "", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"response"`) {
+		t.Fatalf("get = %d: %s", w.Code, w.Body)
+	}
+	if w := serveRequest(router, http.MethodDelete, "/admin/semantic-cache/"+id, "", admin); w.Code != http.StatusOK {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+	if w := serveRequest(router, http.MethodGet, "/admin/semantic-cache/"+id, "", admin); w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted = %d: %s", w.Code, w.Body)
+	}
+	if w := serveRequest(router, http.MethodDelete, "/admin/semantic-cache", "", admin); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":1`) {
+		t.Fatalf("purge = %d: %s", w.Code, w.Body)
+	}
+}
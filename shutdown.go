@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 排空超时后中断剩余请求时使用的取消原因
+var errShuttingDown = errors.New("服务正在停机")
+
+// 进行中的HTTP请求数
+var inflightRequests atomic.Int64
+
+// 停机时需要执行的清理函数（停止后台任务、刷新日志等），按注册的逆序执行
+var shutdownHooks struct {
+	mu    sync.Mutex
+	hooks []func()
+}
+
+// 注册停机清理函数
+func onShutdown(fn func()) {
+	shutdownHooks.mu.Lock()
+	defer shutdownHooks.mu.Unlock()
+	shutdownHooks.hooks = append(shutdownHooks.hooks, fn)
+}
+
+func runShutdownHooks() {
+	shutdownHooks.mu.Lock()
+	hooks := shutdownHooks.hooks
+	shutdownHooks.hooks = nil
+	shutdownHooks.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// 统计进行中的请求
+func inflightMiddleware(c *gin.Context) {
+	inflightRequests.Add(1)
+	defer inflightRequests.Add(-1)
+	c.Next()
+}
+
+// 客户端是否已断开（区别于停机导致的请求中断）
+func clientGone(ctx context.Context) bool {
+	return ctx.Err() != nil && !errors.Is(context.Cause(ctx), errShuttingDown)
+}
+
+// 请求Context结束时返回的错误：停机中断时返回可输出给客户端的错误
+func contextError(ctx context.Context) error {
+	if errors.Is(context.Cause(ctx), errShuttingDown) {
+		return &proxyError{http.StatusServiceUnavailable, "server_shutdown", "服务正在停机，响应已中断，请重试"}
+	}
+	return ctx.Err()
+}
+
+// 启动HTTP服务并在收到SIGINT/SIGTERM时优雅停机：
+// 1. 标记未就绪，等待ShutdownDelay让负载均衡摘除本实例
+// 2. 停止接受新连接，最多等待DrainTimeout让进行中的请求和流式响应完成
+// 3. 超时后中断剩余请求，流式响应以错误事件结束
+// 4. 执行停机清理函数（逆序执行，初始化时注册的追踪导出器最后刷新并关闭）
+func serveWithGracefulShutdown(handler http.Handler) error {
+	baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+	srv := &http.Server{
+		Addr:        ":" + config.ServerPort,
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		stop()
+		runShutdownHooks()
+		return err
+	case <-sigCtx.Done():
+	}
+	// 再次收到信号时按默认行为立即退出
+	stop()
+
+	slog.Info("收到停止信号，开始停机", "inflight", inflightRequests.Load())
+	setDraining()
+	time.Sleep(config.ShutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("排空超时，中断剩余请求", "inflight", inflightRequests.Load())
+		cancelRequests(errShuttingDown)
+		// 给处理函数留出输出结束事件的时间
+		deadline := time.Now().Add(5 * time.Second)
+		for inflightRequests.Load() > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		srv.Close()
+	}
+
+	runShutdownHooks()
+	slog.Info("服务已停止")
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunShutdownHooks(t *testing.T) {
+	var order []int
+	for i := 1; i <= 3; i++ {
+		i := i
+		onShutdown(func() { order = append(order, i) })
+	}
+	runShutdownHooks()
+	runShutdownHooks() // 已执行过的清理函数不再执行
+	if fmt.Sprint(order) != "[3 2 1]" {
+		t.Fatalf("order = %v, want [3 2 1]", order)
+	}
+}
+
+func TestContextError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	shutdown, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(errShuttingDown)
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		clientGone bool
+		wantType   string // contextError为*proxyError时的类型
+	}{
+		{"未结束", context.Background(), false, ""},
+		{"客户端断开", canceled, true, ""},
+		{"停机中断", shutdown, false, "server_shutdown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientGone(tt.ctx); got != tt.clientGone {
+				t.Fatalf("clientGone = %v, want %v", got, tt.clientGone)
+			}
+			if tt.ctx.Err() == nil {
+				return
+			}
+			pe, ok := contextError(tt.ctx).(*proxyError)
+			if tt.wantType == "" && ok || tt.wantType != "" && (!ok || pe.Type != tt.wantType) {
+				t.Fatalf("contextError = %v", contextError(tt.ctx))
+			}
+		})
+	}
+}
+
+// 向客户端输出第一段内容（partial）后触发停机的ResponseRecorder
+type shutdownAfterWrite struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelCauseFunc
+}
+
+func (w *shutdownAfterWrite) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "partial") {
+		defer w.cancel(errShuttingDown)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *shutdownAfterWrite) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestStreamInterruptedByShutdown(t *testing.T) {
+	// 目标服务输出第一个chunk后一直等到连接被关闭
+	startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"content\":\"partial\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	w := &shutdownAfterWrite{httptest.NewRecorder(), cancel}
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)).WithContext(ctx)
+	newRouter().ServeHTTP(w, req)
+
+	body := w.Body.String()
+	if !strings.Contains(body, "partial") || !strings.Contains(body, `"type":"server_shutdown"`) {
+		t.Fatalf("停机中断的流应以错误事件结束: %s", body)
+	}
+	if strings.Contains(body, "[DONE]") {
+		t.Fatalf("被中断的流不应输出[DONE]: %s", body)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 链路追踪：按OpenTelemetry数据模型记录Span，支持W3C traceparent传播，
+// 导出到OTLP/HTTP（JSON编码）、文件或标准输出
+
+// Span类型（与OTLP的SpanKind取值一致）
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type span struct {
+	mu         sync.Mutex
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	statusCode int // 0未设置、1成功、2错误
+	statusMsg  string
+	ended      bool
+}
+
+type spanKey struct{}
+
+// 追踪配置
+var tracing struct {
+	enabled     bool
+	sampleRatio float64
+	serviceName string
+	exporter    spanExporter
+	queue       chan *span
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Span导出器
+type spanExporter interface {
+	export(spans []*span) error
+	// 停机时调用：落盘并释放导出器持有的文件、连接
+	close() error
+}
+
+// 初始化链路追踪（TRACING_EXPORTER：otlp、file、stdout，为空时关闭）
+func initTracing() {
+	tracing.enabled = false
+	var exporter spanExporter
+	switch kind := getEnv("TRACING_EXPORTER", ""); kind {
+	case "":
+		return
+	case "otlp":
+		endpoint := getEnv("TRACING_OTLP_ENDPOINT", "http://localhost:4318/v1/traces")
+		exporter = &otlpExporter{endpoint: endpoint, headers: parseHeaderList(getEnv("TRACING_OTLP_HEADERS", "")), client: &http.Client{Timeout: 10 * time.Second}}
+		slog.Info("链路追踪：OTLP导出", "endpoint", endpoint)
+	case "file":
+		path := getEnv("TRACING_FILE", "traces.jsonl")
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("打开追踪文件失败，已关闭链路追踪", "error", err)
+			return
+		}
+		exporter = &writerExporter{w: f}
+		slog.Info("链路追踪：写入文件", "path", path)
+	case "stdout":
+		exporter = &writerExporter{w: os.Stdout}
+		slog.Info("链路追踪：输出到标准输出")
+	default:
+		slog.Error("不支持的TRACING_EXPORTER，已关闭链路追踪", "exporter", kind)
+		return
+	}
+
+	ratio, err := strconv.ParseFloat(getEnv("TRACING_SAMPLE_RATIO", "1"), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		ratio = 1
+	}
+	tracing.enabled = true
+	tracing.sampleRatio = ratio
+	tracing.serviceName = getEnv("TRACING_SERVICE_NAME", "openai-gateway")
+	tracing.exporter = exporter
+	tracing.queue = make(chan *span, 4096)
+	tracing.stop = make(chan struct{})
+	tracing.done = make(chan struct{})
+	go runSpanExporter(getEnvDuration("TRACING_FLUSH_INTERVAL", 5*time.Second))
+	onShutdown(stopTracing)
+}
+
+// 解析"k1=v1,k2=v2"格式的Header列表
+func parseHeaderList(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return headers
+}
+
+// 后台批量导出Span
+func runSpanExporter(interval time.Duration) {
+	defer close(tracing.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*span
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := tracing.exporter.export(batch); err != nil {
+			slog.Warn("导出追踪数据失败", "dropped_spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-tracing.queue:
+				batch = append(batch, s)
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case s := <-tracing.queue:
+			batch = append(batch, s)
+			if len(batch) >= 512 {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-tracing.stop:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+// 停机时导出剩余Span，然后刷新并关闭导出器
+func stopTracing() {
+	if !tracing.enabled {
+		return
+	}
+	close(tracing.stop)
+	<-tracing.done
+	if err := tracing.exporter.close(); err != nil {
+		fmt.Printf("关闭追踪导出器失败: %s\n", err)
+	}
+}
+
+// 开始一个Span：有父Span时继承trace，否则按采样率新建trace；未开启追踪时返回nil
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if !tracing.enabled {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mrand.Float64() < tracing.sampleRatio
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// 以传入的W3C traceparent为父开始服务端Span
+func startServerSpan(ctx context.Context, name, traceparent string) (context.Context, *span) {
+	if !tracing.enabled {
+		return ctx, nil
+	}
+	if parent, ok := parseTraceparent(traceparent); ok {
+		ctx = context.WithValue(ctx, spanKey{}, parent)
+	}
+	return startSpan(ctx, name, spanKindServer)
+}
+
+// 解析traceparent（00-<trace-id>-<parent-id>-<flags>）
+func parseTraceparent(value string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+	return s, true
+}
+
+// 当前Span的traceparent，用于向目标服务传播
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// 把当前Span的trace上下文写入请求Header
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok && s != nil {
+		header.Set("traceparent", s.traceparent())
+	}
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// 标记Span失败
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode, s.statusMsg = 2, err.Error()
+}
+
+// 结束Span并交给导出器（未采样的Span直接丢弃）
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case tracing.queue <- s:
+	default:
+		// 队列满时丢弃，避免阻塞请求
+	}
+}
+
+// 在入站Span上记录GenAI语义约定属性
+func setGenAIAttributes(s *span, info *requestInfo) {
+	if s == nil || (info.RequestedModel == "" && info.Model == "") {
+		return
+	}
+	s.setAttr("gen_ai.operation.name", "chat")
+	if info.RequestedModel != "" {
+		s.setAttr("gen_ai.request.model", info.RequestedModel)
+	}
+	if info.Model != "" {
+		s.setAttr("gen_ai.response.model", info.Model)
+	}
+	if info.PromptTokens > 0 {
+		s.setAttr("gen_ai.usage.input_tokens", info.PromptTokens)
+	}
+	if info.CompletionTokens > 0 {
+		s.setAttr("gen_ai.usage.output_tokens", info.CompletionTokens)
+	}
+	if info.FinishReason != "" {
+		s.setAttr("gen_ai.response.finish_reasons", []string{info.FinishReason})
+	}
+	if info.Upstream != "" {
+		s.setAttr("gateway.upstream", info.Upstream)
+	}
+	if len(info.Failover) > 0 {
+		s.setAttr("gateway.failover", info.Failover)
+	}
+}
+
+// 为每个入站请求创建服务端Span
+func tracingMiddleware(c *gin.Context) {
+	if !tracing.enabled {
+		c.Next()
+		return
+	}
+	ctx, s := startServerSpan(c.Request.Context(), c.Request.Method+" "+getRequestInfo(c.Request.Context()).Route, c.GetHeader("traceparent"))
+	c.Request = c.Request.WithContext(ctx)
+	s.setAttr("http.request.method", c.Request.Method)
+	s.setAttr("http.route", c.FullPath())
+	s.setAttr("url.path", c.Request.URL.Path)
+	c.Header("traceparent", s.traceparent())
+
+	c.Next()
+
+	status := c.Writer.Status()
+	s.setAttr("http.response.status_code", status)
+	if info := getRequestInfo(c.Request.Context()); info != nil {
+		snap := info.snapshot()
+		s.setAttr("gateway.key", snap.Key)
+		setGenAIAttributes(s, &snap)
+	}
+	if status >= http.StatusInternalServerError {
+		s.setError(fmt.Errorf("状态码%d", status))
+	}
+	s.finish()
+}
+
+// 导出用的Span JSON（OTLP/JSON编码）
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// 属性值转换为OTLP AnyValue
+func otlpValue(v interface{}) map[string]interface{} {
+	switch value := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": value}
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		return map[string]interface{}{"doubleValue": value}
+	case []string:
+		values := make([]map[string]interface{}, 0, len(value))
+		for _, item := range value {
+			values = append(values, otlpValue(item))
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+}
+
+func (s *span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attributes {
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: key, Value: otlpValue(value)})
+	}
+	if s.statusCode != 0 {
+		out.Status = &otlpStatus{Code: s.statusCode, Message: s.statusMsg}
+	}
+	return out
+}
+
+// OTLP/HTTP导出器（JSON编码）
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.toOTLP())
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue(tracing.serviceName)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "openai-gateway"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("OTLP接收端返回状态码%d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// 文件/标准输出导出器：每行一个Span（OTLP/JSON的span结构，附带service.name）
+type writerExporter struct {
+	w io.Writer
+}
+
+// 追踪文件落盘后关闭；标准输出不关闭
+func (e *writerExporter) close() error {
+	f, ok := e.w.(*os.File)
+	if !ok || f == os.Stdout {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (e *writerExporter) export(spans []*span) error {
+	var buf bytes.Buffer
+	for _, s := range spans {
+		line := struct {
+			Service string `json:"service"`
+			otlpSpan
+		}{tracing.serviceName, s.toOTLP()}
+		data, err := json.Marshal(line)
+		if err != nil {
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"采样", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"未采样", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"不支持的版本", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"trace-id全零", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"长度错误", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false, false},
+		{"非十六进制", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ok := parseTraceparent(tt.value)
+			if ok != tt.ok || ok && s.sampled != tt.sampled {
+				t.Fatalf("parseTraceparent = %v, %v", s, ok)
+			}
+			if ok && s.traceparent() != tt.value {
+				t.Fatalf("traceparent() = %s, want %s", s.traceparent(), tt.value)
+			}
+		})
+	}
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	t.Setenv("TRACING_EXPORTER", "file")
+	t.Setenv("TRACING_FILE", path)
+	t.Setenv("TRACING_FLUSH_INTERVAL", "1h") // 只在停机时导出
+	t.Cleanup(func() { tracing.enabled = false })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var upstreamTraceparent string
+	startTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		echoTarget(w, r)
+	})
+	header := map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"}
+	w := serveRequest(newRouter(), http.MethodPost, "/chat/completions", `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"hi"}]}`, header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(upstreamTraceparent, "00-"+traceID+"-") {
+		t.Fatalf("上游收到的traceparent = %q", upstreamTraceparent)
+	}
+
+	// 停机时导出剩余Span并关闭文件
+	exporter := tracing.exporter.(*writerExporter)
+	runShutdownHooks()
+	if _, err := exporter.w.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("停机后追踪文件应已关闭: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := map[string]otlpSpan{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s otlpSpan
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("invalid span line: %s", scanner.Text())
+		}
+		if s.TraceID != traceID {
+			t.Fatalf("span %s traceId = %s, want %s", s.Name, s.TraceID, traceID)
+		}
+		spans[s.Name] = s
+	}
+	server, ok := spans["POST /chat/completions"]
+	if !ok || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Fatalf("服务端Span = %+v", server)
+	}
+	for _, name := range []string{"gateway.token", "gateway.upstream default"} {
+		if s, ok := spans[name]; !ok || s.ParentSpanID != server.SpanID {
+			t.Fatalf("缺少%s或父Span错误: %v", name, spans)
+		}
+	}
+}
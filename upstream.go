@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// JSON配置中的时间间隔（支持"500ms"、"2s"等字符串或纳秒数）
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("时间格式错误: %s", value)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("时间格式错误: %s", string(data))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// 上游服务配置（UPSTREAMS，JSON数组；未配置时由TARGET_URL生成default上游）
+// 上游可以是单个URL，也可以是多个副本组成的池（endpoints）
+type Upstream struct {
+	Name      string      `json:"name"`
+	URL       string      `json:"url"`
+	Endpoints []*Endpoint `json:"endpoints"`
+	Balancer  string      `json:"balancer"` // round_robin（默认）、weighted、least_outstanding、ewma_latency、ewma_ttft
+	Sticky    bool        `json:"sticky"`   // 按x-usersession-id将同一会话固定到同一副本
+	Method    string      `json:"method"`
+	Retry     RetryPolicy `json:"retry"`
+
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+	Breaker     BreakerConfig      `json:"breaker"`
+	Concurrency *ConcurrencyConfig `json:"concurrency"` // 并发限制和优先级队列，未配置时不限制
+
+	budget    *retryBudget
+	pool      *balancer
+	admission *admission
+}
+
+var upstreams []*Upstream
+
+// 初始化上游配置
+func initUpstreams() {
+	var configured []*Upstream
+	if _, err := loadJSONEnv("UPSTREAMS", &configured); err != nil {
+		slog.Error("UPSTREAMS配置错误，已忽略", "error", err)
+		configured = nil
+	}
+	if len(configured) == 0 {
+		configured = []*Upstream{{Name: "default", URL: config.TargetURL}}
+	}
+
+	upstreams = nil
+	for i, upstream := range configured {
+		if upstream.Name == "" {
+			upstream.Name = fmt.Sprintf("upstream-%d", i)
+		}
+		if upstream.Method == "" {
+			upstream.Method = config.TargetMethod
+		}
+		if len(upstream.Endpoints) == 0 {
+			upstream.Endpoints = []*Endpoint{{URL: upstream.URL}}
+		}
+		upstream.Breaker.applyDefaults()
+		if upstream.HealthCheck != nil {
+			upstream.HealthCheck.applyDefaults()
+		}
+		for _, endpoint := range upstream.Endpoints {
+			if endpoint.Weight <= 0 {
+				endpoint.Weight = 1
+			}
+			endpoint.health = newEndpointHealth(&upstream.Breaker)
+		}
+		switch upstream.Balancer {
+		case balanceRoundRobin, balanceWeighted, balanceLeastOutstanding, balanceEWMALatency, balanceEWMATTFT:
+		case "":
+			upstream.Balancer = balanceRoundRobin
+		default:
+			slog.Warn("负载均衡策略不支持，使用默认策略", "upstream", upstream.Name, "balancer", upstream.Balancer, "default", balanceRoundRobin)
+			upstream.Balancer = balanceRoundRobin
+		}
+		upstream.pool = &balancer{strategy: upstream.Balancer, endpoints: upstream.Endpoints}
+		upstream.Retry.applyDefaults()
+		upstream.budget = newRetryBudget(upstream.Retry.BudgetRatio, upstream.Retry.BudgetMinRetries)
+		if upstream.Concurrency != nil && upstream.Concurrency.MaxConcurrent > 0 {
+			upstream.admission = newAdmission(upstream.Name, upstream.Concurrency)
+			slog.Info("上游并发限制", "upstream", upstream.Name, "max_concurrent", upstream.Concurrency.MaxConcurrent,
+				"max_queue", upstream.Concurrency.MaxQueue, "max_queue_time", time.Duration(upstream.Concurrency.MaxQueueTime).String())
+		}
+		upstreams = append(upstreams, upstream)
+		for _, endpoint := range upstream.Endpoints {
+			slog.Info("上游副本", "upstream", upstream.Name, "endpoint", endpoint.URL, "weight", endpoint.Weight, "balancer", upstream.Balancer, "max_attempts", upstream.Retry.MaxAttempts)
+		}
+	}
+}
+
+// 按名称查找上游
+func findUpstream(name string) *Upstream {
+	for _, upstream := range upstreams {
+		if upstream.Name == name {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// 默认上游（配置中的第一个）
+func defaultUpstream() *Upstream {
+	return upstreams[0]
+}